@@ -0,0 +1,589 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-app-be/models"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+type accessDecision struct {
+	ApproverID int    `json:"approver_id"`
+	Note       string `json:"note"`
+	// Fulfilment is "issue" to hand out a copy straight away when one is in stock, or "pickup" to queue it.
+	// A request that starts in the future is always queued until its start date.
+	Fulfilment string `json:"fulfilment"`
+	clearanceOverride
+}
+
+type accessPickup struct {
+	StaffID   int `json:"staff_id"`
+	KeyCopyID int `json:"key_copy_id"`
+	clearanceOverride
+}
+
+const accessRequestColumns = `id, key_id, staff_id, justification, start_date, end_date, status,
+	COALESCE(approver_id, 0), COALESCE(decision_note, ''), COALESCE(key_copy_id, 0), created_at, decided_at`
+
+func scanAccessRequest(row rowScanner) (models.AccessRequest, error) {
+	var ar models.AccessRequest
+	err := row.Scan(&ar.ID, &ar.KeyID, &ar.StaffID, &ar.Justification, &ar.StartDate, &ar.EndDate, &ar.Status,
+		&ar.ApproverID, &ar.DecisionNote, &ar.KeyCopyID, &ar.CreatedAt, &ar.DecidedAt)
+	return ar, err
+}
+
+func queryAccessRequests(db *sql.DB, query string, args ...interface{}) ([]models.AccessRequest, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []models.AccessRequest{}
+	for rows.Next() {
+		ar, err := scanAccessRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, ar)
+	}
+	return requests, rows.Err()
+}
+
+// isAdmin reports whether the staff member has the admin role
+func isAdmin(q queryer, staffID int) (bool, error) {
+	var admin bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM staffs WHERE id = $1 AND LOWER(role) = 'admin')", staffID).Scan(&admin)
+	return admin, err
+}
+
+// canApproveKey reports whether the staff member is the key's custodian or an admin
+func canApproveKey(q queryer, staffID, keyID int) (bool, error) {
+	var allowed bool
+	err := q.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM staffs s
+			WHERE s.id = $1 AND (LOWER(s.role) = 'admin' OR s.id = (SELECT staff_id FROM keys WHERE id = $2))
+		)`, staffID, keyID).Scan(&allowed)
+	return allowed, err
+}
+
+// findIssuableCopy returns a copy of the key that is in stock and not reserved by someone else, or 0 if there is none
+func findIssuableCopy(q queryer, keyID, staffID int) (int, error) {
+	copies, err := keyCopiesForKey(q, keyID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, kc := range copies {
+		if kc.StaffID != 0 {
+			continue
+		}
+		reserved, err := reservedByOther(q, kc.ID, staffID, time.Now())
+		if err != nil {
+			return 0, err
+		}
+		if !reserved {
+			return kc.ID, nil
+		}
+	}
+	return 0, nil
+}
+
+// errCopyNotInStock is returned when a copy was handed out by someone else in the meantime
+var errCopyNotInStock = errors.New("key copy is no longer in stock")
+
+// issueKeyCopy hands an in-stock copy to a staff member and records it in the copy history
+func issueKeyCopy(q queryer, keyCopyID, keyID, staffID, performedBy int, expiresAt *time.Time, note string) error {
+	result, err := q.Exec(
+		"UPDATE key_copies SET staff_id = $1, witness_staff_id = NULL, expires_at = $2, expired = FALSE WHERE id = $3 AND COALESCE(staff_id, 0) = 0 AND status = 'active'",
+		staffID, expiresAt, keyCopyID,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errCopyNotInStock
+	}
+
+	return recordKeyCopyHistory(q, models.KeyCopyHistory{
+		KeyCopyID:   keyCopyID,
+		KeyID:       keyID,
+		Action:      "issued",
+		StaffID:     staffID,
+		PerformedBy: performedBy,
+		Note:        note,
+	})
+}
+
+// extendKeyCopy moves the expiry of a held copy out to at least expiresAt after a new approval and records it
+// in the copy history. An assignment is never shortened, and one with no expiry keeps having none.
+func extendKeyCopy(q queryer, keyCopyID, keyID, staffID, performedBy int, expiresAt *time.Time, note string) error {
+	_, err := q.Exec(`
+		UPDATE key_copies
+		SET expires_at = CASE WHEN expires_at IS NOT NULL THEN GREATEST(expires_at, $1) END,
+			expired = CASE WHEN expires_at IS NOT NULL AND expires_at < $1 THEN FALSE ELSE expired END
+		WHERE id = $2`, expiresAt, keyCopyID)
+	if err != nil {
+		return err
+	}
+
+	return recordKeyCopyHistory(q, models.KeyCopyHistory{
+		KeyCopyID:       keyCopyID,
+		KeyID:           keyID,
+		Action:          "extended",
+		PreviousStaffID: staffID,
+		StaffID:         staffID,
+		PerformedBy:     performedBy,
+		Note:            note,
+	})
+}
+
+// Get a specific access request by ID
+func GetAccessRequest(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		ar, err := scanAccessRequest(db.QueryRow("SELECT "+accessRequestColumns+" FROM access_requests WHERE id = $1", id))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Access request not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving access request: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		json.NewEncoder(w).Encode(ar)
+	}
+}
+
+// Get access requests made by a staff member
+func GetStaffAccessRequests(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		query := "SELECT " + accessRequestColumns + " FROM access_requests WHERE staff_id = $1"
+		queryParams := []interface{}{id}
+		if status := r.URL.Query().Get("status"); status != "" {
+			query += " AND status = $2"
+			queryParams = append(queryParams, status)
+		}
+		query += " ORDER BY created_at DESC"
+
+		requests, err := queryAccessRequests(db, query, queryParams...)
+		if err != nil {
+			log.Printf("Error querying access requests: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(requests)
+	}
+}
+
+// Get pending access requests a staff member can approve, as custodian of the key or as an admin
+func GetPendingApprovals(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		requests, err := queryAccessRequests(db, `
+			SELECT `+accessRequestColumns+`
+			FROM access_requests
+			WHERE status = 'pending' AND staff_id <> $1 AND (
+				key_id IN (SELECT id FROM keys WHERE staff_id = $1)
+				OR EXISTS(SELECT 1 FROM staffs WHERE id = $1 AND LOWER(role) = 'admin')
+			)
+			ORDER BY created_at`, id)
+		if err != nil {
+			log.Printf("Error querying access requests: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(requests)
+	}
+}
+
+// Request access to a key
+func CreateAccessRequest(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ar models.AccessRequest
+		if err := json.NewDecoder(r.Body).Decode(&ar); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if ar.StaffID == 0 || ar.KeyID == 0 {
+			http.Error(w, "staff_id and key_id are required", http.StatusBadRequest)
+			return
+		}
+		if ar.Justification == "" {
+			http.Error(w, "justification is required", http.StatusBadRequest)
+			return
+		}
+		if ar.StartDate.IsZero() {
+			ar.StartDate = time.Now()
+		}
+		if !ar.EndDate.After(ar.StartDate) {
+			http.Error(w, "end_date must be after start_date", http.StatusBadRequest)
+			return
+		}
+
+		var exists bool
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM staffs WHERE id = $1)", ar.StaffID).Scan(&exists)
+		if err != nil {
+			log.Printf("Error checking staff existence: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Staff ID does not exist", http.StatusBadRequest)
+			return
+		}
+
+		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM keys WHERE id = $1)", ar.KeyID).Scan(&exists)
+		if err != nil {
+			log.Printf("Error checking key existence: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Key ID does not exist", http.StatusBadRequest)
+			return
+		}
+
+		err = db.QueryRow(
+			"INSERT INTO access_requests (key_id, staff_id, justification, start_date, end_date) VALUES ($1, $2, $3, $4, $5) RETURNING id, status, created_at",
+			ar.KeyID, ar.StaffID, ar.Justification, ar.StartDate, ar.EndDate,
+		).Scan(&ar.ID, &ar.Status, &ar.CreatedAt)
+		if err != nil {
+			log.Printf("Error creating access request: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(ar)
+	}
+}
+
+// Approve an access request, issuing a copy straight away or queueing it for pickup
+func ApproveAccessRequest(db *sql.DB) http.HandlerFunc {
+	return decideAccessRequest(db, true)
+}
+
+// Reject an access request
+func RejectAccessRequest(db *sql.DB) http.HandlerFunc {
+	return decideAccessRequest(db, false)
+}
+
+func decideAccessRequest(db *sql.DB, approve bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		var d accessDecision
+		if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		ar, err := scanAccessRequest(tx.QueryRow("SELECT "+accessRequestColumns+" FROM access_requests WHERE id = $1 FOR UPDATE", id))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Access request not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving access request: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if ar.Status != "pending" {
+			http.Error(w, "Access request has already been decided", http.StatusConflict)
+			return
+		}
+
+		allowed, err := canApproveKey(tx, d.ApproverID, ar.KeyID)
+		if err != nil {
+			log.Printf("Error checking approver: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !allowed || d.ApproverID == ar.StaffID {
+			http.Error(w, "Only the key custodian or an admin can decide this request", http.StatusForbidden)
+			return
+		}
+
+		ar.Status = "rejected"
+		if approve {
+			ar.Status = "approved"
+
+			_, msg, err := checkClearance(tx, ar.StaffID, ar.KeyID, d.clearanceOverride)
+			if err != nil {
+				log.Printf("Error checking clearance: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if msg != "" {
+				http.Error(w, msg, http.StatusForbidden)
+				return
+			}
+
+			expiresAt, msg, err := assignmentExpiry(tx, ar.StaffID, &ar.EndDate)
+			if err != nil {
+				log.Printf("Error checking staff validity: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if msg != "" {
+				http.Error(w, msg, http.StatusConflict)
+				return
+			}
+
+			// Someone already holding an active copy of this key has that assignment extended instead
+			var heldCopyID int
+			err = tx.QueryRow(
+				"SELECT id FROM key_copies WHERE key_id = $1 AND staff_id = $2 AND status = 'active' ORDER BY id LIMIT 1",
+				ar.KeyID, ar.StaffID,
+			).Scan(&heldCopyID)
+			if err != nil && err != sql.ErrNoRows {
+				log.Printf("Error retrieving held key copy: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			if heldCopyID != 0 {
+				err = extendKeyCopy(tx, heldCopyID, ar.KeyID, ar.StaffID, d.ApproverID, expiresAt, fmt.Sprintf("Extended by access request #%d", ar.ID))
+				if err != nil {
+					log.Printf("Error extending key copy: %v", err)
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+				ar.Status = "fulfilled"
+				ar.KeyCopyID = heldCopyID
+			} else if d.Fulfilment != "pickup" && !ar.StartDate.After(time.Now()) {
+				// Dual-control keys are always queued, the pickup goes through a confirmed checkout
+				dual, err := isDualControl(tx, ar.KeyID)
+				if err != nil {
+					log.Printf("Error checking dual control: %v", err)
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+
+				copyID := 0
+				if !dual {
+					copyID, err = findIssuableCopy(tx, ar.KeyID, ar.StaffID)
+				}
+				if err != nil {
+					log.Printf("Error finding key copy to issue: %v", err)
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+
+				if copyID != 0 {
+					err = issueKeyCopy(tx, copyID, ar.KeyID, ar.StaffID, d.ApproverID, expiresAt, fmt.Sprintf("Issued for access request #%d", ar.ID))
+					if err == errCopyNotInStock {
+						http.Error(w, "Key copy was issued to someone else, please retry", http.StatusConflict)
+						return
+					}
+					if err != nil {
+						log.Printf("Error issuing key copy: %v", err)
+						http.Error(w, "Internal server error", http.StatusInternalServerError)
+						return
+					}
+					ar.Status = "fulfilled"
+					ar.KeyCopyID = copyID
+				}
+			}
+		}
+
+		ar.ApproverID = d.ApproverID
+		ar.DecisionNote = d.Note
+		err = tx.QueryRow(`
+			UPDATE access_requests
+			SET status = $1, approver_id = $2, decision_note = $3, key_copy_id = $4, decided_at = NOW()
+			WHERE id = $5
+			RETURNING decided_at`,
+			ar.Status, ar.ApproverID, ar.DecisionNote, nullableID(ar.KeyCopyID), ar.ID,
+		).Scan(&ar.DecidedAt)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error updating access request: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(ar)
+	}
+}
+
+// Issue a copy for an approved access request queued for pickup. Requests for dual-control keys are picked up
+// by creating a checkout with their access_request_id instead, which issues the copy once a witness confirms.
+func PickupAccessRequest(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		var p accessPickup
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		ar, err := scanAccessRequest(tx.QueryRow("SELECT "+accessRequestColumns+" FROM access_requests WHERE id = $1 FOR UPDATE", id))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Access request not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving access request: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if ar.Status != "approved" {
+			http.Error(w, "Access request is not awaiting pickup", http.StatusConflict)
+			return
+		}
+		if ar.StartDate.After(time.Now()) {
+			http.Error(w, "Access request cannot be picked up before its start date", http.StatusConflict)
+			return
+		}
+
+		dual, err := isDualControl(tx, ar.KeyID)
+		if err != nil {
+			log.Printf("Error checking dual control: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if dual {
+			http.Error(w, dualControlMessage+" with this access_request_id", http.StatusConflict)
+			return
+		}
+
+		if p.KeyCopyID != 0 {
+			var kc models.KeyCopy
+			err := tx.QueryRow(
+				"SELECT id, key_id, COALESCE(staff_id, 0) FROM key_copies WHERE id = $1 FOR UPDATE",
+				p.KeyCopyID,
+			).Scan(&kc.ID, &kc.KeyID, &kc.StaffID)
+			if err != nil && err != sql.ErrNoRows {
+				log.Printf("Error retrieving key copy: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if err == sql.ErrNoRows || kc.KeyID != ar.KeyID {
+				http.Error(w, "Key copy does not belong to the requested key", http.StatusBadRequest)
+				return
+			}
+			if kc.StaffID != 0 {
+				http.Error(w, "Key copy is not in stock", http.StatusConflict)
+				return
+			}
+
+			reserved, err := reservedByOther(tx, kc.ID, ar.StaffID, time.Now())
+			if err != nil {
+				log.Printf("Error checking reservations: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if reserved {
+				http.Error(w, "Key copy is reserved by another staff member", http.StatusConflict)
+				return
+			}
+			ar.KeyCopyID = kc.ID
+		} else {
+			ar.KeyCopyID, err = findIssuableCopy(tx, ar.KeyID, ar.StaffID)
+			if err != nil {
+				log.Printf("Error finding key copy to issue: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if ar.KeyCopyID == 0 {
+				http.Error(w, "No copy of this key is in stock", http.StatusConflict)
+				return
+			}
+		}
+
+		_, msg, err := checkClearance(tx, ar.StaffID, ar.KeyID, p.clearanceOverride)
+		if err != nil {
+			log.Printf("Error checking clearance: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if msg != "" {
+			http.Error(w, msg, http.StatusForbidden)
+			return
+		}
+
+		expiresAt, msg, err := assignmentExpiry(tx, ar.StaffID, &ar.EndDate)
+		if err != nil {
+			log.Printf("Error checking staff validity: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if msg != "" {
+			http.Error(w, msg, http.StatusConflict)
+			return
+		}
+
+		err = issueKeyCopy(tx, ar.KeyCopyID, ar.KeyID, ar.StaffID, p.StaffID, expiresAt, fmt.Sprintf("Picked up for access request #%d", ar.ID))
+		if err == errCopyNotInStock {
+			http.Error(w, "Key copy is not in stock", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error issuing key copy: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		ar.Status = "fulfilled"
+		_, err = tx.Exec("UPDATE access_requests SET status = $1, key_copy_id = $2 WHERE id = $3", ar.Status, ar.KeyCopyID, ar.ID)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error updating access request: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(ar)
+	}
+}
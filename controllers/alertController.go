@@ -0,0 +1,370 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-app-be/models"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const alertColumns = `id, type, severity, message, COALESCE(key_copy_id, 0), COALESCE(staff_id, 0), status, created_at,
+	COALESCE(acknowledged_by, 0), acknowledged_at, COALESCE(resolved_by, 0), resolved_at, COALESCE(resolution_note, '')`
+
+func scanAlert(row rowScanner) (models.Alert, error) {
+	var a models.Alert
+	err := row.Scan(&a.ID, &a.Type, &a.Severity, &a.Message, &a.KeyCopyID, &a.StaffID, &a.Status, &a.CreatedAt,
+		&a.AcknowledgedBy, &a.AcknowledgedAt, &a.ResolvedBy, &a.ResolvedAt, &a.ResolutionNote)
+	return a, err
+}
+
+// raiseAlert opens an alert for someone to look into
+func raiseAlert(q queryer, a models.Alert) error {
+	_, err := raiseAlertOnce(q, a, "")
+	return err
+}
+
+// raiseAlertOnce opens an alert and records that it was raised, unless an unresolved alert with the same
+// dedup key is already open. An empty key never matches.
+func raiseAlertOnce(q queryer, a models.Alert, dedupKey string) (bool, error) {
+	var id int
+	err := q.QueryRow(`
+		WITH alert AS (
+			INSERT INTO alerts (type, severity, message, key_copy_id, staff_id, dedup_key)
+			VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))
+			ON CONFLICT (dedup_key) WHERE status <> 'resolved' DO NOTHING
+			RETURNING id
+		)
+		INSERT INTO alert_events (alert_id, event) SELECT id, 'raised' FROM alert
+		RETURNING alert_id`,
+		a.Type, a.Severity, a.Message, nullableID(a.KeyCopyID), nullableID(a.StaffID), dedupKey,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Get alerts with pagination and status/type filters
+func GetAlerts(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || page <= 0 {
+			page = 1
+		}
+
+		pageSize, err := strconv.Atoi(r.URL.Query().Get("pageSize"))
+		if err != nil || pageSize <= 0 {
+			pageSize = 20
+		}
+
+		offset := (page - 1) * pageSize
+
+		whereClause := "WHERE 1=1"
+		var queryParams []interface{}
+
+		if status := r.URL.Query().Get("status"); status != "" {
+			queryParams = append(queryParams, status)
+			whereClause += " AND status = $" + strconv.Itoa(len(queryParams))
+		}
+		if alertType := r.URL.Query().Get("type"); alertType != "" {
+			queryParams = append(queryParams, alertType)
+			whereClause += " AND type = $" + strconv.Itoa(len(queryParams))
+		}
+
+		var total int
+		err = db.QueryRow("SELECT COUNT(*) FROM alerts "+whereClause, queryParams...).Scan(&total)
+		if err != nil {
+			log.Printf("Error counting records: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		selectQuery := "SELECT " + alertColumns + " FROM alerts " + whereClause +
+			" ORDER BY created_at DESC, id DESC LIMIT $" + strconv.Itoa(len(queryParams)+1) + " OFFSET $" + strconv.Itoa(len(queryParams)+2)
+		queryParams = append(queryParams, pageSize, offset)
+
+		rows, err := db.Query(selectQuery, queryParams...)
+		if err != nil {
+			log.Printf("Error querying records: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		alerts := []models.Alert{}
+		for rows.Next() {
+			a, err := scanAlert(rows)
+			if err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			alerts = append(alerts, a)
+		}
+
+		response := struct {
+			Data       interface{} `json:"data"`
+			Total      int         `json:"total"`
+			Page       int         `json:"page"`
+			PageSize   int         `json:"pageSize"`
+			TotalPages int         `json:"totalPages"`
+		}{
+			Data:       alerts,
+			Total:      total,
+			Page:       page,
+			PageSize:   pageSize,
+			TotalPages: (total + pageSize - 1) / pageSize,
+		}
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("Error encoding response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+type alertActionRequest struct {
+	StaffID int    `json:"staff_id"`
+	Note    string `json:"note"`
+}
+
+// changeAlertStatus moves an alert from one of the from statuses to the new status, sets the columns
+// saying who did it and records the change as an event of the same name. setColumns gets the staff ID
+// as $3 and, when withNote is set, the note as $4.
+func changeAlertStatus(db *sql.DB, w http.ResponseWriter, r *http.Request, from []string, status, setColumns string, withNote bool) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var req alertActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.StaffID == 0 {
+		http.Error(w, "staff_id is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM staffs WHERE id = $1)", req.StaffID).Scan(&exists)
+	if err != nil {
+		log.Printf("Error checking staff existence: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Staff ID does not exist", http.StatusBadRequest)
+		return
+	}
+
+	var current string
+	err = tx.QueryRow("SELECT status FROM alerts WHERE id = $1 FOR UPDATE", id).Scan(&current)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Alert not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error retrieving alert: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	allowed := false
+	for _, s := range from {
+		allowed = allowed || current == s
+	}
+	if !allowed {
+		http.Error(w, "Alert is already "+current, http.StatusConflict)
+		return
+	}
+
+	args := []interface{}{id, status, req.StaffID}
+	if withNote {
+		args = append(args, req.Note)
+	}
+	a, err := scanAlert(tx.QueryRow("UPDATE alerts SET status = $2, "+setColumns+" WHERE id = $1 RETURNING "+alertColumns, args...))
+	if err != nil {
+		log.Printf("Error updating alert: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO alert_events (alert_id, event, staff_id, note) VALUES ($1, $2, $3, $4)",
+		a.ID, status, req.StaffID, req.Note,
+	)
+	if err != nil {
+		log.Printf("Error recording alert event: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing alert: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(a)
+}
+
+// Acknowledge an open alert, to show someone is looking into it. The note goes on the event.
+func AcknowledgeAlert(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		changeAlertStatus(db, w, r, []string{"open"}, "acknowledged", "acknowledged_by = $3, acknowledged_at = NOW()", false)
+	}
+}
+
+// Resolve an open or acknowledged alert with a note on what was done
+func ResolveAlert(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		changeAlertStatus(db, w, r, []string{"open", "acknowledged"}, "resolved", "resolved_by = $3, resolved_at = NOW(), resolution_note = NULLIF($4, '')", true)
+	}
+}
+
+// alertStreamLag is how long after an event is created it may still turn up with an ID below ones already
+// streamed. IDs are handed out before commit, so an event whose transaction commits late lands behind them.
+const alertStreamLag = time.Minute
+
+// alertEventsAfter gets up to limit alert events after the given event ID, with the alert as it is now. Events
+// with lower IDs created in the last alertStreamLag, but no earlier than since, are included too unless their
+// ID is in sent.
+func alertEventsAfter(q queryer, after int, since time.Time, sent []int64, limit int) ([]models.AlertEvent, error) {
+	rows, err := q.Query(`
+		SELECT e.id, e.alert_id, e.event, COALESCE(e.staff_id, 0), COALESCE(e.note, ''), e.created_at, a.*
+		FROM alert_events e
+		JOIN LATERAL (SELECT `+alertColumns+` FROM alerts WHERE alerts.id = e.alert_id) a ON TRUE
+		WHERE (e.id > $1 OR e.created_at > GREATEST(NOW() - $2::float8 * INTERVAL '1 second', $3))
+			AND NOT e.id = ANY($4)
+		ORDER BY e.id
+		LIMIT $5`, after, alertStreamLag.Seconds(), since, pq.Array(sent), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.AlertEvent{}
+	for rows.Next() {
+		var e models.AlertEvent
+		a := &e.Alert
+		err := rows.Scan(&e.ID, &e.AlertID, &e.Event, &e.StaffID, &e.Note, &e.CreatedAt,
+			&a.ID, &a.Type, &a.Severity, &a.Message, &a.KeyCopyID, &a.StaffID, &a.Status, &a.CreatedAt,
+			&a.AcknowledgedBy, &a.AcknowledgedAt, &a.ResolvedBy, &a.ResolvedAt, &a.ResolutionNote)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// alertStreamPoll is how often the event stream checks for new alert events
+const alertStreamPoll = 2 * time.Second
+
+// Stream alert events (raised, acknowledged, resolved) as server-sent events. A client reconnecting with
+// Last-Event-ID, or passing ?after=<event id>, is sent what it missed first; otherwise the stream starts
+// with the next event. Events are sent in ID order, except that one committed late is sent when it appears,
+// so a reconnecting client may be sent events from the last minute again and should skip IDs it has seen.
+func StreamAlertEvents(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		after := r.Header.Get("Last-Event-ID")
+		if after == "" {
+			after = r.URL.Query().Get("after")
+		}
+		last, err := strconv.Atoi(after)
+		var since time.Time
+		if after == "" {
+			err = db.QueryRow("SELECT COALESCE(MAX(id), 0), NOW() FROM alert_events").Scan(&last, &since)
+			if err != nil {
+				log.Printf("Error retrieving latest alert event: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		} else if err != nil || last < 0 {
+			http.Error(w, "Invalid event ID", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "retry: %d\n\n", alertStreamPoll.Milliseconds())
+		flusher.Flush()
+
+		ticker := time.NewTicker(alertStreamPoll)
+		defer ticker.Stop()
+		idle := 0
+		// sent holds the events from the trailing window already streamed, with when they were created
+		sent := map[int64]time.Time{}
+		for {
+			sentIDs := make([]int64, 0, len(sent))
+			for id, createdAt := range sent {
+				if time.Since(createdAt) > 2*alertStreamLag {
+					delete(sent, id)
+				} else {
+					sentIDs = append(sentIDs, id)
+				}
+			}
+
+			events, err := alertEventsAfter(db, last, since, sentIDs, 100)
+			if err != nil {
+				log.Printf("Error querying alert events: %v", err)
+				return
+			}
+			for _, e := range events {
+				data, err := json.Marshal(e)
+				if err != nil {
+					log.Printf("Error encoding alert event: %v", err)
+					return
+				}
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Event, data)
+				sent[int64(e.ID)] = e.CreatedAt
+				if e.ID > last {
+					last = e.ID
+				}
+			}
+
+			// A comment now and then stops proxies from closing a quiet stream
+			idle++
+			if len(events) > 0 {
+				idle = 0
+			} else if idle*int(alertStreamPoll/time.Second) >= 30 {
+				fmt.Fprint(w, ": keep-alive\n\n")
+				idle = 0
+			}
+			flusher.Flush()
+
+			// A full batch means there is probably more waiting
+			if len(events) == 100 {
+				continue
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+}
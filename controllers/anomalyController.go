@@ -0,0 +1,532 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-app-be/models"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// anomaly is an alert a rule wants raised. Alerts with the same dedup key are only raised again once
+// the earlier one is resolved.
+type anomaly struct {
+	Alert    models.Alert
+	DedupKey string
+}
+
+// anomalyRule looks for one kind of unusual behaviour. Rules are JSON-decoded from their stored params
+// on top of their defaults, so exported fields are the rule's settings. Detect is given the time of the
+// previous run so rules looking at events only report the ones that are new.
+type anomalyRule interface {
+	Description() string
+	Detect(q queryer, since, now time.Time) ([]anomaly, error)
+}
+
+// anomalyRules are the rules by name, each returning a rule with its default settings
+var anomalyRules = map[string]func() anomalyRule{
+	"after_hours_checkout": func() anomalyRule {
+		return &afterHoursRule{StartHour: 7, EndHour: 19, Weekends: true, TimeZone: "UTC"}
+	},
+	"peer_outlier": func() anomalyRule {
+		return &peerOutlierRule{Factor: 3, MinExtra: 2, MinPeers: 3}
+	},
+	"repeated_lost": func() anomalyRule {
+		return &repeatedLostRule{Count: 3, WindowDays: 30}
+	},
+	"long_hold": func() anomalyRule {
+		return &longHoldRule{Factor: 3, MinLoans: 5, LookbackDays: 90}
+	},
+}
+
+// anomalyFirstLookback is how far back a rule looks on its first run
+const anomalyFirstLookback = 24 * time.Hour
+
+// anomalyOverlap is how far before the last run a rule looks again. NOW() is the transaction's start
+// time, so rows committed by transactions that began before the last run can land behind it; findings
+// seen twice are dropped by their dedup keys.
+const anomalyOverlap = time.Minute
+
+type afterHoursRule struct {
+	StartHour int    `json:"start_hour"`
+	EndHour   int    `json:"end_hour"`
+	Weekends  bool   `json:"weekends"`
+	TimeZone  string `json:"time_zone"`
+}
+
+func (r *afterHoursRule) Description() string {
+	return "Checkouts outside business hours, and at weekends when weekends is set"
+}
+
+func (r *afterHoursRule) Detect(q queryer, since, now time.Time) ([]anomaly, error) {
+	loc, err := time.LoadLocation(r.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := holderChanges(q, since, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []anomaly
+	for _, c := range changes {
+		if c.StaffID == 0 || c.At.Before(since) {
+			continue
+		}
+		t := c.At.In(loc)
+		weekend := t.Weekday() == time.Saturday || t.Weekday() == time.Sunday
+		if t.Hour() >= r.StartHour && t.Hour() < r.EndHour && !(r.Weekends && weekend) {
+			continue
+		}
+		found = append(found, anomaly{
+			Alert: models.Alert{
+				Type:      "after_hours_checkout",
+				Severity:  "warning",
+				Message:   fmt.Sprintf("Copy #%d of %s was checked out by %s at %s, outside business hours", c.KeyCopyID, c.KeyName, c.StaffName, t.Format("Mon 2 Jan 15:04 MST")),
+				KeyCopyID: c.KeyCopyID,
+				StaffID:   c.StaffID,
+			},
+			DedupKey: fmt.Sprintf("after_hours_checkout:%d:%d", c.KeyCopyID, c.At.Unix()),
+		})
+	}
+	return found, nil
+}
+
+type peerOutlierRule struct {
+	Factor   float64 `json:"factor"`
+	MinExtra int     `json:"min_extra"`
+	MinPeers int     `json:"min_peers"`
+}
+
+func (r *peerOutlierRule) Description() string {
+	return "Staff holding factor times as many copies as the average of others with the same role, and at least min_extra more"
+}
+
+func (r *peerOutlierRule) Detect(q queryer, since, now time.Time) ([]anomaly, error) {
+	rows, err := q.Query(`
+		SELECT s.id, s.name, s.role, COUNT(kc.id)
+		FROM staffs s
+		LEFT JOIN key_copies kc ON kc.staff_id = s.id AND kc.status = 'active'
+		WHERE COALESCE(s.role, '') <> ''
+		GROUP BY s.id, s.name, s.role`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type holder struct {
+		id, held   int
+		name, role string
+	}
+	byRole := map[string][]holder{}
+	totals := map[string]int{}
+	for rows.Next() {
+		var h holder
+		if err := rows.Scan(&h.id, &h.name, &h.role, &h.held); err != nil {
+			return nil, err
+		}
+		byRole[h.role] = append(byRole[h.role], h)
+		totals[h.role] += h.held
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var found []anomaly
+	for role, holders := range byRole {
+		peers := len(holders) - 1
+		if peers < r.MinPeers {
+			continue
+		}
+		for _, h := range holders {
+			average := float64(totals[role]-h.held) / float64(peers)
+			if float64(h.held) < average*r.Factor || float64(h.held) < average+float64(r.MinExtra) {
+				continue
+			}
+			found = append(found, anomaly{
+				Alert: models.Alert{
+					Type:     "peer_outlier",
+					Severity: "warning",
+					Message:  fmt.Sprintf("%s holds %d copies where other staff with the role %s hold %.1f on average", h.name, h.held, role, average),
+					StaffID:  h.id,
+				},
+				DedupKey: fmt.Sprintf("peer_outlier:%d:%d", h.id, h.held),
+			})
+		}
+	}
+	return found, nil
+}
+
+type repeatedLostRule struct {
+	Count      int `json:"count"`
+	WindowDays int `json:"window_days"`
+}
+
+func (r *repeatedLostRule) Description() string {
+	return "Staff who have lost count copies within window_days"
+}
+
+func (r *repeatedLostRule) Detect(q queryer, since, now time.Time) ([]anomaly, error) {
+	// Only report when the latest loss is new, so a resolved alert isn't raised again for the same losses
+	rows, err := q.Query(`
+		SELECT h.staff_id, COALESCE(s.name, ''), COUNT(*), MAX(h.id)
+		FROM key_copy_history h
+		LEFT JOIN staffs s ON s.id = h.staff_id
+		WHERE h.action = 'marked_lost' AND h.staff_id IS NOT NULL AND h.created_at > $1 AND h.created_at <= $3
+		GROUP BY h.staff_id, s.name
+		HAVING COUNT(*) >= $2 AND MAX(h.created_at) > $4`,
+		now.AddDate(0, 0, -r.WindowDays), r.Count, now, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found []anomaly
+	for rows.Next() {
+		var staffID, count, latest int
+		var name string
+		if err := rows.Scan(&staffID, &name, &count, &latest); err != nil {
+			return nil, err
+		}
+		found = append(found, anomaly{
+			Alert: models.Alert{
+				Type:     "repeated_lost",
+				Severity: "critical",
+				Message:  fmt.Sprintf("%s has lost %d copies in the last %d days", name, count, r.WindowDays),
+				StaffID:  staffID,
+			},
+			DedupKey: fmt.Sprintf("repeated_lost:%d:%d", staffID, latest),
+		})
+	}
+	return found, rows.Err()
+}
+
+type longHoldRule struct {
+	Factor       float64 `json:"factor"`
+	MinLoans     int     `json:"min_loans"`
+	LookbackDays int     `json:"lookback_days"`
+}
+
+func (r *longHoldRule) Description() string {
+	return "Copies held factor times longer than the key's average loan over lookback_days, for keys with at least min_loans returned loans"
+}
+
+func (r *longHoldRule) Detect(q queryer, since, now time.Time) ([]anomaly, error) {
+	from := now.AddDate(0, 0, -r.LookbackDays)
+	changes, err := holderChanges(q, from, now)
+	if err != nil {
+		return nil, err
+	}
+
+	lost := map[int]bool{}
+	rows, err := q.Query("SELECT id FROM key_copies WHERE status = 'lost'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		lost[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	total := map[int]time.Duration{}
+	loans := map[int]int{}
+	for _, c := range changes {
+		if c.StaffID != 0 && !c.At.Before(from) && c.Until != nil {
+			total[c.KeyID] += c.Until.Sub(c.At)
+			loans[c.KeyID]++
+		}
+	}
+
+	var found []anomaly
+	for _, c := range changes {
+		if c.StaffID == 0 || c.Until != nil || lost[c.KeyCopyID] || loans[c.KeyID] < r.MinLoans {
+			continue
+		}
+		average := total[c.KeyID] / time.Duration(loans[c.KeyID])
+		// Report a loan once, in the run where it goes over the limit
+		over := c.At.Add(time.Duration(float64(average) * r.Factor))
+		if !over.After(since) || over.After(now) {
+			continue
+		}
+		found = append(found, anomaly{
+			Alert: models.Alert{
+				Type:      "long_hold",
+				Severity:  "warning",
+				Message:   fmt.Sprintf("%s has held copy #%d of %s for %.0f hours where loans average %.1f hours", c.StaffName, c.KeyCopyID, c.KeyName, now.Sub(c.At).Hours(), average.Hours()),
+				KeyCopyID: c.KeyCopyID,
+				StaffID:   c.StaffID,
+			},
+			DedupKey: fmt.Sprintf("long_hold:%d:%d", c.KeyCopyID, c.At.Unix()),
+		})
+	}
+	return found, nil
+}
+
+// loadAnomalyRule gets a rule's stored settings and state, locking its row, and starts tracking rules
+// that have never run. It is for the run and update paths; GetAnomalyRules reads without writing.
+func loadAnomalyRule(q queryer, name string) (models.AnomalyRule, anomalyRule, error) {
+	stored := models.AnomalyRule{Name: name}
+	_, err := q.Exec("INSERT INTO anomaly_rules (name) VALUES ($1) ON CONFLICT (name) DO NOTHING", name)
+	if err != nil {
+		return stored, nil, err
+	}
+	var params []byte
+	err = q.QueryRow("SELECT enabled, params, last_run_at FROM anomaly_rules WHERE name = $1 FOR UPDATE", name).
+		Scan(&stored.Enabled, &params, &stored.LastRunAt)
+	if err != nil {
+		return stored, nil, err
+	}
+
+	rule, err := decodeAnomalyRule(&stored, params)
+	return stored, rule, err
+}
+
+// decodeAnomalyRule applies stored params over the rule's defaults and fills in the description and
+// effective params of stored
+func decodeAnomalyRule(stored *models.AnomalyRule, params []byte) (anomalyRule, error) {
+	rule := anomalyRules[stored.Name]()
+	if err := json.Unmarshal(params, rule); err != nil {
+		return nil, err
+	}
+	stored.Description = rule.Description()
+	var err error
+	stored.Params, err = json.Marshal(rule)
+	return rule, err
+}
+
+// runAnomalyRule runs one rule in its own transaction and raises what it finds
+func runAnomalyRule(db *sql.DB, name string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stored, rule, err := loadAnomalyRule(tx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	var now time.Time
+	if err := tx.QueryRow("SELECT NOW()").Scan(&now); err != nil {
+		return 0, err
+	}
+	since := now.Add(-anomalyFirstLookback)
+	if stored.LastRunAt != nil {
+		since = stored.LastRunAt.Add(-anomalyOverlap)
+	}
+
+	raised := 0
+	if stored.Enabled {
+		found, err := rule.Detect(tx, since, now)
+		if err != nil {
+			return 0, err
+		}
+		for _, a := range found {
+			ok, err := raiseAlertOnce(tx, a.Alert, a.DedupKey)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				raised++
+			}
+		}
+	}
+
+	// Disabled rules move on too, so enabling one doesn't report everything since it was switched off
+	if _, err := tx.Exec("UPDATE anomaly_rules SET last_run_at = $2 WHERE name = $1", name, now); err != nil {
+		return 0, err
+	}
+	return raised, tx.Commit()
+}
+
+// DetectAnomalies runs every anomaly rule, carrying on past rules that fail
+func DetectAnomalies(db *sql.DB) error {
+	var errs []error
+	for name := range anomalyRules {
+		if _, err := runAnomalyRule(db, name); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Get the anomaly rules with their settings
+func GetAnomalyRules(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT name, enabled, params, last_run_at FROM anomaly_rules")
+		if err != nil {
+			log.Printf("Error querying anomaly rules: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		saved := map[string]models.AnomalyRule{}
+		savedParams := map[string][]byte{}
+		for rows.Next() {
+			var stored models.AnomalyRule
+			var params []byte
+			if err := rows.Scan(&stored.Name, &stored.Enabled, &params, &stored.LastRunAt); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			saved[stored.Name], savedParams[stored.Name] = stored, params
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Error querying anomaly rules: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// Rules that have never been saved or run show their defaults
+		rules := []models.AnomalyRule{}
+		for name := range anomalyRules {
+			stored, ok := saved[name]
+			if !ok {
+				stored = models.AnomalyRule{Name: name, Enabled: true}
+				savedParams[name] = []byte("{}")
+			}
+			if _, err := decodeAnomalyRule(&stored, savedParams[name]); err != nil {
+				log.Printf("Error reading anomaly rule %s: %v", name, err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			rules = append(rules, stored)
+		}
+		sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+
+		json.NewEncoder(w).Encode(rules)
+	}
+}
+
+// Turn an anomaly rule on or off and change its settings. Settings left out keep their current value.
+func UpdateAnomalyRule(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+
+		if _, ok := anomalyRules[name]; !ok {
+			http.Error(w, "Anomaly rule not found", http.StatusNotFound)
+			return
+		}
+
+		var req struct {
+			Enabled *bool           `json:"enabled"`
+			Params  json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		stored, rule, err := loadAnomalyRule(tx, name)
+		if err != nil {
+			log.Printf("Error retrieving anomaly rule %s: %v", name, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if req.Enabled != nil {
+			stored.Enabled = *req.Enabled
+		}
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, rule); err != nil {
+				http.Error(w, "Invalid params: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if stored.Params, err = json.Marshal(rule); err != nil {
+				log.Printf("Error encoding anomaly rule params: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if msg := validateAnomalyRule(rule); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		_, err = tx.Exec("UPDATE anomaly_rules SET enabled = $2, params = $3 WHERE name = $1", name, stored.Enabled, []byte(stored.Params))
+		if err != nil {
+			log.Printf("Error updating anomaly rule: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing anomaly rule: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(stored)
+	}
+}
+
+// validateAnomalyRule checks a rule's settings make sense, returning a message when they don't
+func validateAnomalyRule(rule anomalyRule) string {
+	switch r := rule.(type) {
+	case *afterHoursRule:
+		if r.StartHour < 0 || r.EndHour > 24 || r.StartHour >= r.EndHour {
+			return "start_hour and end_hour must be hours of the day with start_hour first"
+		}
+		if _, err := time.LoadLocation(r.TimeZone); err != nil {
+			return "Invalid time_zone"
+		}
+	case *peerOutlierRule:
+		if r.Factor < 1 || r.MinExtra < 0 || r.MinPeers < 1 {
+			return "factor must be at least 1, min_extra at least 0 and min_peers at least 1"
+		}
+	case *repeatedLostRule:
+		if r.Count < 2 || r.WindowDays < 1 {
+			return "count must be at least 2 and window_days at least 1"
+		}
+	case *longHoldRule:
+		if r.Factor < 1 || r.MinLoans < 1 || r.LookbackDays < 1 {
+			return "factor must be at least 1, min_loans and lookback_days at least 1"
+		}
+	}
+	return ""
+}
+
+// Run the anomaly rules now rather than waiting for the next scheduled run
+func RunAnomalyRules(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raised := map[string]int{}
+		for name := range anomalyRules {
+			n, err := runAnomalyRule(db, name)
+			if err != nil {
+				log.Printf("Error running anomaly rule %s: %v", name, err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			raised[name] = n
+		}
+
+		json.NewEncoder(w).Encode(struct {
+			Raised map[string]int `json:"raised"`
+		}{raised})
+	}
+}
@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-app-be/models"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// clearanceOverride lets an admin push through an assignment the staff member is not cleared for
+type clearanceOverride struct {
+	OverrideBy     int    `json:"override_by"`
+	OverrideReason string `json:"override_reason"`
+}
+
+// recordAudit appends an entry to the audit log
+func recordAudit(q queryer, a models.AuditLog) error {
+	_, err := q.Exec(
+		"INSERT INTO audit_logs (action, performed_by, entity, entity_id, reason, details) VALUES ($1, $2, $3, $4, $5, $6)",
+		a.Action, nullableID(a.PerformedBy), a.Entity, nullableID(a.EntityID), a.Reason, a.Details,
+	)
+	return err
+}
+
+// checkClearance verifies the staff member's clearance level is at least the key's. An admin override
+// with a reason lets the assignment through, is written to the audit log and reported back as overridden.
+// A message is returned when the assignment is not allowed.
+func checkClearance(q queryer, staffID, keyID int, o clearanceOverride) (bool, string, error) {
+	var staffLevel, keyLevel int
+	err := q.QueryRow(`
+		SELECT s.clearance_level, k.clearance_level
+		FROM staffs s, keys k
+		WHERE s.id = $1 AND k.id = $2`, staffID, keyID).Scan(&staffLevel, &keyLevel)
+	if err == sql.ErrNoRows {
+		// Missing staff or keys are reported by the existence checks
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+
+	if staffLevel >= keyLevel {
+		return false, "", nil
+	}
+
+	if o.OverrideBy == 0 {
+		return false, "Staff clearance level is below the key's clearance level", nil
+	}
+	if o.OverrideReason == "" {
+		return false, "override_reason is required to override clearance", nil
+	}
+
+	admin, err := isAdmin(q, o.OverrideBy)
+	if err != nil {
+		return false, "", err
+	}
+	if !admin {
+		return false, "Only an admin can override clearance", nil
+	}
+
+	err = recordAudit(q, models.AuditLog{
+		Action:      "clearance_override",
+		PerformedBy: o.OverrideBy,
+		Entity:      "key",
+		EntityID:    keyID,
+		Reason:      o.OverrideReason,
+		Details:     fmt.Sprintf("Staff %d (clearance %d) assigned key %d (clearance %d)", staffID, staffLevel, keyID, keyLevel),
+	})
+	return err == nil, "", err
+}
+
+// Get audit log entries with pagination and action filter
+func GetAuditLogs(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || page <= 0 {
+			page = 1
+		}
+
+		pageSize, err := strconv.Atoi(r.URL.Query().Get("pageSize"))
+		if err != nil || pageSize <= 0 {
+			pageSize = 20
+		}
+
+		offset := (page - 1) * pageSize
+
+		whereClause := "WHERE 1=1"
+		var queryParams []interface{}
+
+		if action := r.URL.Query().Get("action"); action != "" {
+			whereClause += " AND action = $1"
+			queryParams = append(queryParams, action)
+		}
+
+		var total int
+		err = db.QueryRow("SELECT COUNT(*) FROM audit_logs "+whereClause, queryParams...).Scan(&total)
+		if err != nil {
+			log.Printf("Error counting records: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		selectQuery := `
+			SELECT id, action, COALESCE(performed_by, 0), entity, COALESCE(entity_id, 0), COALESCE(reason, ''), COALESCE(details, ''), created_at
+			FROM audit_logs
+		` + whereClause + `
+			ORDER BY created_at DESC, id DESC
+			LIMIT $` + strconv.Itoa(len(queryParams)+1) + ` OFFSET $` + strconv.Itoa(len(queryParams)+2)
+		queryParams = append(queryParams, pageSize, offset)
+
+		rows, err := db.Query(selectQuery, queryParams...)
+		if err != nil {
+			log.Printf("Error querying records: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		logs := []models.AuditLog{}
+		for rows.Next() {
+			var a models.AuditLog
+			if err := rows.Scan(&a.ID, &a.Action, &a.PerformedBy, &a.Entity, &a.EntityID, &a.Reason, &a.Details, &a.CreatedAt); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			logs = append(logs, a)
+		}
+
+		response := struct {
+			Data       interface{} `json:"data"`
+			Total      int         `json:"total"`
+			Page       int         `json:"page"`
+			PageSize   int         `json:"pageSize"`
+			TotalPages int         `json:"totalPages"`
+		}{
+			Data:       logs,
+			Total:      total,
+			Page:       page,
+			PageSize:   pageSize,
+			TotalPages: (total + pageSize - 1) / pageSize,
+		}
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("Error encoding response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+}
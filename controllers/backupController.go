@@ -0,0 +1,338 @@
+package controllers
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-app-be/models"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	backupFormat  = "key-management-backup"
+	backupVersion = 1
+)
+
+// backupTable is a table in a backup. Tables are listed parents first so a restore can insert them in
+// order; Serial tables have an id sequence to move past the restored rows, and Upsert tables may already
+// have rows in an otherwise empty database, which the backup's rows replace.
+type backupTable struct {
+	Name    string
+	OrderBy string
+	Serial  bool
+	Upsert  string
+}
+
+// backupTables is everything a backup holds. Export jobs are left out since their files stay on the
+// server that made them.
+var backupTables = []backupTable{
+	{Name: "staffs", OrderBy: "id", Serial: true},
+	{Name: "keys", OrderBy: "id", Serial: true},
+	{Name: "key_copies", OrderBy: "id", Serial: true},
+	{Name: "key_reservations", OrderBy: "id", Serial: true},
+	{Name: "key_copy_history", OrderBy: "id", Serial: true},
+	{Name: "key_copy_transfers", OrderBy: "id", Serial: true},
+	{Name: "key_copy_checkouts", OrderBy: "id", Serial: true},
+	{Name: "access_requests", OrderBy: "id", Serial: true},
+	{Name: "return_tasks", OrderBy: "id", Serial: true},
+	{Name: "recertification_campaigns", OrderBy: "id", Serial: true},
+	{Name: "recertification_items", OrderBy: "id", Serial: true},
+	{Name: "stocktake_sessions", OrderBy: "id", Serial: true},
+	{Name: "stocktake_scans", OrderBy: "id", Serial: true},
+	{Name: "label_templates", OrderBy: "id", Serial: true},
+	{Name: "cabinets", OrderBy: "id", Serial: true},
+	{Name: "cabinet_slots", OrderBy: "cabinet_id, slot"},
+	{Name: "cabinet_events", OrderBy: "id", Serial: true},
+	{Name: "doors", OrderBy: "id", Serial: true},
+	{Name: "door_events", OrderBy: "id", Serial: true},
+	{Name: "alerts", OrderBy: "id", Serial: true},
+	{Name: "alert_events", OrderBy: "id", Serial: true},
+	{Name: "anomaly_rules", OrderBy: "name",
+		Upsert: "ON CONFLICT (name) DO UPDATE SET enabled = EXCLUDED.enabled, params = EXCLUDED.params, last_run_at = EXCLUDED.last_run_at"},
+	{Name: "audit_logs", OrderBy: "id", Serial: true},
+}
+
+// backupHeader starts a backup. A JSON backup holds every table's rows in Tables; a JSON Lines backup
+// has the header on its first line and then one backupLine per row.
+type backupHeader struct {
+	Format    string                       `json:"format"`
+	Version   int                          `json:"version"`
+	CreatedAt time.Time                    `json:"created_at"`
+	Tables    map[string][]json.RawMessage `json:"tables,omitempty"`
+}
+
+type backupLine struct {
+	Table string          `json:"table"`
+	Row   json.RawMessage `json:"row"`
+}
+
+type RestoreResult struct {
+	Version int            `json:"version"`
+	Tables  map[string]int `json:"tables"`
+}
+
+// Get a snapshot of the whole dataset as JSON, or JSON Lines with ?format=jsonl, read in one transaction
+// so every table is from the same moment. Rows are streamed table by table as Postgres renders them.
+func GetBackup(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "json" && format != "jsonl" {
+			http.Error(w, "format must be json or jsonl", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		header, _ := json.Marshal(backupHeader{Format: backupFormat, Version: backupVersion, CreatedAt: time.Now()})
+		filename := fmt.Sprintf("backup-%s.%s", time.Now().Format("2006-01-02"), format)
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		if format == "jsonl" {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+
+		// A failure part way through can only be logged; the truncated backup won't parse, so it can't
+		// be restored by mistake
+		out := bufio.NewWriter(w)
+		if format == "jsonl" {
+			out.Write(header)
+			out.WriteString("\n")
+		} else {
+			// Open the header object back up to add the tables to it
+			out.Write(header[:len(header)-1])
+			out.WriteString(`,"tables":{`)
+		}
+		for i, table := range backupTables {
+			if err = writeBackupTable(tx, out, table, format, i > 0); err != nil {
+				log.Printf("Error backing up %s: %v", table.Name, err)
+				return
+			}
+		}
+		if format == "json" {
+			out.WriteString("}}\n")
+		}
+		if err := out.Flush(); err != nil {
+			log.Printf("Error writing backup: %v", err)
+		}
+	}
+}
+
+func writeBackupTable(q queryer, out *bufio.Writer, table backupTable, format string, more bool) error {
+	rows, err := q.Query(`SELECT row_to_json(t)::text FROM ` + table.Name + ` t ORDER BY ` + table.OrderBy)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	name, _ := json.Marshal(table.Name)
+	if format == "json" {
+		if more {
+			out.WriteString(",")
+		}
+		out.Write(name)
+		out.WriteString(":[")
+	}
+	first := true
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			return err
+		}
+		if format == "jsonl" {
+			out.WriteString(`{"table":`)
+			out.Write(name)
+			out.WriteString(`,"row":`)
+			out.WriteString(row)
+			out.WriteString("}\n")
+			continue
+		}
+		if !first {
+			out.WriteString(",")
+		}
+		out.WriteString(row)
+		first = false
+	}
+	if format == "json" {
+		out.WriteString("]")
+	}
+	return rows.Err()
+}
+
+// restoreRow inserts one backed up row with its own ID, naming only the columns the backup has so
+// columns added since it was taken get their defaults
+func restoreRow(tx *sql.Tx, table backupTable, row json.RawMessage) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(row, &fields); err != nil || fields == nil {
+		return requestError{http.StatusBadRequest, fmt.Sprintf("%s row is not a JSON object", table.Name)}
+	}
+	columns := make([]string, 0, len(fields))
+	for name := range fields {
+		columns = append(columns, pq.QuoteIdentifier(name))
+	}
+	sort.Strings(columns)
+	list := strings.Join(columns, ", ")
+
+	_, err := tx.Exec(`INSERT INTO `+table.Name+` (`+list+`)
+		SELECT `+list+` FROM json_populate_record(NULL::`+table.Name+`, $1) `+table.Upsert, string(row))
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return requestError{http.StatusBadRequest, fmt.Sprintf("%s row could not be restored: %s", table.Name, pqErr.Message)}
+	}
+	return err
+}
+
+// Restore a backup from GetBackup into an empty database, keeping every ID and moving each id sequence
+// past the restored rows. Either format is accepted; the whole restore happens in one transaction.
+func RestoreBackup(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tables := map[string]backupTable{}
+		for _, t := range backupTables {
+			tables[t.Name] = t
+		}
+
+		dec := json.NewDecoder(r.Body)
+		var header backupHeader
+		if err := dec.Decode(&header); err != nil {
+			http.Error(w, "Invalid backup", http.StatusBadRequest)
+			return
+		}
+		if header.Format != backupFormat {
+			http.Error(w, "Not a backup from this service", http.StatusBadRequest)
+			return
+		}
+		if header.Version < 1 || header.Version > backupVersion {
+			http.Error(w, fmt.Sprintf("Unsupported backup version %d", header.Version), http.StatusBadRequest)
+			return
+		}
+		for name := range header.Tables {
+			if _, ok := tables[name]; !ok {
+				http.Error(w, "Unknown table "+name, http.StatusBadRequest)
+				return
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		// Keep anything else writing while we check the database is empty and fill it
+		for _, t := range backupTables {
+			if t.Upsert != "" {
+				continue
+			}
+			if _, err := tx.Exec("LOCK TABLE " + t.Name + " IN EXCLUSIVE MODE"); err != nil {
+				log.Printf("Error locking %s: %v", t.Name, err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			var exists bool
+			if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM " + t.Name + ")").Scan(&exists); err != nil {
+				log.Printf("Error checking %s: %v", t.Name, err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if exists {
+				http.Error(w, "Restore needs an empty database but "+t.Name+" has rows", http.StatusConflict)
+				return
+			}
+		}
+
+		result := RestoreResult{Version: header.Version, Tables: map[string]int{}}
+		if header.Tables != nil {
+			for _, t := range backupTables {
+				for _, row := range header.Tables[t.Name] {
+					if err = restoreRow(tx, t, row); err != nil {
+						break
+					}
+					result.Tables[t.Name]++
+				}
+				if err != nil {
+					break
+				}
+			}
+		} else {
+			for {
+				var line backupLine
+				if err = dec.Decode(&line); err == io.EOF {
+					err = nil
+					break
+				}
+				if err != nil {
+					err = requestError{http.StatusBadRequest, "Invalid backup line"}
+					break
+				}
+				t, ok := tables[line.Table]
+				if !ok {
+					err = requestError{http.StatusBadRequest, "Unknown table " + line.Table}
+					break
+				}
+				if err = restoreRow(tx, t, line.Row); err != nil {
+					break
+				}
+				result.Tables[t.Name]++
+			}
+		}
+		if writeRequestError(w, err) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error restoring backup: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		for _, t := range backupTables {
+			if !t.Serial {
+				continue
+			}
+			_, err := tx.Exec(`SELECT setval(pg_get_serial_sequence($1, 'id'), COALESCE(MAX(id), 0) + 1, false) FROM `+t.Name, t.Name)
+			if err != nil {
+				log.Printf("Error resetting %s sequence: %v", t.Name, err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		total := 0
+		for _, n := range result.Tables {
+			total += n
+		}
+		err = recordAudit(tx, models.AuditLog{
+			Action:  "restore",
+			Entity:  "backup",
+			Details: fmt.Sprintf("Restored %d rows from a backup taken %s", total, header.CreatedAt.Format(time.RFC3339)),
+		})
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error committing restore: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(result)
+	}
+}
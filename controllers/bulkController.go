@@ -0,0 +1,229 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-app-be/models"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// bulkMaxOperations is how many operations one bulk request may hold, from BULK_MAX_OPERATIONS
+func bulkMaxOperations() int {
+	if n, err := strconv.Atoi(os.Getenv("BULK_MAX_OPERATIONS")); err == nil && n > 0 {
+		return n
+	}
+	return 100
+}
+
+type bulkOperation struct {
+	Op   string          `json:"op"`
+	ID   int             `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+type bulkRequest struct {
+	Mode       string          `json:"mode"`
+	Operations []bulkOperation `json:"operations"`
+}
+
+type BulkItemResult struct {
+	Index  int         `json:"index"`
+	Op     string      `json:"op"`
+	ID     int         `json:"id"`
+	Status int         `json:"status"`
+	Data   interface{} `json:"data,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+type BulkResult struct {
+	Mode      string           `json:"mode"`
+	Committed bool             `json:"committed"`
+	Succeeded int              `json:"succeeded"`
+	Failed    int              `json:"failed"`
+	Results   []BulkItemResult `json:"results"`
+}
+
+// bulkApplier carries out one operation, returning the ID it touched and the record to report back
+type bulkApplier func(tx *sql.Tx, op bulkOperation) (int, interface{}, error)
+
+// decodeBulkData decodes an operation's data, which creates and updates must have
+func decodeBulkData(op bulkOperation, v interface{}) error {
+	if len(op.Data) == 0 {
+		return requestError{http.StatusBadRequest, op.Op + " needs data"}
+	}
+	if err := json.Unmarshal(op.Data, v); err != nil {
+		return requestError{http.StatusBadRequest, "Invalid data"}
+	}
+	return nil
+}
+
+func applyKeyOperation(tx *sql.Tx, op bulkOperation) (int, interface{}, error) {
+	var k models.Key
+	switch op.Op {
+	case "create":
+		if err := decodeBulkData(op, &k); err != nil {
+			return 0, nil, err
+		}
+		created, err := createKey(tx, k)
+		return created.ID, created, err
+	case "update":
+		if err := decodeBulkData(op, &k); err != nil {
+			return op.ID, nil, err
+		}
+		updated, err := updateKey(tx, op.ID, k)
+		return op.ID, updated, err
+	default:
+		return op.ID, nil, deleteKey(tx, op.ID)
+	}
+}
+
+func applyKeyCopyOperation(tx *sql.Tx, op bulkOperation) (int, interface{}, error) {
+	var req keyCopyRequest
+	switch op.Op {
+	case "create":
+		if err := decodeBulkData(op, &req); err != nil {
+			return 0, nil, err
+		}
+		k, err := createKeyCopy(tx, req)
+		return k.ID, k, err
+	case "update":
+		if err := decodeBulkData(op, &req); err != nil {
+			return op.ID, nil, err
+		}
+		k, err := updateKeyCopy(tx, op.ID, req)
+		return op.ID, k, err
+	default:
+		return op.ID, nil, deleteKeyCopy(tx, op.ID)
+	}
+}
+
+// bulkHandler runs a list of create, update and delete operations, each with the same checks and body as
+// the single-record endpoint. In "atomic" mode (the default) the first failure rolls everything back; in
+// "best_effort" mode failed operations are skipped and the rest committed. Each operation runs under its own
+// savepoint so a failure in best-effort mode doesn't abort the transaction.
+func bulkHandler(db *sql.DB, entity string, apply bulkApplier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req bulkRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Mode == "" {
+			req.Mode = "atomic"
+		}
+		if req.Mode != "atomic" && req.Mode != "best_effort" {
+			http.Error(w, "mode must be atomic or best_effort", http.StatusBadRequest)
+			return
+		}
+		if len(req.Operations) == 0 {
+			http.Error(w, "operations is required", http.StatusBadRequest)
+			return
+		}
+		if limit := bulkMaxOperations(); len(req.Operations) > limit {
+			http.Error(w, fmt.Sprintf("A bulk request can hold at most %d operations", limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		for i, op := range req.Operations {
+			switch op.Op {
+			case "create":
+			case "update", "delete":
+				if op.ID <= 0 {
+					http.Error(w, fmt.Sprintf("Operation %d needs an id", i), http.StatusBadRequest)
+					return
+				}
+			default:
+				http.Error(w, fmt.Sprintf("Operation %d: op must be create, update or delete", i), http.StatusBadRequest)
+				return
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		result := BulkResult{Mode: req.Mode, Results: []BulkItemResult{}}
+		failure := 0
+		for i, op := range req.Operations {
+			item := BulkItemResult{Index: i, Op: op.Op, Status: http.StatusOK}
+			if op.Op == "create" {
+				item.Status = http.StatusCreated
+			}
+
+			_, err := tx.Exec("SAVEPOINT bulk_operation")
+			if err == nil {
+				item.ID, item.Data, err = apply(tx, op)
+			}
+			if err == nil {
+				_, err = tx.Exec("RELEASE SAVEPOINT bulk_operation")
+			}
+			if err != nil {
+				var reqErr requestError
+				if errors.As(err, &reqErr) {
+					item.Status, item.Error = reqErr.status, reqErr.message
+				} else {
+					log.Printf("Error in bulk %s operation %d: %v", entity, i, err)
+					item.Status, item.Error = http.StatusInternalServerError, "Internal server error"
+				}
+				item.ID, item.Data = op.ID, nil
+				if _, err := tx.Exec("ROLLBACK TO SAVEPOINT bulk_operation"); err != nil {
+					log.Printf("Error rolling back bulk operation: %v", err)
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+				result.Failed++
+				if failure == 0 {
+					failure = item.Status
+				}
+			} else {
+				result.Succeeded++
+			}
+			result.Results = append(result.Results, item)
+
+			if result.Failed > 0 && req.Mode == "atomic" {
+				break
+			}
+		}
+
+		status := http.StatusOK
+		if req.Mode == "atomic" && result.Failed > 0 {
+			status = failure
+		} else if result.Succeeded > 0 {
+			err = recordAudit(tx, models.AuditLog{
+				Action:  "bulk",
+				Entity:  entity,
+				Details: fmt.Sprintf("Applied %d of %d bulk operations", result.Succeeded, len(req.Operations)),
+			})
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				log.Printf("Error committing bulk operations: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			result.Committed = true
+		}
+
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// Create, update and delete keys in one request
+func BulkKeys(db *sql.DB) http.HandlerFunc {
+	return bulkHandler(db, "keys", applyKeyOperation)
+}
+
+// Create, update and delete key copies in one request
+func BulkKeyCopies(db *sql.DB) http.HandlerFunc {
+	return bulkHandler(db, "key_copies", applyKeyCopyOperation)
+}
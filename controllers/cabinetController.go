@@ -0,0 +1,574 @@
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-app-be/models"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Slot events a cabinet can report
+const (
+	cabinetSlotOpened  = "slot_opened"
+	cabinetKeyRemoved  = "key_removed"
+	cabinetKeyReturned = "key_returned"
+)
+
+// CabinetAdapter translates what one make of key cabinet sends into slot events
+type CabinetAdapter interface {
+	ParseEvents(payload []byte) ([]models.CabinetEvent, error)
+}
+
+var cabinetAdapters = map[string]CabinetAdapter{
+	"generic":   genericCabinetAdapter{},
+	"simulated": simulatedCabinetAdapter{},
+}
+
+// RegisterCabinetAdapter makes an adapter available to cabinets under the given name
+func RegisterCabinetAdapter(name string, adapter CabinetAdapter) {
+	cabinetAdapters[name] = adapter
+}
+
+// genericCabinetAdapter accepts our own JSON format: {"events": [{"slot": 3, "event": "key_removed", "staff_id": 12, "occurred_at": "..."}]}
+type genericCabinetAdapter struct{}
+
+func (genericCabinetAdapter) ParseEvents(payload []byte) ([]models.CabinetEvent, error) {
+	var body struct {
+		Events []models.CabinetEvent `json:"events"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return nil, err
+	}
+	for i := range body.Events {
+		if body.Events[i].OccurredAt.IsZero() {
+			body.Events[i].OccurredAt = time.Now()
+		}
+	}
+	return body.Events, nil
+}
+
+// simulatedCabinetAdapter reads the line protocol of the simulated cabinet, one event per line:
+// "<RFC3339 time> <slot> OPEN|REMOVED|RETURNED [<badge staff id>]"
+type simulatedCabinetAdapter struct{}
+
+var simulatedCabinetEvents = map[string]string{
+	"OPEN":     cabinetSlotOpened,
+	"REMOVED":  cabinetKeyRemoved,
+	"RETURNED": cabinetKeyReturned,
+}
+
+func (simulatedCabinetAdapter) ParseEvents(payload []byte) ([]models.CabinetEvent, error) {
+	var events []models.CabinetEvent
+	scanner := bufio.NewScanner(bytes.NewReader(payload))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, fmt.Errorf("line %d: expected time, slot, event and optional badge", line)
+		}
+
+		var e models.CabinetEvent
+		var err error
+		if e.OccurredAt, err = time.Parse(time.RFC3339, fields[0]); err != nil {
+			return nil, fmt.Errorf("line %d: invalid time", line)
+		}
+		if e.Slot, err = strconv.Atoi(fields[1]); err != nil {
+			return nil, fmt.Errorf("line %d: invalid slot", line)
+		}
+		if e.Event = simulatedCabinetEvents[fields[2]]; e.Event == "" {
+			return nil, fmt.Errorf("line %d: unknown event %q", line, fields[2])
+		}
+		if len(fields) == 4 {
+			if e.StaffID, err = strconv.Atoi(fields[3]); err != nil {
+				return nil, fmt.Errorf("line %d: invalid badge", line)
+			}
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// simulateCabinetLine is what the simulated cabinet sends for a slot event
+func simulateCabinetLine(e models.CabinetEvent) string {
+	line := e.OccurredAt.Format(time.RFC3339) + " " + strconv.Itoa(e.Slot)
+	for code, event := range simulatedCabinetEvents {
+		if event == e.Event {
+			line += " " + code
+		}
+	}
+	if e.StaffID != 0 {
+		line += " " + strconv.Itoa(e.StaffID)
+	}
+	return line
+}
+
+// cabinetRemovalRefusal checks whether the staff member may take an in-stock copy out of the cabinet
+// and works out when the loan expires. A message is returned when they may not.
+func cabinetRemovalRefusal(q queryer, kc models.KeyCopy, staffID int, at time.Time) (*time.Time, string, error) {
+	if staffID == 0 {
+		return nil, "No badge was presented", nil
+	}
+	if kc.Status != "active" {
+		return nil, "Key copy is marked " + kc.Status, nil
+	}
+
+	expiresAt, msg, err := assignmentExpiry(q, staffID, nil)
+	if err != nil || msg != "" {
+		return nil, msg, err
+	}
+
+	dual, err := isDualControl(q, kc.KeyID)
+	if err != nil {
+		return nil, "", err
+	}
+	if dual {
+		return nil, dualControlMessage, nil
+	}
+
+	reserved, err := reservedByOther(q, kc.ID, staffID, at)
+	if err != nil {
+		return nil, "", err
+	}
+	if reserved {
+		return nil, "Key copy is reserved by another staff member", nil
+	}
+
+	_, msg, err = checkClearance(q, staffID, kc.KeyID, clearanceOverride{})
+	return expiresAt, msg, err
+}
+
+// processCabinetEvent applies a slot event to the copy in that slot, raises an alert when a key leaves
+// the cabinet without an authorised checkout, and records the event with its outcome
+func processCabinetEvent(q queryer, cabinetID int, e *models.CabinetEvent) error {
+	e.CabinetID = cabinetID
+	e.Outcome = "recorded"
+
+	var kc models.KeyCopy
+	err := q.QueryRow(`
+		SELECT kc.id, kc.key_id, COALESCE(kc.staff_id, 0), kc.status
+		FROM cabinet_slots cs
+		JOIN key_copies kc ON kc.id = cs.key_copy_id
+		WHERE cs.cabinet_id = $1 AND cs.slot = $2
+		FOR UPDATE OF kc`, cabinetID, e.Slot,
+	).Scan(&kc.ID, &kc.KeyID, &kc.StaffID, &kc.Status)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	e.KeyCopyID = kc.ID
+
+	switch {
+	case e.Event == cabinetSlotOpened:
+	case e.Event != cabinetKeyRemoved && e.Event != cabinetKeyReturned:
+		e.Outcome = "ignored"
+		e.Detail = "Unknown event"
+	case err == sql.ErrNoRows:
+		e.Outcome = "unmapped_slot"
+		e.Detail = "No key copy is assigned to this slot"
+
+	case e.Event == cabinetKeyRemoved && kc.StaffID != 0 && kc.StaffID == e.StaffID:
+		// Collected after a checkout made beforehand, e.g. a confirmed dual-control checkout
+		e.Outcome = "checked_out"
+		e.Detail = "Collected by the holder"
+
+	case e.Event == cabinetKeyRemoved:
+		msg := ""
+		var expiresAt *time.Time
+		if kc.StaffID != 0 {
+			msg = fmt.Sprintf("Key copy is checked out to staff %d", kc.StaffID)
+		} else if expiresAt, msg, err = cabinetRemovalRefusal(q, kc, e.StaffID, e.OccurredAt); err != nil {
+			return err
+		}
+
+		if msg == "" {
+			err = issueKeyCopy(q, kc.ID, kc.KeyID, e.StaffID, e.StaffID, expiresAt, fmt.Sprintf("Removed from cabinet %d slot %d", cabinetID, e.Slot))
+			if err != nil {
+				return err
+			}
+			e.Outcome = "checked_out"
+			break
+		}
+
+		e.Outcome = "unauthorised"
+		e.Detail = msg
+		err = raiseAlert(q, models.Alert{
+			Type:      "unauthorised_removal",
+			Severity:  "critical",
+			Message:   fmt.Sprintf("Key copy %d was removed from cabinet %d slot %d without an authorised checkout: %s", kc.ID, cabinetID, e.Slot, msg),
+			KeyCopyID: kc.ID,
+			StaffID:   e.StaffID,
+		})
+		if err != nil {
+			return err
+		}
+
+	case e.Event == cabinetKeyReturned && kc.StaffID != 0:
+		note := fmt.Sprintf("Returned to cabinet %d slot %d", cabinetID, e.Slot)
+		if err := returnKeyCopy(q, kc.ID, kc.KeyID, kc.StaffID, e.StaffID, note); err != nil {
+			return err
+		}
+		// Putting the key back settles any return the holder was asked for
+		_, err = q.Exec(
+			"UPDATE return_tasks SET status = 'completed', completed_at = NOW() WHERE key_copy_id = $1 AND staff_id = $2 AND status = 'open'",
+			kc.ID, kc.StaffID,
+		)
+		if err != nil {
+			return err
+		}
+		e.Outcome = "checked_in"
+
+	default:
+		e.Detail = "Key copy was already in stock"
+	}
+
+	return q.QueryRow(`
+		INSERT INTO cabinet_events (cabinet_id, slot, event, staff_id, key_copy_id, outcome, detail, occurred_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, received_at`,
+		e.CabinetID, e.Slot, e.Event, nullableID(e.StaffID), nullableID(e.KeyCopyID), e.Outcome, e.Detail, e.OccurredAt,
+	).Scan(&e.ID, &e.ReceivedAt)
+}
+
+// ingestCabinetPayload parses a payload with the cabinet's adapter and applies its events in one transaction
+func ingestCabinetPayload(db *sql.DB, w http.ResponseWriter, cabinetID string, payload []byte, simulated bool) {
+	var c models.Cabinet
+	err := db.QueryRow("SELECT id, name, adapter, created_at FROM cabinets WHERE id = $1", cabinetID).Scan(&c.ID, &c.Name, &c.Adapter, &c.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Cabinet not found", http.StatusNotFound)
+		} else {
+			log.Printf("Error retrieving cabinet: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if simulated && c.Adapter != "simulated" {
+		http.Error(w, "Only cabinets using the simulated adapter can be simulated", http.StatusBadRequest)
+		return
+	}
+
+	adapter, ok := cabinetAdapters[c.Adapter]
+	if !ok {
+		log.Printf("Cabinet %d uses unknown adapter %q", c.ID, c.Adapter)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	events, err := adapter.ParseEvents(payload)
+	if err != nil {
+		http.Error(w, "Invalid cabinet payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for i := range events {
+		if err := processCabinetEvent(tx, c.ID, &events[i]); err != nil {
+			log.Printf("Error processing cabinet event: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing cabinet events: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if events == nil {
+		events = []models.CabinetEvent{}
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(events)
+}
+
+// Get all cabinets
+func GetCabinets(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT id, name, adapter, created_at FROM cabinets ORDER BY id")
+		if err != nil {
+			log.Printf("Error querying cabinets: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		cabinets := []models.Cabinet{}
+		for rows.Next() {
+			var c models.Cabinet
+			if err := rows.Scan(&c.ID, &c.Name, &c.Adapter, &c.CreatedAt); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			cabinets = append(cabinets, c)
+		}
+
+		json.NewEncoder(w).Encode(cabinets)
+	}
+}
+
+// Register a key cabinet and the adapter that understands it
+func CreateCabinet(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var c models.Cabinet
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if c.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		if c.Adapter == "" {
+			c.Adapter = "generic"
+		}
+		if _, ok := cabinetAdapters[c.Adapter]; !ok {
+			http.Error(w, "Unknown cabinet adapter", http.StatusBadRequest)
+			return
+		}
+
+		err := db.QueryRow(
+			"INSERT INTO cabinets (name, adapter) VALUES ($1, $2) RETURNING id, created_at",
+			c.Name, c.Adapter,
+		).Scan(&c.ID, &c.CreatedAt)
+		if err != nil {
+			log.Printf("Error creating cabinet: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// Get which key copy sits in each slot of a cabinet
+func GetCabinetSlots(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		rows, err := db.Query("SELECT cabinet_id, slot, key_copy_id FROM cabinet_slots WHERE cabinet_id = $1 ORDER BY slot", id)
+		if err != nil {
+			log.Printf("Error querying cabinet slots: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		slots := []models.CabinetSlot{}
+		for rows.Next() {
+			var s models.CabinetSlot
+			if err := rows.Scan(&s.CabinetID, &s.Slot, &s.KeyCopyID); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			slots = append(slots, s)
+		}
+
+		json.NewEncoder(w).Encode(slots)
+	}
+}
+
+// Put a key copy in a cabinet slot
+func UpdateCabinetSlot(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		var s models.CabinetSlot
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		if s.CabinetID, err = strconv.Atoi(vars["id"]); err != nil {
+			http.Error(w, "Cabinet not found", http.StatusNotFound)
+			return
+		}
+		if s.Slot, err = strconv.Atoi(vars["slot"]); err != nil || s.Slot <= 0 {
+			http.Error(w, "slot must be a positive number", http.StatusBadRequest)
+			return
+		}
+
+		var exists bool
+		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM cabinets WHERE id = $1)", s.CabinetID).Scan(&exists)
+		if err != nil {
+			log.Printf("Error checking cabinet existence: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Cabinet not found", http.StatusNotFound)
+			return
+		}
+
+		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM key_copies WHERE id = $1)", s.KeyCopyID).Scan(&exists)
+		if err != nil {
+			log.Printf("Error checking key copy existence: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Key copy does not exist", http.StatusBadRequest)
+			return
+		}
+
+		var taken bool
+		err = db.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM cabinet_slots WHERE key_copy_id = $1 AND NOT (cabinet_id = $2 AND slot = $3))",
+			s.KeyCopyID, s.CabinetID, s.Slot,
+		).Scan(&taken)
+		if err != nil {
+			log.Printf("Error checking cabinet slots: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			http.Error(w, "Key copy is already assigned to another slot", http.StatusConflict)
+			return
+		}
+
+		_, err = db.Exec(`
+			INSERT INTO cabinet_slots (cabinet_id, slot, key_copy_id) VALUES ($1, $2, $3)
+			ON CONFLICT (cabinet_id, slot) DO UPDATE SET key_copy_id = EXCLUDED.key_copy_id`,
+			s.CabinetID, s.Slot, s.KeyCopyID,
+		)
+		if err != nil {
+			log.Printf("Error updating cabinet slot: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(s)
+	}
+}
+
+// Empty a cabinet slot
+func DeleteCabinetSlot(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		result, err := db.Exec("DELETE FROM cabinet_slots WHERE cabinet_id = $1 AND slot = $2", vars["id"], vars["slot"])
+		if err != nil {
+			log.Printf("Error deleting cabinet slot: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			http.Error(w, "Cabinet slot not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Cabinet slot emptied successfully"})
+	}
+}
+
+// Get a cabinet's events, newest first, with pagination
+func GetCabinetEvents(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || page <= 0 {
+			page = 1
+		}
+
+		pageSize, err := strconv.Atoi(r.URL.Query().Get("pageSize"))
+		if err != nil || pageSize <= 0 {
+			pageSize = 20
+		}
+
+		rows, err := db.Query(`
+			SELECT id, cabinet_id, slot, event, COALESCE(staff_id, 0), COALESCE(key_copy_id, 0), outcome, COALESCE(detail, ''), occurred_at, received_at
+			FROM cabinet_events
+			WHERE cabinet_id = $1
+			ORDER BY occurred_at DESC, id DESC
+			LIMIT $2 OFFSET $3`, id, pageSize, (page-1)*pageSize)
+		if err != nil {
+			log.Printf("Error querying cabinet events: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		events := []models.CabinetEvent{}
+		for rows.Next() {
+			var e models.CabinetEvent
+			if err := rows.Scan(&e.ID, &e.CabinetID, &e.Slot, &e.Event, &e.StaffID, &e.KeyCopyID, &e.Outcome, &e.Detail, &e.OccurredAt, &e.ReceivedAt); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			events = append(events, e)
+		}
+
+		json.NewEncoder(w).Encode(events)
+	}
+}
+
+// Ingest the events a cabinet pushes, in whatever format its adapter understands
+func IngestCabinetEvents(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		payload, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		ingestCabinetPayload(db, w, vars["id"], payload, false)
+	}
+}
+
+// Act as the simulated cabinet for local testing: the slot event is sent through the simulated
+// adapter's line protocol exactly as the device would send it
+func SimulateCabinetEvent(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		var e models.CabinetEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if e.Slot <= 0 {
+			http.Error(w, "slot must be a positive number", http.StatusBadRequest)
+			return
+		}
+		if e.Event != cabinetSlotOpened && e.Event != cabinetKeyRemoved && e.Event != cabinetKeyReturned {
+			http.Error(w, "event must be slot_opened, key_removed or key_returned", http.StatusBadRequest)
+			return
+		}
+		if e.OccurredAt.IsZero() {
+			e.OccurredAt = time.Now()
+		}
+
+		ingestCabinetPayload(db, w, vars["id"], []byte(simulateCabinetLine(e)), true)
+	}
+}
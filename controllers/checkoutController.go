@@ -0,0 +1,398 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-app-be/models"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// dualControlWindow is how long a second staff member has to confirm a dual-control checkout
+const dualControlWindow = 5 * time.Minute
+
+const dualControlMessage = "Copies of dual-control keys must be checked out through a confirmed checkout"
+
+type checkoutRequest struct {
+	StaffID   int        `json:"staff_id"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	// AccessRequestID names the approved access request this checkout picks up, if any
+	AccessRequestID int `json:"access_request_id"`
+	clearanceOverride
+}
+
+type checkoutConfirmation struct {
+	StaffID int `json:"staff_id"`
+}
+
+const checkoutColumns = `id, key_copy_id, staff_id, COALESCE(witness_staff_id, 0), COALESCE(access_request_id, 0), status,
+	loan_expires_at, created_at, expires_at, confirmed_at`
+
+func scanCheckout(row rowScanner) (models.KeyCopyCheckout, error) {
+	var c models.KeyCopyCheckout
+	err := row.Scan(&c.ID, &c.KeyCopyID, &c.StaffID, &c.WitnessStaffID, &c.AccessRequestID, &c.Status,
+		&c.LoanExpiresAt, &c.CreatedAt, &c.ExpiresAt, &c.ConfirmedAt)
+	return c, err
+}
+
+// fulfilAccessRequest records that an approved access request was picked up with the copy, reporting
+// whether the request was still waiting for it
+func fulfilAccessRequest(q queryer, accessRequestID, keyCopyID int) (bool, error) {
+	result, err := q.Exec(
+		"UPDATE access_requests SET status = 'fulfilled', key_copy_id = $1 WHERE id = $2 AND status = 'approved'",
+		keyCopyID, accessRequestID,
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// isDualControl reports whether copies of the key need a second staff member to check out
+func isDualControl(q queryer, keyID int) (bool, error) {
+	var dual bool
+	err := q.QueryRow("SELECT COALESCE((SELECT dual_control FROM keys WHERE id = $1), FALSE)", keyID).Scan(&dual)
+	return dual, err
+}
+
+// ExpireCheckouts rejects dual-control checkouts nobody confirmed in time
+func ExpireCheckouts(db *sql.DB) error {
+	_, err := db.Exec("UPDATE key_copy_checkouts SET status = 'rejected' WHERE status = 'pending' AND expires_at <= NOW()")
+	return err
+}
+
+// Check out an in-stock key copy. Copies of dual-control keys stay pending until a second staff member confirms.
+// With access_request_id the checkout picks up that approved access request: the loan runs to the request's end
+// date and the request is fulfilled once the copy is handed out. This is how approved requests for dual-control
+// keys are picked up, since the pickup endpoint can't issue them without a witness.
+func CreateCheckout(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		var req checkoutRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if req.StaffID == 0 {
+			http.Error(w, "staff_id is required", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var kc models.KeyCopy
+		err = tx.QueryRow(
+			"SELECT id, key_id, COALESCE(staff_id, 0), status FROM key_copies WHERE id = $1 FOR UPDATE",
+			id,
+		).Scan(&kc.ID, &kc.KeyID, &kc.StaffID, &kc.Status)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Key copy not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving key copy: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if kc.StaffID != 0 || kc.Status != "active" {
+			http.Error(w, "Key copy is not in stock", http.StatusConflict)
+			return
+		}
+
+		var pending bool
+		err = tx.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM key_copy_checkouts WHERE key_copy_id = $1 AND status = 'pending' AND expires_at > NOW())",
+			kc.ID,
+		).Scan(&pending)
+		if err != nil {
+			log.Printf("Error checking pending checkouts: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if pending {
+			http.Error(w, "Key copy already has a checkout awaiting confirmation", http.StatusConflict)
+			return
+		}
+
+		reserved, err := reservedByOther(tx, kc.ID, req.StaffID, time.Now())
+		if err != nil {
+			log.Printf("Error checking reservations: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if reserved {
+			http.Error(w, "Key copy is reserved by another staff member", http.StatusConflict)
+			return
+		}
+
+		if req.AccessRequestID != 0 {
+			ar, err := scanAccessRequest(tx.QueryRow("SELECT "+accessRequestColumns+" FROM access_requests WHERE id = $1 FOR UPDATE", req.AccessRequestID))
+			if err != nil {
+				if err == sql.ErrNoRows {
+					http.Error(w, "Access request does not exist", http.StatusBadRequest)
+				} else {
+					log.Printf("Error retrieving access request: %v", err)
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+				}
+				return
+			}
+			if ar.StaffID != req.StaffID || ar.KeyID != kc.KeyID {
+				http.Error(w, "Access request is for a different staff member or key", http.StatusBadRequest)
+				return
+			}
+			if ar.Status != "approved" {
+				http.Error(w, "Access request is not awaiting pickup", http.StatusConflict)
+				return
+			}
+			if ar.StartDate.After(time.Now()) {
+				http.Error(w, "Access request cannot be picked up before its start date", http.StatusConflict)
+				return
+			}
+
+			err = tx.QueryRow(
+				"SELECT EXISTS(SELECT 1 FROM key_copy_checkouts WHERE access_request_id = $1 AND status = 'pending' AND expires_at > NOW())",
+				ar.ID,
+			).Scan(&pending)
+			if err != nil {
+				log.Printf("Error checking pending checkouts: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if pending {
+				http.Error(w, "Access request already has a checkout awaiting confirmation", http.StatusConflict)
+				return
+			}
+			req.ExpiresAt = &ar.EndDate
+		}
+
+		_, msg, err := checkClearance(tx, req.StaffID, kc.KeyID, req.clearanceOverride)
+		if err != nil {
+			log.Printf("Error checking clearance: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if msg != "" {
+			http.Error(w, msg, http.StatusForbidden)
+			return
+		}
+
+		loanExpiresAt, msg, err := assignmentExpiry(tx, req.StaffID, req.ExpiresAt)
+		if err != nil {
+			log.Printf("Error checking staff validity: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		dual, err := isDualControl(tx, kc.KeyID)
+		if err != nil {
+			log.Printf("Error checking dual control: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		c := models.KeyCopyCheckout{
+			KeyCopyID:       kc.ID,
+			StaffID:         req.StaffID,
+			AccessRequestID: req.AccessRequestID,
+			Status:          "pending",
+			LoanExpiresAt:   loanExpiresAt,
+		}
+		if !dual {
+			c.Status = "confirmed"
+			note := "Checked out"
+			if c.AccessRequestID != 0 {
+				note = fmt.Sprintf("Checked out for access request #%d", c.AccessRequestID)
+			}
+			err = issueKeyCopy(tx, kc.ID, kc.KeyID, req.StaffID, req.StaffID, loanExpiresAt, note)
+			if err == nil && c.AccessRequestID != 0 {
+				_, err = fulfilAccessRequest(tx, c.AccessRequestID, kc.ID)
+			}
+			if err != nil {
+				log.Printf("Error issuing key copy: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		err = tx.QueryRow(`
+			INSERT INTO key_copy_checkouts (key_copy_id, staff_id, access_request_id, status, loan_expires_at, expires_at, confirmed_at)
+			VALUES ($1, $2, $3, $4, $5, $6, CASE WHEN $4 = 'confirmed' THEN NOW() END)
+			RETURNING id, created_at, expires_at, confirmed_at`,
+			c.KeyCopyID, c.StaffID, nullableID(c.AccessRequestID), c.Status, c.LoanExpiresAt, time.Now().Add(dualControlWindow),
+		).Scan(&c.ID, &c.CreatedAt, &c.ExpiresAt, &c.ConfirmedAt)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error creating checkout: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if dual {
+			w.WriteHeader(http.StatusAccepted)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// Get a specific checkout by ID
+func GetCheckout(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		c, err := scanCheckout(db.QueryRow("SELECT "+checkoutColumns+" FROM key_copy_checkouts WHERE id = $1", id))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Checkout not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving checkout: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// Confirm a pending dual-control checkout as the second staff member
+func ConfirmCheckout(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		var req checkoutConfirmation
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		c, err := scanCheckout(tx.QueryRow("SELECT "+checkoutColumns+" FROM key_copy_checkouts WHERE id = $1 FOR UPDATE", id))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Checkout not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving checkout: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if c.Status != "pending" || !c.ExpiresAt.After(time.Now()) {
+			http.Error(w, "Checkout is no longer awaiting confirmation", http.StatusConflict)
+			return
+		}
+		if req.StaffID == 0 || req.StaffID == c.StaffID {
+			http.Error(w, "A second staff member must confirm the checkout", http.StatusForbidden)
+			return
+		}
+
+		var keyID int
+		err = tx.QueryRow("SELECT key_id FROM key_copies WHERE id = $1 FOR UPDATE", c.KeyCopyID).Scan(&keyID)
+		if err != nil {
+			log.Printf("Error retrieving key copy: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// The witness must be authorised for the key in their own right
+		_, msg, err := checkClearance(tx, req.StaffID, keyID, clearanceOverride{})
+		if err != nil {
+			log.Printf("Error checking clearance: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if msg == "" {
+			_, msg, err = assignmentExpiry(tx, req.StaffID, nil)
+			if err != nil {
+				log.Printf("Error checking staff validity: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if msg != "" {
+			http.Error(w, "Confirming staff member is not authorised: "+msg, http.StatusForbidden)
+			return
+		}
+
+		err = issueKeyCopy(tx, c.KeyCopyID, keyID, c.StaffID, req.StaffID, c.LoanExpiresAt,
+			fmt.Sprintf("Dual-control checkout #%d confirmed by staff %d", c.ID, req.StaffID))
+		if err == errCopyNotInStock {
+			http.Error(w, "Key copy is not in stock", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error issuing key copy: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := tx.Exec("UPDATE key_copies SET witness_staff_id = $1 WHERE id = $2", req.StaffID, c.KeyCopyID); err != nil {
+			log.Printf("Error updating key copy: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// A checkout for an access request is its pickup
+		if c.AccessRequestID != 0 {
+			waiting, err := fulfilAccessRequest(tx, c.AccessRequestID, c.KeyCopyID)
+			if err != nil {
+				log.Printf("Error fulfilling access request: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if !waiting {
+				http.Error(w, "Access request is no longer awaiting pickup", http.StatusConflict)
+				return
+			}
+		}
+
+		c.Status = "confirmed"
+		c.WitnessStaffID = req.StaffID
+		err = tx.QueryRow(
+			"UPDATE key_copy_checkouts SET status = $1, witness_staff_id = $2, confirmed_at = NOW() WHERE id = $3 RETURNING confirmed_at",
+			c.Status, c.WitnessStaffID, c.ID,
+		).Scan(&c.ConfirmedAt)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error confirming checkout: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(c)
+	}
+}
@@ -0,0 +1,399 @@
+package controllers
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/gorilla/mux"
+)
+
+const (
+	reportMargin    = 10.0
+	reportRowHeight = 5.0
+)
+
+// organisationName heads every PDF report, from ORGANISATION_NAME
+func organisationName() string {
+	if name := os.Getenv("ORGANISATION_NAME"); name != "" {
+		return name
+	}
+	return "Key Management"
+}
+
+// reportPDF is an A4 document with the organisation, report title and generation time at the top of every
+// page and page numbers at the bottom. While a table is open its header is repeated on each new page.
+type reportPDF struct {
+	*fpdf.Fpdf
+	tr     func(string) string
+	header []string
+	widths []float64
+}
+
+func newReportPDF(orientation, title string) *reportPDF {
+	pdf := fpdf.New(orientation, "mm", "A4", "")
+	p := &reportPDF{Fpdf: pdf, tr: pdf.UnicodeTranslatorFromDescriptor("")}
+	generated := time.Now().Format(time.RFC1123)
+
+	pdf.SetMargins(reportMargin, reportMargin, reportMargin)
+	pdf.SetAutoPageBreak(true, reportMargin+5)
+	pdf.AliasNbPages("")
+	pdf.SetHeaderFunc(func() {
+		pdf.SetFont("Helvetica", "B", 14)
+		pdf.CellFormat(0, 7, p.tr(organisationName()), "", 1, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "B", 11)
+		pdf.CellFormat(0, 6, p.tr(title), "", 1, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 8)
+		pdf.CellFormat(0, 5, "Generated "+generated, "B", 1, "L", false, 0, "")
+		pdf.Ln(3)
+		if p.header != nil {
+			p.tableHeader()
+		}
+	})
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-reportMargin - 3)
+		pdf.SetFont("Helvetica", "", 8)
+		pdf.CellFormat(0, 5, fmt.Sprintf("Page %d of {nb}", pdf.PageNo()), "", 0, "R", false, 0, "")
+	})
+	return p
+}
+
+// columns shares the page width between columns in proportion to their weights
+func (p *reportPDF) columns(weights ...float64) []float64 {
+	pageWidth, _ := p.GetPageSize()
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	widths := make([]float64, len(weights))
+	for i, w := range weights {
+		widths[i] = (pageWidth - 2*reportMargin) * w / total
+	}
+	return widths
+}
+
+func (p *reportPDF) section(text string) {
+	p.Ln(3)
+	p.SetFont("Helvetica", "B", 10)
+	p.CellFormat(0, 6, p.tr(text), "", 1, "L", false, 0, "")
+}
+
+func (p *reportPDF) field(label, value string) {
+	p.SetFont("Helvetica", "B", 8)
+	p.CellFormat(40, reportRowHeight, p.tr(label), "", 0, "L", false, 0, "")
+	p.SetFont("Helvetica", "", 8)
+	p.CellFormat(0, reportRowHeight, p.tr(value), "", 1, "L", false, 0, "")
+}
+
+func (p *reportPDF) paragraph(text string) {
+	p.SetFont("Helvetica", "", 8)
+	p.MultiCell(0, 4, p.tr(text), "", "L", false)
+}
+
+func (p *reportPDF) tableHeader() {
+	p.SetFont("Helvetica", "B", 8)
+	p.SetFillColor(230, 230, 230)
+	for i, h := range p.header {
+		p.CellFormat(p.widths[i], reportRowHeight, fitText(p.Fpdf, p.tr(h), p.widths[i]-1), "1", 0, "L", true, 0, "")
+	}
+	p.Ln(-1)
+}
+
+func (p *reportPDF) startTable(header []string, widths []float64) {
+	p.header, p.widths = header, widths
+	p.tableHeader()
+}
+
+func (p *reportPDF) endTable() {
+	p.header, p.widths = nil, nil
+}
+
+func (p *reportPDF) row(cells ...string) {
+	p.SetFont("Helvetica", "", 8)
+	for i, text := range cells {
+		p.CellFormat(p.widths[i], reportRowHeight, fitText(p.Fpdf, p.tr(text), p.widths[i]-1), "1", 0, "L", false, 0, "")
+	}
+	p.Ln(-1)
+}
+
+// reportText formats a value for a report cell
+func reportText(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.Format("2006-01-02 15:04")
+	case *time.Time:
+		if v == nil {
+			return ""
+		}
+		return v.Format("2006-01-02 15:04")
+	case bool:
+		if v {
+			return "Yes"
+		}
+		return "No"
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func writeReportPDF(w http.ResponseWriter, p *reportPDF, filename string) {
+	var buf bytes.Buffer
+	if err := p.Output(&buf); err != nil {
+		log.Printf("Error generating report: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `inline; filename="`+filename+`"`)
+	w.Write(buf.Bytes())
+}
+
+type registerCopy struct {
+	Serial     string
+	Status     string
+	Holder     string
+	Witness    string
+	ExpiresAt  *time.Time
+	LastChange *time.Time
+}
+
+// Get the key register as a PDF: every key with its custodian and every copy with its current holder
+func GetKeyRegister(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`
+			SELECT kc.key_id, COALESCE(kc.serial, ''), kc.status, COALESCE(s.name, ''), COALESCE(ws.name, ''),
+				kc.expires_at, latest.created_at
+			FROM key_copies kc
+			LEFT JOIN staffs s ON s.id = kc.staff_id
+			LEFT JOIN staffs ws ON ws.id = kc.witness_staff_id
+			LEFT JOIN LATERAL (
+				SELECT created_at FROM key_copy_history h
+				WHERE h.key_copy_id = kc.id
+				ORDER BY created_at DESC, id DESC
+				LIMIT 1
+			) latest ON TRUE
+			ORDER BY kc.key_id, kc.id`)
+		if err != nil {
+			log.Printf("Error querying key copies: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		copies := map[int][]registerCopy{}
+		total := 0
+		for rows.Next() {
+			var keyID int
+			var c registerCopy
+			if err := rows.Scan(&keyID, &c.Serial, &c.Status, &c.Holder, &c.Witness, &c.ExpiresAt, &c.LastChange); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			copies[keyID] = append(copies[keyID], c)
+			total++
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Error querying key copies: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		rows, err = db.Query(`
+			SELECT k.id, k.name, COALESCE(k.description, ''), k.clearance_level, k.dual_control,
+				COALESCE(k.external_id, ''), COALESCE(c.name, '')
+			FROM keys k
+			LEFT JOIN staffs c ON c.id = k.staff_id
+			ORDER BY k.name, k.id`)
+		if err != nil {
+			log.Printf("Error querying keys: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		p := newReportPDF("P", "Key Register")
+		p.AddPage()
+		widths := p.columns(3, 2, 3, 3, 2.5, 2.5)
+		keys := 0
+		for rows.Next() {
+			var id, clearance int
+			var name, description, externalID, custodian string
+			var dualControl bool
+			if err := rows.Scan(&id, &name, &description, &clearance, &dualControl, &externalID, &custodian); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			keys++
+
+			p.section(fmt.Sprintf("%s (key %d)", name, id))
+			if description != "" {
+				p.field("Description", description)
+			}
+			if custodian == "" {
+				custodian = "None"
+			}
+			p.field("Custodian", custodian)
+			p.field("Clearance level", strconv.Itoa(clearance))
+			p.field("Dual control", reportText(dualControl))
+			if externalID != "" {
+				p.field("External ID", externalID)
+			}
+
+			if len(copies[id]) == 0 {
+				p.paragraph("No copies.")
+				continue
+			}
+			p.startTable([]string{"Serial", "Status", "Holder", "Witness", "Expires", "Last Change"}, widths)
+			for _, c := range copies[id] {
+				holder := c.Holder
+				if holder == "" {
+					holder = "In stock"
+				}
+				p.row(c.Serial, c.Status, holder, c.Witness, reportText(c.ExpiresAt), reportText(c.LastChange))
+			}
+			p.endTable()
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Error querying keys: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		p.section("Summary")
+		p.field("Keys", strconv.Itoa(keys))
+		p.field("Copies", strconv.Itoa(total))
+
+		writeReportPDF(w, p, "key-register.pdf")
+	}
+}
+
+// Get a staff member's access statement as a PDF: the keys they are custodian of and the copies they hold
+// now, with a declaration for them and a reviewer to sign
+func GetAccessStatement(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Invalid staff ID", http.StatusBadRequest)
+			return
+		}
+
+		var name, role, staffType, manager, externalID string
+		var validFrom, validUntil *time.Time
+		var clearance int
+		err = db.QueryRow(`
+			SELECT s.name, COALESCE(s.role, ''), s.staff_type, s.valid_from, s.valid_until, s.clearance_level,
+				COALESCE(m.name, ''), COALESCE(s.external_id, '')
+			FROM staffs s
+			LEFT JOIN staffs m ON m.id = s.manager_id
+			WHERE s.id = $1`, id,
+		).Scan(&name, &role, &staffType, &validFrom, &validUntil, &clearance, &manager, &externalID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Staff not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving staff: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		held, err := copiesHeldAt(db, "staff_id", id, time.Now())
+		if err != nil {
+			log.Printf("Error querying held copies: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := db.Query(`SELECT id, name, clearance_level, dual_control FROM keys WHERE staff_id = $1 ORDER BY name, id`, id)
+		if err != nil {
+			log.Printf("Error querying keys: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		p := newReportPDF("P", "Staff Access Statement")
+		p.AddPage()
+		p.section("Staff member")
+		p.field("Name", name)
+		p.field("Staff ID", strconv.Itoa(id))
+		if externalID != "" {
+			p.field("External ID", externalID)
+		}
+		p.field("Role", role)
+		p.field("Staff type", staffType)
+		p.field("Clearance level", strconv.Itoa(clearance))
+		if manager != "" {
+			p.field("Manager", manager)
+		}
+		p.field("Valid from", reportText(validFrom))
+		p.field("Valid until", reportText(validUntil))
+
+		p.section("Keys in their custody")
+		custodian := 0
+		for rows.Next() {
+			var keyID, keyClearance int
+			var keyName string
+			var dualControl bool
+			if err := rows.Scan(&keyID, &keyName, &keyClearance, &dualControl); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if custodian == 0 {
+				p.startTable([]string{"Key ID", "Key", "Clearance Level", "Dual Control"}, p.columns(1, 4, 2, 2))
+			}
+			custodian++
+			p.row(strconv.Itoa(keyID), keyName, strconv.Itoa(keyClearance), reportText(dualControl))
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Error querying keys: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		p.endTable()
+		if custodian == 0 {
+			p.paragraph("None.")
+		}
+
+		p.section("Key copies held")
+		if len(held) == 0 {
+			p.paragraph("None.")
+		} else {
+			p.startTable([]string{"Serial", "Key", "Held Since", "Last Action"}, p.columns(2, 4, 2, 2))
+			for _, h := range held {
+				p.row(h.Serial, h.KeyName, reportText(h.Since), h.LastAction)
+			}
+			p.endTable()
+		}
+
+		p.section("Declaration")
+		p.paragraph("I confirm that the keys and key copies listed above are complete and correct, that the copies " +
+			"are in my possession, and that I will return them when asked or when I no longer need them.")
+		p.Ln(10)
+		for _, signer := range []string{"Staff member", "Reviewer"} {
+			p.SetFont("Helvetica", "", 8)
+			p.CellFormat(30, reportRowHeight, signer, "", 0, "L", false, 0, "")
+			p.CellFormat(80, reportRowHeight, "Signature: ", "B", 0, "L", false, 0, "")
+			p.CellFormat(10, reportRowHeight, "", "", 0, "L", false, 0, "")
+			p.CellFormat(50, reportRowHeight, "Date: ", "B", 1, "L", false, 0, "")
+			p.Ln(10)
+		}
+
+		writeReportPDF(w, p, fmt.Sprintf("access-statement-%d.pdf", id))
+	}
+}
@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type DashboardStaff struct {
+	StaffID int    `json:"staff_id"`
+	Name    string `json:"name"`
+	Role    string `json:"role"`
+	Copies  int    `json:"copies"`
+}
+
+type DashboardKey struct {
+	KeyID  int    `json:"key_id"`
+	Name   string `json:"name"`
+	Copies int    `json:"copies"`
+}
+
+type Dashboard struct {
+	Keys           int              `json:"keys"`
+	Staffs         int              `json:"staffs"`
+	Copies         int              `json:"copies"`
+	CopiesByStatus map[string]int   `json:"copies_by_status"`
+	CopiesOut      int              `json:"copies_out"`
+	CopiesInStock  int              `json:"copies_in_stock"`
+	Overdue        int              `json:"overdue"`
+	LostThisMonth  int              `json:"lost_this_month"`
+	OpenAlerts     int              `json:"open_alerts"`
+	TopHolders     []DashboardStaff `json:"top_holders"`
+	KeysOutOfStock []DashboardKey   `json:"keys_out_of_stock"`
+}
+
+// Get the overview counts for the dashboard in one response. top sets how many of the biggest holders to list (5 by default).
+func GetDashboard(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		top, err := strconv.Atoi(r.URL.Query().Get("top"))
+		if err != nil || top <= 0 {
+			top = 5
+		}
+
+		// Read everything from one snapshot so the numbers add up
+		tx, err := db.BeginTx(r.Context(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		d := Dashboard{
+			CopiesByStatus: map[string]int{},
+			TopHolders:     []DashboardStaff{},
+			KeysOutOfStock: []DashboardKey{},
+		}
+		err = tx.QueryRow(`
+			SELECT
+				(SELECT COUNT(*) FROM keys),
+				(SELECT COUNT(*) FROM staffs),
+				(SELECT COUNT(*) FROM key_copies),
+				(SELECT COUNT(*) FROM key_copies WHERE status = 'active' AND COALESCE(staff_id, 0) <> 0),
+				(SELECT COUNT(*) FROM key_copies WHERE status = 'active' AND COALESCE(staff_id, 0) = 0),
+				(SELECT COUNT(*) FROM key_copies WHERE COALESCE(staff_id, 0) <> 0 AND (expired OR expires_at <= NOW())),
+				(SELECT COUNT(DISTINCT key_copy_id) FROM key_copy_history WHERE action = 'marked_lost' AND created_at >= date_trunc('month', NOW())),
+				(SELECT COUNT(*) FROM alerts WHERE status = 'open')`,
+		).Scan(&d.Keys, &d.Staffs, &d.Copies, &d.CopiesOut, &d.CopiesInStock, &d.Overdue, &d.LostThisMonth, &d.OpenAlerts)
+		if err != nil {
+			log.Printf("Error counting dashboard totals: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := tx.Query("SELECT status, COUNT(*) FROM key_copies GROUP BY status")
+		if err != nil {
+			log.Printf("Error counting copies by status: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var status string
+			var count int
+			if err := rows.Scan(&status, &count); err != nil {
+				rows.Close()
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			d.CopiesByStatus[status] = count
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			log.Printf("Error counting copies by status: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		rows, err = tx.Query(`
+			SELECT s.id, s.name, COALESCE(s.role, ''), COUNT(*)
+			FROM key_copies kc
+			JOIN staffs s ON s.id = kc.staff_id
+			WHERE kc.status = 'active'
+			GROUP BY s.id, s.name, s.role
+			ORDER BY COUNT(*) DESC, s.id
+			LIMIT $1`, top)
+		if err != nil {
+			log.Printf("Error querying top holders: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var s DashboardStaff
+			if err := rows.Scan(&s.StaffID, &s.Name, &s.Role, &s.Copies); err != nil {
+				rows.Close()
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			d.TopHolders = append(d.TopHolders, s)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			log.Printf("Error querying top holders: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// Keys with no copy in the cabinet, including keys that have no copies at all
+		rows, err = tx.Query(`
+			SELECT k.id, k.name, COUNT(kc.id)
+			FROM keys k
+			LEFT JOIN key_copies kc ON kc.key_id = k.id AND kc.status = 'active'
+			GROUP BY k.id, k.name
+			HAVING COUNT(kc.id) FILTER (WHERE COALESCE(kc.staff_id, 0) = 0) = 0
+			ORDER BY k.name, k.id`)
+		if err != nil {
+			log.Printf("Error querying keys out of stock: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var k DashboardKey
+			if err := rows.Scan(&k.KeyID, &k.Name, &k.Copies); err != nil {
+				rows.Close()
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			d.KeysOutOfStock = append(d.KeysOutOfStock, k)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			log.Printf("Error querying keys out of stock: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(d)
+	}
+}
@@ -0,0 +1,528 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"go-app-be/models"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// importRowError reports a row of an uploaded file that could not be used
+type importRowError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+type DoorImportResult struct {
+	Imported      int                `json:"imported"`
+	Duplicates    int                `json:"duplicates"`
+	Unmapped      int                `json:"unmapped"`
+	Flagged       int                `json:"flagged"`
+	FlaggedEvents []models.DoorEvent `json:"flagged_events"`
+}
+
+// doorLogColumns maps the column names door controllers use in their exports onto ours
+var doorLogColumns = map[string]string{
+	"timestamp":   "time",
+	"time":        "time",
+	"datetime":    "time",
+	"occurred_at": "time",
+	"door":        "door",
+	"door_code":   "door",
+	"door_id":     "door",
+	"reader":      "door",
+	"event":       "event",
+	"type":        "event",
+	"staff_id":    "staff",
+	"badge":       "staff",
+	"user_id":     "staff",
+}
+
+const doorEventColumns = `id, door_code, COALESCE(door_id, 0), COALESCE(key_id, 0), event, COALESCE(staff_id, 0),
+	occurred_at, holder_staff_ids, flagged, imported_at`
+
+func scanDoorEvent(row rowScanner) (models.DoorEvent, error) {
+	var e models.DoorEvent
+	var holders pq.Int64Array
+	err := row.Scan(&e.ID, &e.DoorCode, &e.DoorID, &e.KeyID, &e.Event, &e.StaffID, &e.OccurredAt, &holders, &e.Flagged, &e.ImportedAt)
+	e.HolderStaffIDs = make([]int, len(holders))
+	for i, id := range holders {
+		e.HolderStaffIDs[i] = int(id)
+	}
+	return e, err
+}
+
+// parseDoorLogTime accepts our usual formats plus the local "2006-01-02 15:04:05" most door controllers export
+func parseDoorLogTime(value string) (time.Time, error) {
+	if t, err := parseTime(value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+	if err != nil {
+		t, err = time.ParseInLocation("2006-01-02 15:04", value, time.Local)
+	}
+	return t, err
+}
+
+// parseDoorLog reads a door controller CSV export. The header row names the columns; time and door are required.
+func parseDoorLog(r io.Reader) ([]models.DoorEvent, []importRowError) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, []importRowError{{Line: 1, Message: "Missing header row"}}
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if column, ok := doorLogColumns[name]; ok {
+			columns[column] = i
+		}
+	}
+	if _, ok := columns["time"]; !ok {
+		return nil, []importRowError{{Line: 1, Message: "Missing timestamp column"}}
+	}
+	if _, ok := columns["door"]; !ok {
+		return nil, []importRowError{{Line: 1, Message: "Missing door column"}}
+	}
+
+	field := func(record []string, column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var events []models.DoorEvent
+	var errs []importRowError
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs = append(errs, importRowError{Line: line, Message: err.Error()})
+			continue
+		}
+
+		e := models.DoorEvent{DoorCode: field(record, "door"), Event: strings.ToLower(field(record, "event"))}
+		if e.DoorCode == "" {
+			errs = append(errs, importRowError{Line: line, Message: "door is required"})
+			continue
+		}
+		if e.Event == "" {
+			e.Event = "opened"
+		}
+		if e.OccurredAt, err = parseDoorLogTime(field(record, "time")); err != nil {
+			errs = append(errs, importRowError{Line: line, Message: "Invalid timestamp"})
+			continue
+		}
+		if staff := field(record, "staff"); staff != "" {
+			if e.StaffID, err = strconv.Atoi(staff); err != nil {
+				errs = append(errs, importRowError{Line: line, Message: "Invalid staff_id"})
+				continue
+			}
+		}
+		events = append(events, e)
+	}
+	return events, errs
+}
+
+// doorOpeningEvents are the controller events that mean the door was actually opened.
+// Closings, denials and status reports are imported but never flagged.
+var doorOpeningEvents = map[string]bool{
+	"opened":  true,
+	"granted": true,
+	"forced":  true,
+}
+
+// correlateDoorEvent looks up who held a copy of the door's key when it was opened.
+// An opening while nobody held a copy is flagged.
+func correlateDoorEvent(q queryer, e *models.DoorEvent) error {
+	holders, err := holdersAt(q, e.KeyID, e.OccurredAt)
+	if err != nil {
+		return err
+	}
+
+	e.HolderStaffIDs = []int{}
+	for _, kc := range holders {
+		e.HolderStaffIDs = append(e.HolderStaffIDs, kc.StaffID)
+	}
+	e.Flagged = len(holders) == 0 && doorOpeningEvents[e.Event]
+	return nil
+}
+
+// Get all doors and the keys that open them
+func GetDoors(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT id, code, name, COALESCE(key_id, 0) FROM doors ORDER BY code")
+		if err != nil {
+			log.Printf("Error querying doors: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		doors := []models.Door{}
+		for rows.Next() {
+			var d models.Door
+			if err := rows.Scan(&d.ID, &d.Code, &d.Name, &d.KeyID); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			doors = append(doors, d)
+		}
+
+		json.NewEncoder(w).Encode(doors)
+	}
+}
+
+// validateDoor returns a message when the door cannot be saved
+func validateDoor(q queryer, d *models.Door, id int) (string, error) {
+	if d.Code == "" {
+		return "code is required", nil
+	}
+	if d.Name == "" {
+		d.Name = d.Code
+	}
+
+	var exists bool
+	if d.KeyID != 0 {
+		if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM keys WHERE id = $1)", d.KeyID).Scan(&exists); err != nil {
+			return "", err
+		}
+		if !exists {
+			return "Key ID does not exist", nil
+		}
+	}
+
+	if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM doors WHERE code = $1 AND id <> $2)", d.Code, id).Scan(&exists); err != nil {
+		return "", err
+	}
+	if exists {
+		return "A door with this code already exists", nil
+	}
+	return "", nil
+}
+
+// Map a door controller's door code to the key that opens it
+func CreateDoor(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var d models.Door
+		if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		msg, err := validateDoor(db, &d, 0)
+		if err != nil {
+			log.Printf("Error validating door: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		err = db.QueryRow(
+			"INSERT INTO doors (code, name, key_id) VALUES ($1, $2, $3) RETURNING id",
+			d.Code, d.Name, nullableID(d.KeyID),
+		).Scan(&d.ID)
+		if err != nil {
+			log.Printf("Error creating door: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(d)
+	}
+}
+
+// Update a door
+func UpdateDoor(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		var d models.Door
+		if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		if d.ID, err = strconv.Atoi(vars["id"]); err != nil {
+			http.Error(w, "Door not found", http.StatusNotFound)
+			return
+		}
+
+		msg, err := validateDoor(db, &d, d.ID)
+		if err != nil {
+			log.Printf("Error validating door: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		result, err := db.Exec(
+			"UPDATE doors SET code = $1, name = $2, key_id = $3 WHERE id = $4",
+			d.Code, d.Name, nullableID(d.KeyID), d.ID,
+		)
+		if err != nil {
+			log.Printf("Error updating door: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			http.Error(w, "Door not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(d)
+	}
+}
+
+// Delete a door. Its imported events are kept.
+func DeleteDoor(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		result, err := db.Exec("DELETE FROM doors WHERE id = $1", id)
+		if err != nil {
+			log.Printf("Error deleting door: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			http.Error(w, "Door not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Door deleted successfully"})
+	}
+}
+
+// Import a door controller CSV export, either as the request body or as the "file" field of a form upload.
+// Rows already imported are skipped, and nothing is imported while any row is invalid.
+func ImportDoorEvents(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, "file is required", http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+			body = file
+		}
+
+		events, errs := parseDoorLog(body)
+		if len(errs) > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": errs})
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		doors := map[string]models.Door{}
+		rows, err := tx.Query("SELECT id, code, name, COALESCE(key_id, 0) FROM doors")
+		if err != nil {
+			log.Printf("Error querying doors: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var d models.Door
+			if err := rows.Scan(&d.ID, &d.Code, &d.Name, &d.KeyID); err != nil {
+				rows.Close()
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			doors[d.Code] = d
+		}
+		rows.Close()
+
+		result := DoorImportResult{FlaggedEvents: []models.DoorEvent{}}
+		for _, e := range events {
+			e.HolderStaffIDs = []int{}
+			door, mapped := doors[e.DoorCode]
+			e.DoorID, e.KeyID = door.ID, door.KeyID
+			if e.KeyID != 0 {
+				if err := correlateDoorEvent(tx, &e); err != nil {
+					log.Printf("Error correlating door event: %v", err)
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+			}
+
+			err := tx.QueryRow(`
+				INSERT INTO door_events (door_code, door_id, key_id, event, staff_id, occurred_at, holder_staff_ids, flagged)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+				ON CONFLICT (door_code, occurred_at, event) DO NOTHING
+				RETURNING id, imported_at`,
+				e.DoorCode, nullableID(e.DoorID), nullableID(e.KeyID), e.Event, nullableID(e.StaffID), e.OccurredAt,
+				pq.Array(e.HolderStaffIDs), e.Flagged,
+			).Scan(&e.ID, &e.ImportedAt)
+			if err == sql.ErrNoRows {
+				result.Duplicates++
+				continue
+			}
+			if err != nil {
+				log.Printf("Error importing door event: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			result.Imported++
+			if !mapped || e.KeyID == 0 {
+				result.Unmapped++
+			}
+			if !e.Flagged {
+				continue
+			}
+
+			result.Flagged++
+			result.FlaggedEvents = append(result.FlaggedEvents, e)
+			err = raiseAlert(tx, models.Alert{
+				Type:     "door_opened_without_key",
+				Severity: "warning",
+				Message: fmt.Sprintf("Door %s was opened at %s while no copy of key %d was checked out",
+					door.Name, e.OccurredAt.Format(time.RFC3339), e.KeyID),
+				StaffID: e.StaffID,
+			})
+			if err != nil {
+				log.Printf("Error raising alert: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing door events: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// Get imported door events with pagination and door, flagged and date range filters
+func GetDoorEvents(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || page <= 0 {
+			page = 1
+		}
+
+		pageSize, err := strconv.Atoi(r.URL.Query().Get("pageSize"))
+		if err != nil || pageSize <= 0 {
+			pageSize = 20
+		}
+
+		whereClause := "WHERE 1=1"
+		var queryParams []interface{}
+
+		if door := r.URL.Query().Get("door"); door != "" {
+			queryParams = append(queryParams, door)
+			whereClause += " AND door_code = $" + strconv.Itoa(len(queryParams))
+		}
+		if r.URL.Query().Get("flagged") == "true" {
+			whereClause += " AND flagged"
+		}
+		for param, op := range map[string]string{"from": ">=", "to": "<"} {
+			value := r.URL.Query().Get(param)
+			if value == "" {
+				continue
+			}
+			t, err := parseTime(value)
+			if err != nil {
+				http.Error(w, "Invalid "+param+" date", http.StatusBadRequest)
+				return
+			}
+			queryParams = append(queryParams, t)
+			whereClause += " AND occurred_at " + op + " $" + strconv.Itoa(len(queryParams))
+		}
+
+		var total int
+		err = db.QueryRow("SELECT COUNT(*) FROM door_events "+whereClause, queryParams...).Scan(&total)
+		if err != nil {
+			log.Printf("Error counting records: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		selectQuery := "SELECT " + doorEventColumns + " FROM door_events " + whereClause +
+			" ORDER BY occurred_at DESC, id DESC LIMIT $" + strconv.Itoa(len(queryParams)+1) + " OFFSET $" + strconv.Itoa(len(queryParams)+2)
+		queryParams = append(queryParams, pageSize, (page-1)*pageSize)
+
+		rows, err := db.Query(selectQuery, queryParams...)
+		if err != nil {
+			log.Printf("Error querying records: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		events := []models.DoorEvent{}
+		for rows.Next() {
+			e, err := scanDoorEvent(rows)
+			if err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			events = append(events, e)
+		}
+
+		response := struct {
+			Data       interface{} `json:"data"`
+			Total      int         `json:"total"`
+			Page       int         `json:"page"`
+			PageSize   int         `json:"pageSize"`
+			TotalPages int         `json:"totalPages"`
+		}{
+			Data:       events,
+			Total:      total,
+			Page:       page,
+			PageSize:   pageSize,
+			TotalPages: (total + pageSize - 1) / pageSize,
+		}
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("Error encoding response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+}
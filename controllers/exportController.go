@@ -0,0 +1,255 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// exportFormat picks a spreadsheet format from ?format= or the Accept header. An empty format means the
+// usual JSON page; ok is false when ?format= names something we can't produce.
+func exportFormat(r *http.Request) (format string, ok bool) {
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "":
+	case "json":
+		return "", true
+	case "csv":
+		return "csv", true
+	case "xlsx":
+		return "xlsx", true
+	default:
+		return "", false
+	}
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/csv"):
+		return "csv", true
+	case strings.Contains(accept, xlsxContentType):
+		return "xlsx", true
+	}
+	return "", true
+}
+
+// spreadsheetWriter writes a table one row at a time straight to the response
+type spreadsheetWriter interface {
+	WriteRow(cells []interface{}) error
+	Close() error
+}
+
+type csvSpreadsheet struct {
+	w *csv.Writer
+}
+
+func (c *csvSpreadsheet) WriteRow(cells []interface{}) error {
+	record := make([]string, len(cells))
+	for i, cell := range cells {
+		switch v := cell.(type) {
+		case nil:
+		case time.Time:
+			record[i] = v.Format(time.RFC3339)
+		case []byte:
+			record[i] = string(v)
+		default:
+			record[i] = fmt.Sprint(v)
+		}
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvSpreadsheet) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// xlsxSpreadsheet writes a single-sheet workbook. The sheet is the last part of the zip, so rows are
+// written out as they come with no shared strings table to build up first.
+type xlsxSpreadsheet struct {
+	zip   *zip.Writer
+	sheet *bufio.Writer
+	row   int
+}
+
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+</Relationships>`},
+}
+
+func newXLSXSpreadsheet(w io.Writer, sheetName string) (*xlsxSpreadsheet, error) {
+	x := &xlsxSpreadsheet{zip: zip.NewWriter(w)}
+	for _, part := range xlsxParts {
+		f, err := x.zip.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := x.zip.Create("xl/workbook.xml")
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprint(f, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="`)
+	xml.EscapeText(f, []byte(sheetName))
+	fmt.Fprint(f, `" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`)
+
+	f, err = x.zip.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	x.sheet = bufio.NewWriter(f)
+	_, err = x.sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return x, err
+}
+
+// xlsxColumn turns a zero-based column number into its letters: 0 is A, 26 is AA
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+func (x *xlsxSpreadsheet) WriteRow(cells []interface{}) error {
+	x.row++
+	fmt.Fprintf(x.sheet, `<row r="%d">`, x.row)
+	for i, cell := range cells {
+		ref := xlsxColumn(i) + strconv.Itoa(x.row)
+		switch v := cell.(type) {
+		case nil:
+			continue
+		case int:
+			fmt.Fprintf(x.sheet, `<c r="%s"><v>%d</v></c>`, ref, v)
+		case int64:
+			fmt.Fprintf(x.sheet, `<c r="%s"><v>%d</v></c>`, ref, v)
+		case float64:
+			fmt.Fprintf(x.sheet, `<c r="%s"><v>%s</v></c>`, ref, strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			b := 0
+			if v {
+				b = 1
+			}
+			fmt.Fprintf(x.sheet, `<c r="%s" t="b"><v>%d</v></c>`, ref, b)
+		default:
+			var s string
+			switch v := v.(type) {
+			case time.Time:
+				s = v.Format(time.RFC3339)
+			case []byte:
+				s = string(v)
+			default:
+				s = fmt.Sprint(v)
+			}
+			fmt.Fprintf(x.sheet, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+			xml.EscapeText(x.sheet, []byte(s))
+			x.sheet.WriteString(`</t></is></c>`)
+		}
+	}
+	_, err := x.sheet.WriteString(`</row>`)
+	return err
+}
+
+func (x *xlsxSpreadsheet) Close() error {
+	if _, err := x.sheet.WriteString(`</sheetData></worksheet>`); err != nil {
+		return err
+	}
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.zip.Close()
+}
+
+// writeExport writes header then every row to out, returning how many rows there were. The rows'
+// columns must line up with header.
+func writeExport(rows *sql.Rows, out spreadsheetWriter, header []string) (int, error) {
+	cells := make([]interface{}, len(header))
+	for i, h := range header {
+		cells[i] = h
+	}
+	if err := out.WriteRow(cells); err != nil {
+		return 0, err
+	}
+
+	values := make([]interface{}, len(header))
+	targets := make([]interface{}, len(header))
+	for i := range values {
+		targets[i] = &values[i]
+	}
+	count := 0
+	for rows.Next() {
+		if err := rows.Scan(targets...); err != nil {
+			return count, err
+		}
+		if err := out.WriteRow(values); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
+
+// exportQuery streams every row of the query to the response as a CSV or XLSX download named after
+// name, with header as the first row. The query's columns must line up with header.
+func exportQuery(db *sql.DB, w http.ResponseWriter, format, name string, header []string, query string, args ...interface{}) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying records: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	filename := fmt.Sprintf("%s-%s.%s", name, time.Now().Format("2006-01-02"), format)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	var out spreadsheetWriter
+	if format == "xlsx" {
+		w.Header().Set("Content-Type", xlsxContentType)
+		out, err = newXLSXSpreadsheet(w, name)
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		out = &csvSpreadsheet{w: csv.NewWriter(w)}
+	}
+	// Once rows have been sent the status can't change, so from here failures can only be logged
+	// and the download left short
+	if err == nil {
+		_, err = writeExport(rows, out, header)
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		log.Printf("Error exporting %s: %v", name, err)
+	}
+}
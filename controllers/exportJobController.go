@@ -0,0 +1,539 @@
+package controllers
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-app-be/models"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// exportRetention is how long a finished export's file is kept before cleanup removes it
+const exportRetention = 24 * time.Hour
+
+// exportLinkTTL is how long a signed download link works for. Polling the job hands out a fresh one.
+const exportLinkTTL = 15 * time.Minute
+
+// exportJobTimeout is how long a job can run before it's assumed lost, e.g. to a restart
+const exportJobTimeout = time.Hour
+
+// exportDataset is something an export job can produce. Fields name the values in JSON Lines and Headers
+// title the columns in CSV and PDF; both line up with the query's columns. Ranged queries take the job's
+// from and to, either of which can be NULL, as $1 and $2.
+type exportDataset struct {
+	Title   string
+	Fields  []string
+	Headers []string
+	Ranged  bool
+	Query   string
+}
+
+var exportDatasets = map[string]exportDataset{
+	"inventory": {
+		Title:   "Key copy inventory",
+		Fields:  []string{"key_copy_id", "serial", "key_id", "key_name", "staff_id", "staff_name", "witness_staff_id", "status", "expires_at", "expired"},
+		Headers: []string{"Copy ID", "Serial", "Key ID", "Key Name", "Staff ID", "Staff Name", "Witness ID", "Status", "Expires At", "Expired"},
+		Query: `
+			SELECT kc.id, COALESCE(kc.serial, ''), kc.key_id, COALESCE(k.name, ''), kc.staff_id, COALESCE(s.name, ''),
+				kc.witness_staff_id, kc.status, kc.expires_at, kc.expired
+			FROM key_copies kc
+			LEFT JOIN keys k ON k.id = kc.key_id
+			LEFT JOIN staffs s ON s.id = kc.staff_id
+			ORDER BY kc.id`,
+	},
+	"history": {
+		Title: "Key copy history",
+		Fields: []string{"id", "created_at", "key_copy_id", "serial", "key_id", "key_name", "action",
+			"previous_staff_id", "previous_staff_name", "staff_id", "staff_name", "performed_by", "performed_by_name", "note"},
+		Headers: []string{"ID", "Time", "Copy ID", "Serial", "Key ID", "Key Name", "Action",
+			"Previous ID", "Previous Holder", "Staff ID", "Holder", "By ID", "Performed By", "Note"},
+		Ranged: true,
+		Query: `
+			SELECT h.id, h.created_at, h.key_copy_id, COALESCE(kc.serial, ''), h.key_id, COALESCE(k.name, ''), h.action,
+				h.previous_staff_id, COALESCE(ps.name, ''), h.staff_id, COALESCE(s.name, ''),
+				h.performed_by, COALESCE(pb.name, ''), COALESCE(h.note, '')
+			FROM key_copy_history h
+			LEFT JOIN key_copies kc ON kc.id = h.key_copy_id
+			LEFT JOIN keys k ON k.id = h.key_id
+			LEFT JOIN staffs ps ON ps.id = h.previous_staff_id
+			LEFT JOIN staffs s ON s.id = h.staff_id
+			LEFT JOIN staffs pb ON pb.id = h.performed_by
+			WHERE ($1::timestamptz IS NULL OR h.created_at >= $1) AND ($2::timestamptz IS NULL OR h.created_at < $2)
+			ORDER BY h.id`,
+	},
+}
+
+var exportContentTypes = map[string]string{
+	"csv":   "text/csv; charset=utf-8",
+	"jsonl": "application/x-ndjson",
+	"pdf":   "application/pdf",
+}
+
+// jsonlSpreadsheet writes one JSON object per row, keyed by the first row written
+type jsonlSpreadsheet struct {
+	w      *bufio.Writer
+	fields []string
+}
+
+func (j *jsonlSpreadsheet) WriteRow(cells []interface{}) error {
+	if j.fields == nil {
+		for _, cell := range cells {
+			j.fields = append(j.fields, fmt.Sprint(cell))
+		}
+		return nil
+	}
+
+	j.w.WriteByte('{')
+	for i, cell := range cells {
+		if b, ok := cell.([]byte); ok {
+			cell = string(b)
+		}
+		key, _ := json.Marshal(j.fields[i])
+		value, err := json.Marshal(cell)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			j.w.WriteByte(',')
+		}
+		j.w.Write(key)
+		j.w.WriteByte(':')
+		j.w.Write(value)
+	}
+	_, err := j.w.WriteString("}\n")
+	return err
+}
+
+func (j *jsonlSpreadsheet) Close() error {
+	return j.w.Flush()
+}
+
+// pdfReport lays rows out as a table on landscape pages, repeating the first row as the header on every
+// page. fpdf builds the whole document in memory, so it is written out on Close.
+type pdfReport struct {
+	w   io.Writer
+	doc *reportPDF
+}
+
+func newPDFReport(w io.Writer, title string) *pdfReport {
+	return &pdfReport{w: w, doc: newReportPDF("L", title)}
+}
+
+func (p *pdfReport) WriteRow(cells []interface{}) error {
+	text := make([]string, len(cells))
+	for i, cell := range cells {
+		text[i] = reportText(cell)
+	}
+
+	if p.doc.header == nil {
+		weights := make([]float64, len(cells))
+		for i := range weights {
+			weights[i] = 1
+		}
+		p.doc.AddPage()
+		p.doc.startTable(text, p.doc.columns(weights...))
+		return nil
+	}
+	p.doc.row(text...)
+	return p.doc.Error()
+}
+
+func (p *pdfReport) Close() error {
+	return p.doc.Output(p.w)
+}
+
+// exportDir is where finished exports are kept, EXPORT_DIR or a directory under the system temp dir
+func exportDir() (string, error) {
+	dir := os.Getenv("EXPORT_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "key-exports")
+	}
+	return dir, os.MkdirAll(dir, 0o700)
+}
+
+// exportLink is what a download URL signs
+type exportLink struct {
+	ExportID int   `json:"export_id"`
+	Expires  int64 `json:"expires"`
+}
+
+// exportSigningKey is EXPORT_SIGNING_KEY, or REPORT_SIGNING_KEY when that isn't set
+func exportSigningKey() string {
+	if key := os.Getenv("EXPORT_SIGNING_KEY"); key != "" {
+		return key
+	}
+	return os.Getenv("REPORT_SIGNING_KEY")
+}
+
+// signExportLink signs a download link with the export signing key. The signed message starts with
+// a prefix no report has, so a report signature never works as a link.
+func signExportLink(link exportLink) (string, error) {
+	key := exportSigningKey()
+	if key == "" {
+		return "", errors.New("EXPORT_SIGNING_KEY is not set")
+	}
+
+	data, err := json.Marshal(link)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("export-link:"))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// downloadURL returns a link to a completed job's file that works until expires
+func downloadURL(id int, expires time.Time) (string, error) {
+	signature, err := signExportLink(exportLink{ExportID: id, Expires: expires.Unix()})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("/exports/%d/download?expires=%d&signature=%s", id, expires.Unix(), signature), nil
+}
+
+const exportJobColumns = `id, dataset, format, from_time, to_time, COALESCE(requested_by, 0), status, row_count,
+	COALESCE(error, ''), created_at, started_at, completed_at, expires_at`
+
+func scanExportJob(row rowScanner) (models.ExportJob, error) {
+	var j models.ExportJob
+	err := row.Scan(&j.ID, &j.Dataset, &j.Format, &j.From, &j.To, &j.RequestedBy, &j.Status, &j.Rows,
+		&j.Error, &j.CreatedAt, &j.StartedAt, &j.CompletedAt, &j.ExpiresAt)
+	return j, err
+}
+
+// writeExportFile runs a job's query into its file, writing to a temporary name first so a
+// half-written file is never downloadable
+func writeExportFile(db *sql.DB, job models.ExportJob) (string, int, error) {
+	dataset := exportDatasets[job.Dataset]
+	var args []interface{}
+	if dataset.Ranged {
+		args = append(args, job.From, job.To)
+	}
+
+	dir, err := exportDir()
+	if err != nil {
+		return "", 0, err
+	}
+	name := fmt.Sprintf("export-%d.%s", job.ID, job.Format)
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(path + ".tmp")
+	defer f.Close()
+
+	rows, err := db.Query(dataset.Query, args...)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rows.Close()
+
+	var out spreadsheetWriter
+	header := dataset.Headers
+	switch job.Format {
+	case "jsonl":
+		out = &jsonlSpreadsheet{w: bufio.NewWriter(f)}
+		header = dataset.Fields
+	case "pdf":
+		out = newPDFReport(f, dataset.Title)
+	default:
+		out = &csvSpreadsheet{w: csv.NewWriter(f)}
+	}
+
+	count, err := writeExport(rows, out, header)
+	if err == nil {
+		err = out.Close()
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	return name, count, err
+}
+
+// ProcessExportJobs runs pending export jobs one at a time until there are none left. Jobs are claimed
+// with SKIP LOCKED so the background runner and a newly created job can't both pick up the same one.
+func ProcessExportJobs(db *sql.DB) error {
+	for {
+		job, err := scanExportJob(db.QueryRow(`
+			UPDATE export_jobs SET status = 'running', started_at = NOW()
+			WHERE id = (
+				SELECT id FROM export_jobs WHERE status = 'pending' ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED
+			)
+			RETURNING ` + exportJobColumns))
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name, count, err := writeExportFile(db, job)
+		if err != nil {
+			log.Printf("Error running export job %d: %v", job.ID, err)
+			_, err = db.Exec(`
+				UPDATE export_jobs SET status = 'failed', error = $2, completed_at = NOW(), expires_at = $3
+				WHERE id = $1`, job.ID, err.Error(), time.Now().Add(exportRetention))
+		} else {
+			_, err = db.Exec(`
+				UPDATE export_jobs SET status = 'completed', file_name = $2, row_count = $3, completed_at = NOW(), expires_at = $4
+				WHERE id = $1`, job.ID, name, count, time.Now().Add(exportRetention))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// CleanupExports removes the files of exports past their expiry and fails jobs that have been running
+// too long to still be alive
+func CleanupExports(db *sql.DB) error {
+	_, err := db.Exec(`
+		UPDATE export_jobs SET status = 'failed', error = 'Export did not finish', completed_at = NOW(), expires_at = NOW()
+		WHERE status = 'running' AND started_at < $1`, time.Now().Add(-exportJobTimeout))
+	if err != nil {
+		return err
+	}
+
+	dir, err := exportDir()
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query(`
+		UPDATE export_jobs e SET status = 'expired', file_name = NULL
+		FROM (
+			SELECT id, file_name FROM export_jobs
+			WHERE status IN ('completed', 'failed') AND expires_at < NOW()
+			FOR UPDATE
+		) old
+		WHERE e.id = old.id
+		RETURNING COALESCE(old.file_name, '')`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var errs []error
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+type exportJobRequest struct {
+	Dataset     string     `json:"dataset"`
+	Format      string     `json:"format"`
+	From        *time.Time `json:"from"`
+	To          *time.Time `json:"to"`
+	RequestedBy int        `json:"requested_by"`
+}
+
+// Start an export job for a dataset (inventory or history) as CSV, JSON Lines or a PDF report. The job
+// runs in the background; poll it for its status and a download link.
+func CreateExportJob(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req exportJobRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		// Finished exports are downloaded through signed links, so refuse jobs nobody could fetch
+		if exportSigningKey() == "" {
+			http.Error(w, "Export links can't be signed: EXPORT_SIGNING_KEY is not configured", http.StatusServiceUnavailable)
+			return
+		}
+
+		dataset, ok := exportDatasets[req.Dataset]
+		if !ok {
+			http.Error(w, "dataset must be inventory or history", http.StatusBadRequest)
+			return
+		}
+		if _, ok := exportContentTypes[req.Format]; !ok {
+			http.Error(w, "format must be csv, jsonl or pdf", http.StatusBadRequest)
+			return
+		}
+		if !dataset.Ranged && (req.From != nil || req.To != nil) {
+			http.Error(w, "from and to only apply to the history dataset", http.StatusBadRequest)
+			return
+		}
+		if req.From != nil && req.To != nil && !req.From.Before(*req.To) {
+			http.Error(w, "from must be before to", http.StatusBadRequest)
+			return
+		}
+
+		job, err := scanExportJob(db.QueryRow(`
+			INSERT INTO export_jobs (dataset, format, from_time, to_time, requested_by)
+			VALUES ($1, $2, $3, $4, NULLIF($5, 0))
+			RETURNING `+exportJobColumns, req.Dataset, req.Format, req.From, req.To, req.RequestedBy))
+		if err != nil {
+			log.Printf("Error creating export job: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if err := recordAudit(db, models.AuditLog{
+			Action:      "export",
+			PerformedBy: req.RequestedBy,
+			Entity:      "export_job",
+			EntityID:    job.ID,
+			Details:     fmt.Sprintf("Requested %s export of %s", req.Format, req.Dataset),
+		}); err != nil {
+			log.Printf("Error recording audit log: %v", err)
+		}
+
+		go func() {
+			if err := ProcessExportJobs(db); err != nil {
+				log.Printf("Error running export jobs: %v", err)
+			}
+		}()
+
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+	}
+}
+
+// Get an export job's status, with a fresh signed download link once it has completed
+func GetExportJob(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		job, err := scanExportJob(db.QueryRow("SELECT "+exportJobColumns+" FROM export_jobs WHERE id = $1", id))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Export job not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving export job: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if job.Status == "completed" {
+			expires := time.Now().Add(exportLinkTTL)
+			if job.ExpiresAt != nil && job.ExpiresAt.Before(expires) {
+				expires = *job.ExpiresAt
+			}
+			job.DownloadURL, err = downloadURL(job.ID, expires)
+			if err != nil {
+				log.Printf("Error signing download link: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		json.NewEncoder(w).Encode(job)
+	}
+}
+
+// Download a completed export through a signed link from GetExportJob
+func DownloadExport(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Invalid export job ID", http.StatusBadRequest)
+			return
+		}
+
+		query := r.URL.Query()
+		expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid or expired download link", http.StatusForbidden)
+			return
+		}
+		expected, err := signExportLink(exportLink{ExportID: id, Expires: expires})
+		if err != nil {
+			log.Printf("Error signing download link: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !hmac.Equal([]byte(expected), []byte(query.Get("signature"))) || time.Now().Unix() > expires {
+			http.Error(w, "Invalid or expired download link", http.StatusForbidden)
+			return
+		}
+
+		var job models.ExportJob
+		var name string
+		err = db.QueryRow(`SELECT dataset, format, status, COALESCE(file_name, '') FROM export_jobs WHERE id = $1`, id).
+			Scan(&job.Dataset, &job.Format, &job.Status, &name)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Export job not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving export job: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+		if job.Status == "expired" {
+			http.Error(w, "Export has expired", http.StatusGone)
+			return
+		}
+		if job.Status != "completed" {
+			http.Error(w, "Export is not ready", http.StatusConflict)
+			return
+		}
+
+		dir, err := exportDir()
+		if err != nil {
+			log.Printf("Error opening export directory: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				http.Error(w, "Export has expired", http.StatusGone)
+			} else {
+				log.Printf("Error opening export file: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			log.Printf("Error opening export file: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		filename := fmt.Sprintf("%s-%d.%s", job.Dataset, id, job.Format)
+		w.Header().Set("Content-Type", exportContentTypes[job.Format])
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		http.ServeContent(w, r, filename, info.ModTime(), f)
+	}
+}
@@ -0,0 +1,299 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"go-app-be/models"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// HeldCopy is a key copy and who held it at some point in time
+type HeldCopy struct {
+	KeyCopyID  int       `json:"key_copy_id"`
+	KeyID      int       `json:"key_id"`
+	KeyName    string    `json:"key_name"`
+	Serial     string    `json:"serial"`
+	StaffID    int       `json:"staff_id"`
+	StaffName  string    `json:"staff_name"`
+	LastAction string    `json:"last_action"`
+	Since      time.Time `json:"since"`
+}
+
+// copiesHeldAt works out from the change history which copies were held, and by whom, at the given time,
+// filtered on the key or the staff member. Each copy's latest history entry at that time says who held it
+// afterwards and since when.
+func copiesHeldAt(q queryer, column string, id int, at time.Time) ([]HeldCopy, error) {
+	rows, err := q.Query(`
+		SELECT latest.key_copy_id, latest.key_id, COALESCE(k.name, ''), COALESCE(kc.serial, ''),
+			latest.staff_id, COALESCE(s.name, ''), latest.action, latest.created_at
+		FROM (
+			SELECT DISTINCT ON (key_copy_id) key_copy_id, COALESCE(key_id, 0) AS key_id, COALESCE(staff_id, 0) AS staff_id, action, created_at
+			FROM key_copy_history
+			WHERE created_at <= $2
+			ORDER BY key_copy_id, created_at DESC, id DESC
+		) latest
+		LEFT JOIN key_copies kc ON kc.id = latest.key_copy_id
+		LEFT JOIN keys k ON k.id = latest.key_id
+		LEFT JOIN staffs s ON s.id = latest.staff_id
+		WHERE latest.`+column+` = $1 AND latest.staff_id <> 0 AND latest.action <> 'deleted'
+		ORDER BY latest.key_id, latest.key_copy_id`, id, at)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	held := []HeldCopy{}
+	for rows.Next() {
+		var h HeldCopy
+		if err := rows.Scan(&h.KeyCopyID, &h.KeyID, &h.KeyName, &h.Serial, &h.StaffID, &h.StaffName, &h.LastAction, &h.Since); err != nil {
+			return nil, err
+		}
+		held = append(held, h)
+	}
+	return held, rows.Err()
+}
+
+// holdersAt lists who held copies of the key at the given time
+func holdersAt(q queryer, keyID int, at time.Time) ([]HeldCopy, error) {
+	return copiesHeldAt(q, "key_id", keyID, at)
+}
+
+// existsOrHasHistory reports whether the entity exists, or did and still has change history worth asking about
+func existsOrHasHistory(q queryer, table, column string, id int) (bool, error) {
+	var exists bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM "+table+" WHERE id = $1)", id).Scan(&exists)
+	if err != nil || exists {
+		return exists, err
+	}
+	err = q.QueryRow("SELECT EXISTS(SELECT 1 FROM key_copy_history WHERE "+column+" = $1)", id).Scan(&exists)
+	return exists, err
+}
+
+// pointInTime answers a holder query for the entity in the route at the time in the "at" parameter, now by default
+func pointInTime(db *sql.DB, w http.ResponseWriter, r *http.Request, table, notFound, column string) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, notFound, http.StatusNotFound)
+		return
+	}
+
+	at := time.Now()
+	if value := r.URL.Query().Get("at"); value != "" {
+		if at, err = parseTime(value); err != nil {
+			http.Error(w, "Invalid at time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	exists, err := existsOrHasHistory(db, table, column, id)
+	if err != nil {
+		log.Printf("Error checking existence: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, notFound, http.StatusNotFound)
+		return
+	}
+
+	held, err := copiesHeldAt(db, column, id, at)
+	if err != nil {
+		log.Printf("Error querying holders: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		At     time.Time  `json:"at"`
+		Copies []HeldCopy `json:"copies"`
+	}{
+		At:     at,
+		Copies: held,
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// Get who held copies of a key at a point in time
+func GetKeyHolders(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pointInTime(db, w, r, "keys", "Key not found", "key_id")
+	}
+}
+
+// Get the key copies a staff member held at a point in time
+func GetStaffKeys(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pointInTime(db, w, r, "staffs", "Staff not found", "staff_id")
+	}
+}
+
+// TimelineEntry is a key copy history entry with the names support needs to read it
+type TimelineEntry struct {
+	models.KeyCopyHistory
+	KeyName           string `json:"key_name"`
+	Serial            string `json:"serial"`
+	StaffName         string `json:"staff_name"`
+	PreviousStaffName string `json:"previous_staff_name"`
+	PerformedByName   string `json:"performed_by_name"`
+}
+
+// historyFeed writes a page of the change history matching the condition on $1, oldest first unless order=desc.
+// An action filter and a from/to date range are optional.
+func historyFeed(db *sql.DB, w http.ResponseWriter, r *http.Request, condition string, id int) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page <= 0 {
+		page = 1
+	}
+
+	pageSize, err := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	if err != nil || pageSize <= 0 {
+		pageSize = 20
+	}
+
+	whereClause := "WHERE " + condition
+	queryParams := []interface{}{id}
+
+	if action := r.URL.Query().Get("action"); action != "" {
+		queryParams = append(queryParams, action)
+		whereClause += " AND h.action = $" + strconv.Itoa(len(queryParams))
+	}
+	for _, bound := range []struct{ param, op string }{{"from", ">="}, {"to", "<"}} {
+		value := r.URL.Query().Get(bound.param)
+		if value == "" {
+			continue
+		}
+		t, err := parseTime(value)
+		if err != nil {
+			http.Error(w, "Invalid "+bound.param+" date", http.StatusBadRequest)
+			return
+		}
+		queryParams = append(queryParams, t)
+		whereClause += " AND h.created_at " + bound.op + " $" + strconv.Itoa(len(queryParams))
+	}
+
+	order := "ASC"
+	if r.URL.Query().Get("order") == "desc" {
+		order = "DESC"
+	}
+
+	var total int
+	err = db.QueryRow("SELECT COUNT(*) FROM key_copy_history h "+whereClause, queryParams...).Scan(&total)
+	if err != nil {
+		log.Printf("Error counting records: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	selectQuery := `
+		SELECT h.id, h.key_copy_id, COALESCE(h.key_id, 0), h.action, COALESCE(h.previous_staff_id, 0), COALESCE(h.staff_id, 0),
+			COALESCE(h.performed_by, 0), COALESCE(h.note, ''), h.created_at,
+			COALESCE(k.name, ''), COALESCE(kc.serial, ''), COALESCE(s.name, ''), COALESCE(ps.name, ''), COALESCE(pb.name, '')
+		FROM key_copy_history h
+		LEFT JOIN keys k ON k.id = h.key_id
+		LEFT JOIN key_copies kc ON kc.id = h.key_copy_id
+		LEFT JOIN staffs s ON s.id = h.staff_id
+		LEFT JOIN staffs ps ON ps.id = h.previous_staff_id
+		LEFT JOIN staffs pb ON pb.id = h.performed_by
+		` + whereClause + `
+		ORDER BY h.created_at ` + order + `, h.id ` + order + `
+		LIMIT $` + strconv.Itoa(len(queryParams)+1) + ` OFFSET $` + strconv.Itoa(len(queryParams)+2)
+	queryParams = append(queryParams, pageSize, (page-1)*pageSize)
+
+	rows, err := db.Query(selectQuery, queryParams...)
+	if err != nil {
+		log.Printf("Error querying records: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []TimelineEntry{}
+	for rows.Next() {
+		var e TimelineEntry
+		if err := rows.Scan(&e.ID, &e.KeyCopyID, &e.KeyID, &e.Action, &e.PreviousStaffID, &e.StaffID,
+			&e.PerformedBy, &e.Note, &e.CreatedAt,
+			&e.KeyName, &e.Serial, &e.StaffName, &e.PreviousStaffName, &e.PerformedByName); err != nil {
+			log.Printf("Error scanning row: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, e)
+	}
+
+	response := struct {
+		Data       interface{} `json:"data"`
+		Total      int         `json:"total"`
+		Page       int         `json:"page"`
+		PageSize   int         `json:"pageSize"`
+		TotalPages int         `json:"totalPages"`
+	}{
+		Data:       entries,
+		Total:      total,
+		Page:       page,
+		PageSize:   pageSize,
+		TotalPages: (total + pageSize - 1) / pageSize,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// Get the change history of a key copy: issues, returns, transfers, status changes and edits
+func GetKeyCopyHistory(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Key copy not found", http.StatusNotFound)
+			return
+		}
+
+		exists, err := existsOrHasHistory(db, "key_copies", "key_copy_id", id)
+		if err != nil {
+			log.Printf("Error checking key copy existence: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Key copy not found", http.StatusNotFound)
+			return
+		}
+
+		historyFeed(db, w, r, "h.key_copy_id = $1", id)
+	}
+}
+
+// Get everything a staff member was part of in the change history, as holder before or after a change or as the one making it
+func GetStaffTimeline(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Staff not found", http.StatusNotFound)
+			return
+		}
+
+		exists, err := existsOrHasHistory(db, "staffs", "staff_id", id)
+		if err != nil {
+			log.Printf("Error checking staff existence: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Staff not found", http.StatusNotFound)
+			return
+		}
+
+		historyFeed(db, w, r, "(h.staff_id = $1 OR h.previous_staff_id = $1 OR h.performed_by = $1)", id)
+	}
+}
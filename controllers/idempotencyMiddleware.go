@@ -0,0 +1,199 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// idempotencyKeyTTL is how long a response is kept for replay to retries with the same Idempotency-Key
+const idempotencyKeyTTL = 24 * time.Hour
+
+// idempotencyLockTimeout is how long a request can hold its key before it's assumed to have died with
+// the server and a retry may run it again
+const idempotencyLockTimeout = 5 * time.Minute
+
+const idempotencyKeyMaxLength = 255
+
+// idempotencyMaxBodyBytes is the largest body a request with an Idempotency-Key may have, since the body is
+// read into memory to fingerprint it
+const idempotencyMaxBodyBytes = 10 << 20
+
+// recordingResponseWriter passes a response through to the client while keeping a copy of it
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (rw *recordingResponseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+		rw.header = rw.ResponseWriter.Header().Clone()
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// claimIdempotencyKey takes the key for a request with the given fingerprint. If it can't be taken, the
+// stored response (or the reason there isn't one yet) is written to w and claimed is false.
+func claimIdempotencyKey(db *sql.DB, w http.ResponseWriter, key, fingerprint string) (claimed bool, err error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		var inserted string
+		err = db.QueryRow(`
+			INSERT INTO idempotency_keys (key, fingerprint, expires_at) VALUES ($1, $2, $3)
+			ON CONFLICT (key) DO NOTHING
+			RETURNING key`, key, fingerprint, time.Now().Add(idempotencyKeyTTL)).Scan(&inserted)
+		if err == nil {
+			return true, nil
+		}
+		if err != sql.ErrNoRows {
+			return false, err
+		}
+
+		var storedFingerprint string
+		var status *int
+		var headers []byte
+		var body []byte
+		var createdAt, expiresAt time.Time
+		err = db.QueryRow(`
+			SELECT fingerprint, status, COALESCE(headers, '{}'), COALESCE(body, ''), created_at, expires_at
+			FROM idempotency_keys WHERE key = $1`, key,
+		).Scan(&storedFingerprint, &status, &headers, &body, &createdAt, &expiresAt)
+		if err == sql.ErrNoRows {
+			// Cleaned up or released since the insert, so try again
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		// A key past its expiry, or held by a request that never finished, is free to use again
+		if time.Now().After(expiresAt) || (status == nil && time.Since(createdAt) > idempotencyLockTimeout) {
+			_, err = db.Exec(`DELETE FROM idempotency_keys WHERE key = $1 AND created_at = $2`, key, createdAt)
+			if err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		switch {
+		case storedFingerprint != fingerprint:
+			http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+		case status == nil:
+			http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+		default:
+			var stored http.Header
+			if err := json.Unmarshal(headers, &stored); err != nil {
+				return false, err
+			}
+			for name, values := range stored {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(*status)
+			w.Write(body)
+		}
+		return false, nil
+	}
+	http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+	return false, nil
+}
+
+// IdempotencyMiddleware lets clients retry POST requests safely. A request with an Idempotency-Key header
+// runs once; retries with the same key and the same method, URL and body get the first response again,
+// marked with Idempotent-Replayed, and reusing the key for a different request is refused. Server errors
+// aren't kept, so a retry after one runs the request again.
+func IdempotencyMiddleware(db *sql.DB) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			if r.Method != http.MethodPost || key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > idempotencyKeyMaxLength {
+				http.Error(w, "Idempotency-Key can be at most "+strconv.Itoa(idempotencyKeyMaxLength)+" characters", http.StatusBadRequest)
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, idempotencyMaxBodyBytes))
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Request body is too large to use with an Idempotency-Key", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			hash := sha256.New()
+			io.WriteString(hash, r.Method+" "+r.URL.RequestURI()+"\n"+r.Header.Get("Content-Type")+"\n")
+			hash.Write(body)
+			fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+			claimed, err := claimIdempotencyKey(db, w, key, fingerprint)
+			if err != nil {
+				log.Printf("Error checking idempotency key: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if !claimed {
+				return
+			}
+
+			// A handler that panics mustn't leave the key held until idempotencyLockTimeout
+			defer func() {
+				if p := recover(); p != nil {
+					if _, err := db.Exec("DELETE FROM idempotency_keys WHERE key = $1", key); err != nil {
+						log.Printf("Error releasing idempotency key: %v", err)
+					}
+					panic(p)
+				}
+			}()
+
+			rw := &recordingResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(rw, r)
+			if rw.status == 0 {
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			if rw.status >= http.StatusInternalServerError {
+				_, err = db.Exec("DELETE FROM idempotency_keys WHERE key = $1", key)
+			} else {
+				headers, _ := json.Marshal(rw.header)
+				_, err = db.Exec(`UPDATE idempotency_keys SET status = $2, headers = $3, body = $4 WHERE key = $1`,
+					key, rw.status, string(headers), rw.body.Bytes())
+			}
+			if err != nil {
+				log.Printf("Error saving idempotency key: %v", err)
+			}
+		})
+	}
+}
+
+// ExpireIdempotencyKeys forgets responses older than idempotencyKeyTTL
+func ExpireIdempotencyKeys(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM idempotency_keys WHERE expires_at < NOW()")
+	return err
+}
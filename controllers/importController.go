@@ -0,0 +1,500 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"go-app-be/models"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// isUniqueViolation reports whether err is Postgres refusing a duplicate value for a unique column
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+// importColumns maps the header names a spreadsheet is likely to use onto the fields of each import.
+// Every field also matches its own name.
+var importColumns = map[string]map[string]string{
+	"keys": {
+		"key":        "name",
+		"key_name":   "name",
+		"desc":       "description",
+		"notes":      "description",
+		"staff":      "custodian",
+		"staff_id":   "custodian",
+		"owner":      "custodian",
+		"clearance":  "clearance_level",
+		"reference":  "external_id",
+		"ref":        "external_id",
+		"key_code":   "external_id",
+		"dual":       "dual_control",
+		"two_person": "dual_control",
+	},
+	"key-copies": {
+		"key_id":          "key",
+		"key_name":        "key",
+		"key_external_id": "key",
+		"serial_number":   "serial",
+		"staff":           "holder",
+		"staff_id":        "holder",
+		"staff_name":      "holder",
+		"assigned_to":     "holder",
+		"expires":         "expires_at",
+		"due":             "expires_at",
+	},
+	"staffs": {
+		"staff_name":      "name",
+		"full_name":       "name",
+		"type":            "staff_type",
+		"clearance":       "clearance_level",
+		"manager_id":      "manager",
+		"manager_name":    "manager",
+		"employee_id":     "external_id",
+		"employee_number": "external_id",
+		"reference":       "external_id",
+		"ref":             "external_id",
+	},
+}
+
+// importFields are the fields each import understands; the first is required
+var importFields = map[string][]string{
+	"keys":       {"name", "description", "custodian", "clearance_level", "dual_control", "external_id"},
+	"key-copies": {"key", "serial", "holder", "expires_at"},
+	"staffs":     {"name", "role", "staff_type", "valid_from", "valid_until", "clearance_level", "manager", "external_id"},
+}
+
+type ImportResult struct {
+	Entity  string           `json:"entity"`
+	DryRun  bool             `json:"dry_run"`
+	Rows    int              `json:"rows"`
+	Created int              `json:"created"`
+	IDs     []int            `json:"ids"`
+	Errors  []importRowError `json:"errors"`
+}
+
+// importRow is one data row with its values looked up by field name
+type importRow struct {
+	line    int
+	record  []string
+	columns map[string]int
+}
+
+func (r importRow) get(field string) string {
+	if i, ok := r.columns[field]; ok && i < len(r.record) {
+		return strings.TrimSpace(r.record[i])
+	}
+	return ""
+}
+
+func normaliseImportHeader(name string) string {
+	name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+	return strings.Join(strings.FieldsFunc(name, func(r rune) bool { return r == ' ' || r == '-' || r == '_' }), "_")
+}
+
+// importHeader works out which column holds each field, from the caller's mapping of header names to
+// fields first and the usual aliases second
+func importHeader(entity string, header []string, mapping map[string]string) (map[string]int, error) {
+	known := map[string]bool{}
+	for _, f := range importFields[entity] {
+		known[f] = true
+	}
+	userMapping := map[string]string{}
+	for from, to := range mapping {
+		if !known[to] {
+			return nil, fmt.Errorf("mapping refers to unknown field %q, expected one of %s", to, strings.Join(importFields[entity], ", "))
+		}
+		userMapping[normaliseImportHeader(from)] = to
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		name = normaliseImportHeader(name)
+		field, ok := userMapping[name]
+		if !ok {
+			field, ok = importColumns[entity][name]
+		}
+		if !ok && known[name] {
+			field, ok = name, true
+		}
+		if !ok {
+			continue
+		}
+		if _, taken := columns[field]; taken {
+			return nil, fmt.Errorf("more than one column maps to %s", field)
+		}
+		columns[field] = i
+	}
+
+	required := importFields[entity][0]
+	if _, ok := columns[required]; !ok {
+		return nil, fmt.Errorf("missing %s column", required)
+	}
+	return columns, nil
+}
+
+// resolveImportReference finds the row of keys or staffs a value refers to, by external ID, then by exact
+// name, then by ID. A message is returned when it refers to none or several.
+func resolveImportReference(q queryer, table, value string) (int, string, error) {
+	var id int
+	err := q.QueryRow("SELECT id FROM "+table+" WHERE external_id = $1", value).Scan(&id)
+	if err != sql.ErrNoRows {
+		return id, "", err
+	}
+
+	var matches int
+	err = q.QueryRow("SELECT COUNT(*), COALESCE(MIN(id), 0) FROM "+table+" WHERE LOWER(name) = LOWER($1)", value).Scan(&matches, &id)
+	if err != nil || matches == 1 {
+		return id, "", err
+	}
+	if matches > 1 {
+		return 0, fmt.Sprintf("%q matches %d %s by name, use the ID or external ID", value, matches, table), nil
+	}
+
+	n, convErr := strconv.Atoi(value)
+	if convErr == nil {
+		err = q.QueryRow("SELECT id FROM "+table+" WHERE id = $1", n).Scan(&id)
+		if err != sql.ErrNoRows {
+			return id, "", err
+		}
+	}
+	return 0, fmt.Sprintf("%q does not match any %s", value, table), nil
+}
+
+func parseImportBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "", "false", "no", "n", "0":
+		return false, nil
+	case "true", "yes", "y", "1":
+		return true, nil
+	}
+	return false, fmt.Errorf("%q is not yes or no", value)
+}
+
+func parseImportInt(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func parseImportTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := parseTime(value)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a date", value)
+	}
+	return &t, nil
+}
+
+// externalIDTaken checks a new row's external ID against the table, which includes rows created earlier in the import
+func externalIDTaken(q queryer, table, externalID string) (bool, error) {
+	if externalID == "" {
+		return false, nil
+	}
+	var exists bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM "+table+" WHERE external_id = $1)", externalID).Scan(&exists)
+	return exists, err
+}
+
+// importKey creates a key from a row, returning its ID or a message saying what is wrong with the row
+func importKey(tx *sql.Tx, row importRow) (int, string, error) {
+	k := models.Key{Name: row.get("name"), Description: row.get("description"), ExternalID: row.get("external_id")}
+	if k.Name == "" {
+		return 0, "name is required", nil
+	}
+
+	var err error
+	if k.ClearanceLevel, err = parseImportInt(row.get("clearance_level")); err != nil || k.ClearanceLevel < 0 {
+		return 0, "clearance_level must be a whole number of at least 0", nil
+	}
+	if k.DualControl, err = parseImportBool(row.get("dual_control")); err != nil {
+		return 0, "dual_control: " + err.Error(), nil
+	}
+	if custodian := row.get("custodian"); custodian != "" {
+		id, msg, err := resolveImportReference(tx, "staffs", custodian)
+		if err != nil || msg != "" {
+			return 0, "custodian: " + msg, err
+		}
+		k.StaffID = id
+	}
+
+	taken, err := externalIDTaken(tx, "keys", k.ExternalID)
+	if err != nil {
+		return 0, "", err
+	}
+	if taken {
+		return 0, fmt.Sprintf("external_id %q is already in use", k.ExternalID), nil
+	}
+
+	err = tx.QueryRow(
+		"INSERT INTO keys (name, description, staff_id, clearance_level, dual_control, external_id) VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')) RETURNING id",
+		k.Name, k.Description, k.StaffID, k.ClearanceLevel, k.DualControl, k.ExternalID,
+	).Scan(&k.ID)
+	return k.ID, "", err
+}
+
+// importKeyCopy creates a key copy from a row, with the same checks as assigning it through the API
+func importKeyCopy(tx *sql.Tx, row importRow) (int, string, error) {
+	var k models.KeyCopy
+	if row.get("key") == "" {
+		return 0, "key is required", nil
+	}
+	id, msg, err := resolveImportReference(tx, "keys", row.get("key"))
+	if err != nil || msg != "" {
+		return 0, "key: " + msg, err
+	}
+	k.KeyID = id
+
+	if k.ExpiresAt, err = parseImportTime(row.get("expires_at")); err != nil {
+		return 0, "expires_at: " + err.Error(), nil
+	}
+
+	if holder := row.get("holder"); holder != "" {
+		id, msg, err := resolveImportReference(tx, "staffs", holder)
+		if err != nil || msg != "" {
+			return 0, "holder: " + msg, err
+		}
+		k.StaffID = id
+
+		expiresAt, msg, err := assignmentExpiry(tx, k.StaffID, k.ExpiresAt)
+		if err != nil || msg != "" {
+			return 0, msg, err
+		}
+		k.ExpiresAt = expiresAt
+
+		dual, err := isDualControl(tx, k.KeyID)
+		if err != nil {
+			return 0, "", err
+		}
+		if dual {
+			return 0, dualControlMessage, nil
+		}
+		if _, msg, err := checkClearance(tx, k.StaffID, k.KeyID, clearanceOverride{}); err != nil || msg != "" {
+			return 0, msg, err
+		}
+	} else {
+		k.ExpiresAt = nil
+	}
+
+	if k.Serial = row.get("serial"); k.Serial != "" {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM key_copies WHERE serial = $1)", k.Serial).Scan(&exists); err != nil {
+			return 0, "", err
+		}
+		if exists {
+			return 0, fmt.Sprintf("serial %q is already in use", k.Serial), nil
+		}
+	} else if k.Serial, err = nextKeyCopySerial(tx, k.KeyID); err != nil {
+		return 0, "", err
+	}
+
+	err = tx.QueryRow(
+		"INSERT INTO key_copies (key_id, serial, staff_id, expires_at) VALUES ($1, NULLIF($2, ''), $3, $4) RETURNING id",
+		k.KeyID, k.Serial, k.StaffID, k.ExpiresAt,
+	).Scan(&k.ID)
+	if err != nil {
+		return 0, "", err
+	}
+
+	err = recordKeyCopyHistory(tx, models.KeyCopyHistory{
+		KeyCopyID: k.ID,
+		KeyID:     k.KeyID,
+		Action:    "created",
+		StaffID:   k.StaffID,
+		Note:      fmt.Sprintf("Imported from line %d", row.line),
+	})
+	return k.ID, "", err
+}
+
+// importStaff creates a staff member from a row. Managers can be staff from earlier rows of the same file.
+func importStaff(tx *sql.Tx, row importRow) (int, string, error) {
+	s := models.Staff{
+		Name:       row.get("name"),
+		Role:       row.get("role"),
+		StaffType:  strings.ToLower(row.get("staff_type")),
+		ExternalID: row.get("external_id"),
+	}
+	if s.Name == "" {
+		return 0, "name is required", nil
+	}
+
+	var err error
+	if s.ValidFrom, err = parseImportTime(row.get("valid_from")); err != nil {
+		return 0, "valid_from: " + err.Error(), nil
+	}
+	if s.ValidUntil, err = parseImportTime(row.get("valid_until")); err != nil {
+		return 0, "valid_until: " + err.Error(), nil
+	}
+	if s.ClearanceLevel, err = parseImportInt(row.get("clearance_level")); err != nil {
+		return 0, "clearance_level must be a whole number", nil
+	}
+	if msg := validateStaff(&s); msg != "" {
+		return 0, msg, nil
+	}
+	if manager := row.get("manager"); manager != "" {
+		id, msg, err := resolveImportReference(tx, "staffs", manager)
+		if err != nil || msg != "" {
+			return 0, "manager: " + msg, err
+		}
+		s.ManagerID = id
+	}
+
+	taken, err := externalIDTaken(tx, "staffs", s.ExternalID)
+	if err != nil {
+		return 0, "", err
+	}
+	if taken {
+		return 0, fmt.Sprintf("external_id %q is already in use", s.ExternalID), nil
+	}
+
+	err = tx.QueryRow(
+		"INSERT INTO staffs (name, role, staff_type, valid_from, valid_until, clearance_level, manager_id, external_id) VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, '')) RETURNING id",
+		s.Name, s.Role, s.StaffType, s.ValidFrom, s.ValidUntil, s.ClearanceLevel, nullableID(s.ManagerID), s.ExternalID,
+	).Scan(&s.ID)
+	return s.ID, "", err
+}
+
+var importers = map[string]func(*sql.Tx, importRow) (int, string, error){
+	"keys":       importKey,
+	"key-copies": importKeyCopy,
+	"staffs":     importStaff,
+}
+
+// Import keys, key copies or staff from a CSV file, sent as the body or as the "file" field of a form.
+// Columns are matched by name, with mapping (a JSON object of header name to field, as a query parameter
+// or form field) for headers we don't recognise. Keys and staff can be referred to by external ID, name
+// or ID. The whole file is imported or none of it: any row errors are reported and nothing is saved, and
+// dryRun=true checks every row the same way without saving.
+func ImportRecords(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		entity := vars["entity"]
+
+		importOne, ok := importers[entity]
+		if !ok {
+			http.Error(w, "Can only import keys, key-copies or staffs", http.StatusNotFound)
+			return
+		}
+
+		var body io.Reader = r.Body
+		mappingValue := r.URL.Query().Get("mapping")
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, "file is required", http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+			body = file
+			if value := r.FormValue("mapping"); value != "" {
+				mappingValue = value
+			}
+		}
+
+		var mapping map[string]string
+		if mappingValue != "" {
+			if err := json.Unmarshal([]byte(mappingValue), &mapping); err != nil {
+				http.Error(w, "mapping must be a JSON object of header names to fields", http.StatusBadRequest)
+				return
+			}
+		}
+
+		dryRun, err := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+		if err != nil {
+			dryRun = false
+		}
+
+		reader := csv.NewReader(body)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+
+		header, err := reader.Read()
+		if err != nil {
+			http.Error(w, "Missing header row", http.StatusBadRequest)
+			return
+		}
+		columns, err := importHeader(entity, header, mapping)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		result := ImportResult{Entity: entity, DryRun: dryRun, IDs: []int{}, Errors: []importRowError{}}
+		for line := 2; ; line++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				result.Errors = append(result.Errors, importRowError{Line: line, Message: err.Error()})
+				continue
+			}
+			if strings.TrimSpace(strings.Join(record, "")) == "" {
+				continue
+			}
+			result.Rows++
+
+			id, msg, err := importOne(tx, importRow{line: line, record: record, columns: columns})
+			if err != nil {
+				log.Printf("Error importing %s line %d: %v", entity, line, err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if msg != "" {
+				result.Errors = append(result.Errors, importRowError{Line: line, Message: msg})
+				continue
+			}
+			result.IDs = append(result.IDs, id)
+		}
+		result.Created = len(result.IDs)
+
+		if dryRun || len(result.Errors) > 0 {
+			// IDs handed out inside a transaction that is rolled back mean nothing to the caller
+			result.IDs = []int{}
+			if !dryRun {
+				result.Created = 0
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			json.NewEncoder(w).Encode(result)
+			return
+		}
+
+		err = recordAudit(tx, models.AuditLog{
+			Action:  "import",
+			Entity:  entity,
+			Details: fmt.Sprintf("Imported %d %s from CSV", result.Created, entity),
+		})
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error committing import: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(result)
+	}
+}
@@ -19,7 +19,7 @@ type PaginatedResponseKey struct {
 	TotalPages int          `json:"totalPages"`
 }
 
-// Get all keys with pagination and name filter
+// Get all keys with pagination and name filter, or all matching keys as CSV or XLSX
 func GetKeys(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -46,6 +46,23 @@ func GetKeys(db *sql.DB) http.HandlerFunc {
 			queryParams = append(queryParams, nameParam)
 		}
 
+		// Exports skip pagination and stream every matching key
+		format, ok := exportFormat(r)
+		if !ok {
+			http.Error(w, "format must be json, csv or xlsx", http.StatusBadRequest)
+			return
+		}
+		if format != "" {
+			exportQuery(db, w, format, "keys",
+				[]string{"ID", "Name", "Description", "Staff ID", "Clearance Level", "Dual Control", "External ID", "Staff Name"}, `
+				SELECT keys.id, keys.name, keys.description, keys.staff_id, keys.clearance_level, keys.dual_control, COALESCE(keys.external_id, ''), COALESCE(staffs.name, '')
+				FROM keys
+				LEFT JOIN staffs ON keys.staff_id = staffs.id
+			`+whereClause+`
+				ORDER BY keys.id`, queryParams...)
+			return
+		}
+
 		countQuery := "SELECT COUNT(*) FROM keys " + whereClause
 		var total int
 		err = db.QueryRow(countQuery, queryParams...).Scan(&total)
@@ -59,7 +76,7 @@ func GetKeys(db *sql.DB) http.HandlerFunc {
 
 		// Join with the staffs table to get the staff_name
 		selectQuery := `
-			SELECT keys.id, keys.name, keys.description, keys.staff_id, staffs.name AS staff_name
+			SELECT keys.id, keys.name, keys.description, keys.staff_id, keys.clearance_level, keys.dual_control, COALESCE(keys.external_id, ''), staffs.name AS staff_name
 			FROM keys
 			LEFT JOIN staffs ON keys.staff_id = staffs.id
 		` + whereClause + `
@@ -76,22 +93,28 @@ func GetKeys(db *sql.DB) http.HandlerFunc {
 		defer rows.Close()
 
 		var keys []struct {
-			ID          int    `json:"id"`
-			Name        string `json:"name"`
-			Description string `json:"description"`
-			StaffID     int    `json:"staff_id"`
-			StaffName   string `json:"staff_name"`
+			ID             int    `json:"id"`
+			Name           string `json:"name"`
+			Description    string `json:"description"`
+			StaffID        int    `json:"staff_id"`
+			ClearanceLevel int    `json:"clearance_level"`
+			DualControl    bool   `json:"dual_control"`
+			ExternalID     string `json:"external_id"`
+			StaffName      string `json:"staff_name"`
 		}
 
 		for rows.Next() {
 			var k struct {
-				ID          int    `json:"id"`
-				Name        string `json:"name"`
-				Description string `json:"description"`
-				StaffID     int    `json:"staff_id"`
-				StaffName   string `json:"staff_name"`
+				ID             int    `json:"id"`
+				Name           string `json:"name"`
+				Description    string `json:"description"`
+				StaffID        int    `json:"staff_id"`
+				ClearanceLevel int    `json:"clearance_level"`
+				DualControl    bool   `json:"dual_control"`
+				ExternalID     string `json:"external_id"`
+				StaffName      string `json:"staff_name"`
 			}
-			if err := rows.Scan(&k.ID, &k.Name, &k.Description, &k.StaffID, &k.StaffName); err != nil {
+			if err := rows.Scan(&k.ID, &k.Name, &k.Description, &k.StaffID, &k.ClearanceLevel, &k.DualControl, &k.ExternalID, &k.StaffName); err != nil {
 				log.Printf("Error scanning row: %v", err)
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
 				return
@@ -128,7 +151,7 @@ func GetKey(db *sql.DB) http.HandlerFunc {
 		id := vars["id"]
 
 		var k models.Key
-		err := db.QueryRow("SELECT id, name, description, staff_id FROM keys WHERE id = $1", id).Scan(&k.ID, &k.Name, &k.Description, &k.StaffID)
+		err := db.QueryRow("SELECT id, name, description, staff_id, clearance_level, dual_control, COALESCE(external_id, '') FROM keys WHERE id = $1", id).Scan(&k.ID, &k.Name, &k.Description, &k.StaffID, &k.ClearanceLevel, &k.DualControl, &k.ExternalID)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				http.Error(w, "Key not found", http.StatusNotFound)
@@ -143,6 +166,41 @@ func GetKey(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+// checkKey validates a key's fields and that its custodian exists
+func checkKey(q queryer, k models.Key) error {
+	if k.ClearanceLevel < 0 {
+		return requestError{http.StatusBadRequest, "clearance_level cannot be negative"}
+	}
+
+	// Verify staff exists if staff_id is provided
+	if k.StaffID != 0 {
+		var exists bool
+		if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM staffs WHERE id = $1)", k.StaffID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return requestError{http.StatusBadRequest, "Staff ID does not exist"}
+		}
+	}
+	return nil
+}
+
+// createKey adds a key
+func createKey(q queryer, k models.Key) (models.Key, error) {
+	if err := checkKey(q, k); err != nil {
+		return k, err
+	}
+
+	err := q.QueryRow(
+		"INSERT INTO keys (name, description, staff_id, clearance_level, dual_control, external_id) VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')) RETURNING id",
+		k.Name, k.Description, k.StaffID, k.ClearanceLevel, k.DualControl, k.ExternalID,
+	).Scan(&k.ID)
+	if isUniqueViolation(err) {
+		return k, requestError{http.StatusConflict, "external_id is already in use"}
+	}
+	return k, err
+}
+
 // Create a new key
 func CreateKey(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -152,26 +210,10 @@ func CreateKey(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Verify staff exists if staff_id is provided
-		if k.StaffID != 0 {
-			var exists bool
-			err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM staffs WHERE id = $1)", k.StaffID).Scan(&exists)
-			if err != nil {
-				log.Printf("Error checking staff existence: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
-			if !exists {
-				http.Error(w, "Staff ID does not exist", http.StatusBadRequest)
-				return
-			}
+		k, err := createKey(db, k)
+		if writeRequestError(w, err) {
+			return
 		}
-
-		err := db.QueryRow(
-			"INSERT INTO keys (name, description, staff_id) VALUES ($1, $2, $3) RETURNING id",
-			k.Name, k.Description, k.StaffID,
-		).Scan(&k.ID)
-
 		if err != nil {
 			log.Printf("Error creating key: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -183,11 +225,41 @@ func CreateKey(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+// updateKey replaces a key's fields
+func updateKey(q queryer, id int, k models.Key) (models.Key, error) {
+	// Verify key exists
+	var exists bool
+	if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM keys WHERE id = $1)", id).Scan(&exists); err != nil {
+		return k, err
+	}
+	if !exists {
+		return k, requestError{http.StatusNotFound, "Key not found"}
+	}
+	if err := checkKey(q, k); err != nil {
+		return k, err
+	}
+
+	_, err := q.Exec(
+		"UPDATE keys SET name = $1, description = $2, staff_id = $3, clearance_level = $4, dual_control = $5, external_id = NULLIF($6, '') WHERE id = $7",
+		k.Name, k.Description, k.StaffID, k.ClearanceLevel, k.DualControl, k.ExternalID, id,
+	)
+	if isUniqueViolation(err) {
+		return k, requestError{http.StatusConflict, "external_id is already in use"}
+	}
+
+	k.ID = id
+	return k, err
+}
+
 // Update a key
 func UpdateKey(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		id := vars["id"]
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Invalid key ID", http.StatusBadRequest)
+			return
+		}
 
 		var k models.Key
 		if err := json.NewDecoder(r.Body).Decode(&k); err != nil {
@@ -195,90 +267,57 @@ func UpdateKey(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Verify key exists
-		var existingKey models.Key
-		err := db.QueryRow(
-			"SELECT id, name, description, staff_id FROM keys WHERE id = $1",
-			id,
-		).Scan(&existingKey.ID, &existingKey.Name, &existingKey.Description, &existingKey.StaffID)
-
-		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "Key not found", http.StatusNotFound)
-			} else {
-				log.Printf("Error retrieving key: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-			}
+		k, err = updateKey(db, id, k)
+		if writeRequestError(w, err) {
 			return
 		}
-
-		// Verify staff exists if staff_id is provided
-		if k.StaffID != 0 {
-			var exists bool
-			err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM staffs WHERE id = $1)", k.StaffID).Scan(&exists)
-			if err != nil {
-				log.Printf("Error checking staff existence: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
-			if !exists {
-				http.Error(w, "Staff ID does not exist", http.StatusBadRequest)
-				return
-			}
-		}
-
-		_, err = db.Exec(
-			"UPDATE keys SET name = $1, description = $2, staff_id = $3 WHERE id = $4",
-			k.Name, k.Description, k.StaffID, id,
-		)
-
 		if err != nil {
 			log.Printf("Error updating key: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
-		k.ID = existingKey.ID
 		json.NewEncoder(w).Encode(k)
 	}
 }
 
+// deleteKey removes a key that has no copies left
+func deleteKey(q queryer, id int) error {
+	var exists bool
+	if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM keys WHERE id = $1)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return requestError{http.StatusNotFound, "Key not found"}
+	}
+
+	// Check if any key copies reference this key
+	var count int
+	if err := q.QueryRow("SELECT COUNT(*) FROM key_copies WHERE key_id = $1", id).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return requestError{http.StatusBadRequest, "Cannot delete key: Key is referenced by one or more key copies"}
+	}
+
+	_, err := q.Exec("DELETE FROM keys WHERE id = $1", id)
+	return err
+}
+
 // Delete a key
 func DeleteKey(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		id := vars["id"]
-
-		var existingKey models.Key
-		err := db.QueryRow(
-			"SELECT id, name, description, staff_id FROM keys WHERE id = $1",
-			id,
-		).Scan(&existingKey.ID, &existingKey.Name, &existingKey.Description, &existingKey.StaffID)
-
+		id, err := strconv.Atoi(vars["id"])
 		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "Key not found", http.StatusNotFound)
-			} else {
-				log.Printf("Error retrieving key: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-			}
+			http.Error(w, "Invalid key ID", http.StatusBadRequest)
 			return
 		}
 
-		// Check if any key copies reference this key
-		var count int
-		err = db.QueryRow("SELECT COUNT(*) FROM key_copies WHERE key_id = $1", id).Scan(&count)
-		if err != nil {
-			log.Printf("Error checking key copies (key_id=%s): %v", id, err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
-		if count > 0 {
-			http.Error(w, "Cannot delete key: Key is referenced by one or more key copies", http.StatusBadRequest)
+		err = deleteKey(db, id)
+		if writeRequestError(w, err) {
 			return
 		}
-
-		_, err = db.Exec("DELETE FROM keys WHERE id = $1", id)
 		if err != nil {
 			log.Printf("Error deleting key: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -3,10 +3,12 @@ package controllers
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"go-app-be/models"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -22,7 +24,27 @@ type PaginatedResponseKeyCopy struct {
 	TotalPages int `json:"totalPages"`
 }
 
-// Get all key copies with pagination and key_name filter
+type keyCopyRequest struct {
+	models.KeyCopy
+	clearanceOverride
+}
+
+// nextKeyCopySerial allocates the human-readable serial for a new copy of the key, e.g. KEY-0042-03.
+// Copies are numbered from a counter on the key so the serial of a deleted copy is never handed out again.
+// Copies without a key get no serial.
+func nextKeyCopySerial(q queryer, keyID int) (string, error) {
+	var seq int
+	err := q.QueryRow("UPDATE keys SET copy_seq = copy_seq + 1 WHERE id = $1 RETURNING copy_seq", keyID).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("KEY-%04d-%02d", keyID, seq), nil
+}
+
+// Get all key copies with pagination and key_name filter, or all matching copies as CSV or XLSX
 func GetKeyCopies(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -50,12 +72,31 @@ func GetKeyCopies(db *sql.DB) http.HandlerFunc {
 			queryParams = append(queryParams, "%"+nameFilter+"%")
 		}
 
+		// Exports skip pagination and stream every matching copy, in stock ones included
+		format, ok := exportFormat(r)
+		if !ok {
+			http.Error(w, "format must be json, csv or xlsx", http.StatusBadRequest)
+			return
+		}
+		if format != "" {
+			exportQuery(db, w, format, "key-copies",
+				[]string{"ID", "Key ID", "Serial", "Key Name", "Staff ID", "Staff Name", "Witness Staff ID", "Status", "Expires At", "Expired"}, `
+				SELECT kc.id, kc.key_id, COALESCE(kc.serial, ''), k.name, kc.staff_id, COALESCE(s.name, ''),
+					kc.witness_staff_id, kc.status, kc.expires_at, kc.expired
+				FROM key_copies kc
+				JOIN keys k ON kc.key_id = k.id
+				LEFT JOIN staffs s ON kc.staff_id = s.id
+				`+whereClause+`
+				ORDER BY kc.id`, queryParams...)
+			return
+		}
+
 		// Count query
 		countQuery := `
 			SELECT COUNT(*)
 			FROM key_copies kc
 			JOIN keys k ON kc.key_id = k.id
-			JOIN staffs s ON kc.staff_id = s.id
+			LEFT JOIN staffs s ON kc.staff_id = s.id
 			` + whereClause
 
 		var total int
@@ -70,10 +111,11 @@ func GetKeyCopies(db *sql.DB) http.HandlerFunc {
 
 		// Data query with JOINs
 		selectQuery := `
-			SELECT kc.id, kc.key_id, k.name AS key_name, kc.staff_id, s.name AS staff_name
+			SELECT kc.id, kc.key_id, COALESCE(kc.serial, ''), k.name AS key_name, COALESCE(kc.staff_id, 0), COALESCE(s.name, '') AS staff_name,
+				COALESCE(kc.witness_staff_id, 0), kc.status, kc.expires_at, kc.expired
 			FROM key_copies kc
 			JOIN keys k ON kc.key_id = k.id
-			JOIN staffs s ON kc.staff_id = s.id
+			LEFT JOIN staffs s ON kc.staff_id = s.id
 			` + whereClause + `
 			ORDER BY kc.id
 			LIMIT $` + strconv.Itoa(len(queryParams)+1) + ` OFFSET $` + strconv.Itoa(len(queryParams)+2)
@@ -100,7 +142,8 @@ func GetKeyCopies(db *sql.DB) http.HandlerFunc {
 		for rows.Next() {
 			var kCopy models.KeyCopy
 			var keyName, staffName string
-			if err := rows.Scan(&kCopy.ID, &kCopy.KeyID, &keyName, &kCopy.StaffID, &staffName); err != nil {
+			if err := rows.Scan(&kCopy.ID, &kCopy.KeyID, &kCopy.Serial, &keyName, &kCopy.StaffID, &staffName,
+				&kCopy.WitnessStaffID, &kCopy.Status, &kCopy.ExpiresAt, &kCopy.Expired); err != nil {
 				log.Printf("Error scanning row: %v", err)
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
 				return
@@ -157,50 +200,101 @@ func GetKeyCopies(db *sql.DB) http.HandlerFunc {
 // 	}
 // }
 
+// createKeyCopy adds a key copy, assigning it straight away if it has a staff member
+func createKeyCopy(tx *sql.Tx, req keyCopyRequest) (models.KeyCopy, error) {
+	k := req.KeyCopy
+
+	// Verify staff exists and work out when the assignment expires if staff_id is provided
+	k.Expired = false
+	if k.StaffID != 0 {
+		expiresAt, msg, err := assignmentExpiry(tx, k.StaffID, k.ExpiresAt)
+		if err != nil {
+			return k, err
+		}
+		if msg != "" {
+			return k, requestError{http.StatusBadRequest, msg}
+		}
+		k.ExpiresAt = expiresAt
+	} else {
+		k.ExpiresAt = nil
+	}
+
+	// Verify key exists if key_id is provided
+	if k.KeyID != 0 {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM keys WHERE id = $1)", k.KeyID).Scan(&exists); err != nil {
+			return k, err
+		}
+		if !exists {
+			return k, requestError{http.StatusBadRequest, "Key ID does not exist"}
+		}
+	}
+
+	if k.StaffID != 0 {
+		dual, err := isDualControl(tx, k.KeyID)
+		if err != nil {
+			return k, err
+		}
+		if dual {
+			return k, requestError{http.StatusConflict, dualControlMessage}
+		}
+
+		_, msg, err := checkClearance(tx, k.StaffID, k.KeyID, req.clearanceOverride)
+		if err != nil {
+			return k, err
+		}
+		if msg != "" {
+			return k, requestError{http.StatusForbidden, msg}
+		}
+	}
+
+	var err error
+	k.Serial, err = nextKeyCopySerial(tx, k.KeyID)
+	if err != nil {
+		return k, err
+	}
+
+	err = tx.QueryRow(
+		"INSERT INTO key_copies (key_id, serial, staff_id, expires_at) VALUES ($1, NULLIF($2, ''), $3, $4) RETURNING id, status",
+		k.KeyID, k.Serial, k.StaffID, k.ExpiresAt,
+	).Scan(&k.ID, &k.Status)
+	if err != nil {
+		return k, err
+	}
+
+	err = recordKeyCopyHistory(tx, models.KeyCopyHistory{
+		KeyCopyID: k.ID,
+		KeyID:     k.KeyID,
+		Action:    "created",
+		StaffID:   k.StaffID,
+	})
+	return k, err
+}
+
 // Create a new key copy
 func CreateKeyCopy(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var k models.KeyCopy
-		if err := json.NewDecoder(r.Body).Decode(&k); err != nil {
+		var req keyCopyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		// Verify staff exists if staff_id is provided
-		if k.StaffID != 0 {
-			var exists bool
-			err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM staffs WHERE id = $1)", k.StaffID).Scan(&exists)
-			if err != nil {
-				log.Printf("Error checking staff existence: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
-			if !exists {
-				http.Error(w, "Staff ID does not exist", http.StatusBadRequest)
-				return
-			}
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
 		}
+		defer tx.Rollback()
 
-		// Verify key exists if key_id is provided
-		if k.KeyID != 0 {
-			var exists bool
-			err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM keys WHERE id = $1)", k.KeyID).Scan(&exists)
-			if err != nil {
-				log.Printf("Error checking key existence: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
-			if !exists {
-				http.Error(w, "Key ID does not exist", http.StatusBadRequest)
-				return
-			}
+		k, err := createKeyCopy(tx, req)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if writeRequestError(w, err) {
+			return
 		}
-
-		err := db.QueryRow(
-			"INSERT INTO key_copies (key_id, staff_id) VALUES ($1, $2) RETURNING id",
-			k.KeyID, k.StaffID,
-		).Scan(&k.ID)
-
 		if err != nil {
 			log.Printf("Error creating key copy: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -212,104 +306,228 @@ func CreateKeyCopy(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+// updateKeyCopy replaces a key copy's key, holder and expiry, with the same checks as assigning it afresh
+func updateKeyCopy(tx *sql.Tx, id int, req keyCopyRequest) (models.KeyCopy, error) {
+	k := req.KeyCopy
+
+	// Verify key exists
+	var existingKeyCopy models.KeyCopy
+	err := tx.QueryRow(
+		"SELECT id, key_id, COALESCE(serial, ''), staff_id, status, expires_at, expired FROM key_copies WHERE id = $1",
+		id,
+	).Scan(&existingKeyCopy.ID, &existingKeyCopy.KeyID, &existingKeyCopy.Serial, &existingKeyCopy.StaffID, &existingKeyCopy.Status, &existingKeyCopy.ExpiresAt, &existingKeyCopy.Expired)
+	if err == sql.ErrNoRows {
+		return k, requestError{http.StatusNotFound, "Key Copy not found"}
+	}
+	if err != nil {
+		return k, err
+	}
+
+	// Verify staff exists if staff_id is provided
+	if k.StaffID != 0 {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM staffs WHERE id = $1)", k.StaffID).Scan(&exists); err != nil {
+			return k, err
+		}
+		if !exists {
+			return k, requestError{http.StatusBadRequest, "Staff ID does not exist"}
+		}
+	}
+
+	// Verify key exists if key_id is provided
+	if k.KeyID != 0 {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM keys WHERE id = $1)", k.KeyID).Scan(&exists); err != nil {
+			return k, err
+		}
+		if !exists {
+			return k, requestError{http.StatusBadRequest, "Key ID does not exist"}
+		}
+	}
+
+	// Block checkout of a copy that someone else has reserved right now
+	if k.StaffID != 0 && k.StaffID != existingKeyCopy.StaffID {
+		reserved, err := reservedByOther(tx, existingKeyCopy.ID, k.StaffID, time.Now())
+		if err != nil {
+			return k, err
+		}
+		if reserved {
+			return k, requestError{http.StatusConflict, "Key copy is reserved by another staff member"}
+		}
+	}
+
+	// Work out when the assignment expires. The same holder may shorten it, but extending
+	// it needs a new approved access request
+	switch {
+	case k.StaffID == 0:
+		k.ExpiresAt = nil
+		k.Expired = false
+	case k.StaffID == existingKeyCopy.StaffID:
+		if k.ExpiresAt == nil {
+			k.ExpiresAt = existingKeyCopy.ExpiresAt
+		} else if existingKeyCopy.Expired || (existingKeyCopy.ExpiresAt != nil && k.ExpiresAt.After(*existingKeyCopy.ExpiresAt)) {
+			return k, requestError{http.StatusConflict, "Extending an assignment requires a new approved access request"}
+		}
+		k.Expired = existingKeyCopy.Expired
+	default:
+		expiresAt, msg, err := assignmentExpiry(tx, k.StaffID, k.ExpiresAt)
+		if err != nil {
+			return k, err
+		}
+		if msg != "" {
+			return k, requestError{http.StatusBadRequest, msg}
+		}
+		k.ExpiresAt = expiresAt
+		k.Expired = false
+	}
+
+	if k.StaffID != 0 && (k.StaffID != existingKeyCopy.StaffID || k.KeyID != existingKeyCopy.KeyID) {
+		dual, err := isDualControl(tx, k.KeyID)
+		if err != nil {
+			return k, err
+		}
+		if dual {
+			return k, requestError{http.StatusConflict, dualControlMessage}
+		}
+
+		_, msg, err := checkClearance(tx, k.StaffID, k.KeyID, req.clearanceOverride)
+		if err != nil {
+			return k, err
+		}
+		if msg != "" {
+			return k, requestError{http.StatusForbidden, msg}
+		}
+	}
+
+	// The serial is stamped on the physical tag, so it stays put unless the copy never had one
+	k.Serial = existingKeyCopy.Serial
+	if k.Serial == "" {
+		k.Serial, err = nextKeyCopySerial(tx, k.KeyID)
+		if err != nil {
+			return k, err
+		}
+	}
+
+	_, err = tx.Exec(
+		`UPDATE key_copies
+		SET key_id = $1, staff_id = $2, expires_at = $3, expired = $4, serial = NULLIF($5, ''),
+			witness_staff_id = CASE WHEN staff_id = $2 THEN witness_staff_id END
+		WHERE id = $6`,
+		k.KeyID, k.StaffID, k.ExpiresAt, k.Expired, k.Serial, id,
+	)
+	if err != nil {
+		return k, err
+	}
+
+	action := "updated"
+	if k.StaffID != existingKeyCopy.StaffID {
+		action = "reassigned"
+	}
+	err = recordKeyCopyHistory(tx, models.KeyCopyHistory{
+		KeyCopyID:       existingKeyCopy.ID,
+		KeyID:           k.KeyID,
+		Action:          action,
+		PreviousStaffID: existingKeyCopy.StaffID,
+		StaffID:         k.StaffID,
+	})
+
+	k.ID = existingKeyCopy.ID
+	k.Status = existingKeyCopy.Status
+	return k, err
+}
+
 // Update a key copy
 func UpdateKeyCopy(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		id := vars["id"]
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Invalid key copy ID", http.StatusBadRequest)
+			return
+		}
 
-		var k models.KeyCopy
-		if err := json.NewDecoder(r.Body).Decode(&k); err != nil {
+		var req keyCopyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		// Verify key exists
-		var existingKeyCopy models.KeyCopy
-		err := db.QueryRow(
-			"SELECT id, key_id, staff_id FROM key_copies WHERE id = $1",
-			id,
-		).Scan(&existingKeyCopy.ID, &existingKeyCopy.KeyID, &existingKeyCopy.StaffID)
-
+		tx, err := db.Begin()
 		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "Key Copy not found", http.StatusNotFound)
-			} else {
-				log.Printf("Error retrieving key copy: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-			}
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
+		defer tx.Rollback()
 
-		// Verify staff exists if staff_id is provided
-		if k.StaffID != 0 {
-			var exists bool
-			err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM staffs WHERE id = $1)", k.StaffID).Scan(&exists)
-			if err != nil {
-				log.Printf("Error checking staff existence: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
-			if !exists {
-				http.Error(w, "Staff ID does not exist", http.StatusBadRequest)
-				return
-			}
+		k, err := updateKeyCopy(tx, id, req)
+		if err == nil {
+			err = tx.Commit()
 		}
-
-		// Verify key exists if key_id is provided
-		if k.KeyID != 0 {
-			var exists bool
-			err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM keys WHERE id = $1)", k.KeyID).Scan(&exists)
-			if err != nil {
-				log.Printf("Error checking key existence: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
-			if !exists {
-				http.Error(w, "Key ID does not exist", http.StatusBadRequest)
-				return
-			}
+		if writeRequestError(w, err) {
+			return
 		}
-
-		_, err = db.Exec(
-			"UPDATE key_copies SET key_id = $1, staff_id = $2 WHERE id = $3",
-			k.KeyID, k.StaffID, id,
-		)
-
 		if err != nil {
 			log.Printf("Error updating key copy: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
-		k.ID = existingKeyCopy.ID
 		json.NewEncoder(w).Encode(k)
 	}
 }
 
+// deleteKeyCopy removes a key copy, keeping its history
+func deleteKeyCopy(tx *sql.Tx, id int) error {
+	var existingKeyCopy models.KeyCopy
+	err := tx.QueryRow(
+		"SELECT id, key_id, staff_id FROM key_copies WHERE id = $1",
+		id,
+	).Scan(&existingKeyCopy.ID, &existingKeyCopy.KeyID, &existingKeyCopy.StaffID)
+	if err == sql.ErrNoRows {
+		return requestError{http.StatusNotFound, "Key copy not found"}
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM key_copies WHERE id = $1", id); err != nil {
+		return err
+	}
+
+	return recordKeyCopyHistory(tx, models.KeyCopyHistory{
+		KeyCopyID:       existingKeyCopy.ID,
+		KeyID:           existingKeyCopy.KeyID,
+		Action:          "deleted",
+		PreviousStaffID: existingKeyCopy.StaffID,
+	})
+}
+
 // Delete a key copy
 func DeleteKeyCopy(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		id := vars["id"]
-
-		var existingKeyCopy models.KeyCopy
-		err := db.QueryRow(
-			"SELECT id, key_id, staff_id FROM key_copies WHERE id = $1",
-			id,
-		).Scan(&existingKeyCopy.ID, &existingKeyCopy.KeyID, &existingKeyCopy.StaffID)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Invalid key copy ID", http.StatusBadRequest)
+			return
+		}
 
+		tx, err := db.Begin()
 		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "Key copy not found", http.StatusNotFound)
-			} else {
-				log.Printf("Error retrieving key copy: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-			}
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
+		defer tx.Rollback()
 
-		_, err = db.Exec("DELETE FROM key_copies WHERE id = $1", id)
+		err = deleteKeyCopy(tx, id)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if writeRequestError(w, err) {
+			return
+		}
 		if err != nil {
 			log.Printf("Error deleting key copy: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -319,3 +537,97 @@ func DeleteKeyCopy(db *sql.DB) http.HandlerFunc {
 		json.NewEncoder(w).Encode(map[string]string{"message": "Key copy deleted successfully"})
 	}
 }
+
+// nullableID stores a zero ID as NULL
+func nullableID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// recordKeyCopyHistory appends an entry to a key copy's change history.
+// StaffID is the holder after the change and PreviousStaffID the holder before it.
+func recordKeyCopyHistory(q queryer, h models.KeyCopyHistory) error {
+	_, err := q.Exec(`
+		INSERT INTO key_copy_history (key_copy_id, key_id, action, previous_staff_id, staff_id, performed_by, note)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		h.KeyCopyID, nullableID(h.KeyID), h.Action, nullableID(h.PreviousStaffID), nullableID(h.StaffID), nullableID(h.PerformedBy), h.Note,
+	)
+	return err
+}
+
+// assignmentExpiry checks that the staff member is inside their validity window and works out when an
+// assignment to them ends, capped at the end of that window. A message is returned when the assignment
+// is not allowed.
+func assignmentExpiry(q queryer, staffID int, requested *time.Time) (*time.Time, string, error) {
+	var validFrom, validUntil *time.Time
+	err := q.QueryRow("SELECT valid_from, valid_until FROM staffs WHERE id = $1", staffID).Scan(&validFrom, &validUntil)
+	if err == sql.ErrNoRows {
+		return nil, "Staff ID does not exist", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	if validFrom != nil && now.Before(*validFrom) {
+		return nil, "Staff member's access period has not started yet", nil
+	}
+	if validUntil != nil && !now.Before(*validUntil) {
+		return nil, "Staff member's access period has ended", nil
+	}
+	if requested != nil && !requested.After(now) {
+		return nil, "expires_at must be in the future", nil
+	}
+
+	if validUntil != nil && (requested == nil || requested.After(*validUntil)) {
+		return validUntil, "", nil
+	}
+	return requested, "", nil
+}
+
+// ExpireAssignments flags held copies whose assignment or holder validity has run out and records it in the copy history
+func ExpireAssignments(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		UPDATE key_copies kc
+		SET expired = TRUE
+		FROM staffs s
+		WHERE s.id = kc.staff_id AND NOT kc.expired AND COALESCE(kc.expires_at, s.valid_until) <= NOW()
+		RETURNING kc.id, kc.key_id, kc.staff_id, COALESCE(kc.expires_at, s.valid_until)`)
+	if err != nil {
+		return err
+	}
+
+	var expired []models.KeyCopyHistory
+	for rows.Next() {
+		var h models.KeyCopyHistory
+		var expiredAt time.Time
+		if err := rows.Scan(&h.KeyCopyID, &h.KeyID, &h.StaffID, &expiredAt); err != nil {
+			rows.Close()
+			return err
+		}
+		h.Action = "expired"
+		h.PreviousStaffID = h.StaffID
+		h.Note = "Assignment expired at " + expiredAt.Format(time.RFC3339)
+		expired = append(expired, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, h := range expired {
+		if err := recordKeyCopyHistory(tx, h); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
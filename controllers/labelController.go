@@ -0,0 +1,276 @@
+package controllers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-app-be/models"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/skip2/go-qrcode"
+)
+
+// Label sheet layout on A4 in millimetres: 3 columns of 8 labels
+const (
+	labelColumns    = 3
+	labelRows       = 8
+	labelMarginX    = 7.0
+	labelMarginY    = 10.5
+	labelWidth      = 65.0
+	labelHeight     = 34.5
+	labelQRSize     = 28.0
+	labelTextOffset = 32.0
+)
+
+type labelSheetRequest struct {
+	KeyCopyIDs []int `json:"key_copy_ids"`
+	KeyID      int   `json:"key_id"`
+}
+
+type KeyCopyDetail struct {
+	models.KeyCopy
+	KeyName   string `json:"key_name"`
+	StaffName string `json:"staff_name"`
+}
+
+// keyCopyLabel is what gets printed on a copy's tag. Its fields are also what ZPL templates can use.
+type keyCopyLabel struct {
+	KeyCopyID      int
+	KeyID          int
+	Serial         string
+	KeyName        string
+	KeyDescription string
+}
+
+// labelCopies loads the labels for the requested copies and/or every copy of a key. Copies without a serial are skipped.
+func labelCopies(q queryer, req labelSheetRequest) ([]keyCopyLabel, error) {
+	rows, err := q.Query(`
+		SELECT kc.id, kc.key_id, kc.serial, k.name, COALESCE(k.description, '')
+		FROM key_copies kc
+		JOIN keys k ON k.id = kc.key_id
+		WHERE kc.serial IS NOT NULL AND (kc.id = ANY($1) OR kc.key_id = $2)
+		ORDER BY kc.key_id, kc.id`, pq.Array(req.KeyCopyIDs), req.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := []keyCopyLabel{}
+	for rows.Next() {
+		var l keyCopyLabel
+		if err := rows.Scan(&l.KeyCopyID, &l.KeyID, &l.Serial, &l.KeyName, &l.KeyDescription); err != nil {
+			return nil, err
+		}
+		labels = append(labels, l)
+	}
+	return labels, rows.Err()
+}
+
+// qrSVG draws a QR code as an SVG, one path segment per run of dark modules
+func qrSVG(content string, size int) ([]byte, error) {
+	code, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		return nil, err
+	}
+	bitmap := code.Bitmap()
+
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			start := x
+			for x < len(row) && row[x] {
+				x++
+			}
+			fmt.Fprintf(&path, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+
+	var svg bytes.Buffer
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, len(bitmap), len(bitmap))
+	svg.WriteString(`<rect width="100%" height="100%" fill="#fff"/>`)
+	fmt.Fprintf(&svg, `<path fill="#000" d="%s"/></svg>`, path.String())
+	return svg.Bytes(), nil
+}
+
+// fitText shortens text with an ellipsis until it fits the width on the current font
+func fitText(pdf *fpdf.Fpdf, text string, width float64) string {
+	if pdf.GetStringWidth(text) <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 && pdf.GetStringWidth(string(runes)+"...") > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "..."
+}
+
+// labelSheetPDF lays out labels on as many A4 pages as needed
+func labelSheetPDF(labels []keyCopyLabel) ([]byte, error) {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(0, 0, 0)
+	pdf.SetAutoPageBreak(false, 0)
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	textWidth := labelWidth - labelTextOffset - 2
+
+	for i, label := range labels {
+		slot := i % (labelColumns * labelRows)
+		if slot == 0 {
+			pdf.AddPage()
+		}
+		x := labelMarginX + float64(slot%labelColumns)*labelWidth
+		y := labelMarginY + float64(slot/labelColumns)*labelHeight
+
+		png, err := qrcode.Encode(label.Serial, qrcode.Medium, 256)
+		if err != nil {
+			return nil, err
+		}
+		options := fpdf.ImageOptions{ImageType: "PNG"}
+		name := "qr-" + strconv.Itoa(label.KeyCopyID)
+		pdf.RegisterImageOptionsReader(name, options, bytes.NewReader(png))
+		pdf.ImageOptions(name, x+2, y+(labelHeight-labelQRSize)/2, labelQRSize, labelQRSize, false, options, 0, "")
+
+		pdf.SetFont("Helvetica", "B", 11)
+		pdf.Text(x+labelTextOffset, y+14, label.Serial)
+		pdf.SetFont("Helvetica", "", 8)
+		pdf.Text(x+labelTextOffset, y+20, fitText(pdf, tr(label.KeyName), textWidth))
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Look up a key copy by the serial on its tag, for scanners
+func GetKeyCopyBySerial(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		serial := strings.ToUpper(strings.TrimSpace(vars["serial"]))
+
+		var kc KeyCopyDetail
+		err := db.QueryRow(`
+			SELECT kc.id, kc.key_id, kc.serial, COALESCE(kc.staff_id, 0), COALESCE(kc.witness_staff_id, 0), kc.status,
+				kc.expires_at, kc.expired, COALESCE(k.name, ''), COALESCE(s.name, '')
+			FROM key_copies kc
+			LEFT JOIN keys k ON k.id = kc.key_id
+			LEFT JOIN staffs s ON s.id = kc.staff_id
+			WHERE kc.serial = $1`, serial,
+		).Scan(&kc.ID, &kc.KeyID, &kc.Serial, &kc.StaffID, &kc.WitnessStaffID, &kc.Status,
+			&kc.ExpiresAt, &kc.Expired, &kc.KeyName, &kc.StaffName)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Key copy not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving key copy: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		json.NewEncoder(w).Encode(kc)
+	}
+}
+
+// Get a QR code label for a key copy as PNG (default) or SVG
+func GetKeyCopyLabel(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		size, err := strconv.Atoi(r.URL.Query().Get("size"))
+		if err != nil || size <= 0 {
+			size = 256
+		}
+		if size < 64 || size > 1024 {
+			http.Error(w, "size must be between 64 and 1024", http.StatusBadRequest)
+			return
+		}
+
+		var serial string
+		err = db.QueryRow("SELECT COALESCE(serial, '') FROM key_copies WHERE id = $1", id).Scan(&serial)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Key copy not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving key copy: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+		if serial == "" {
+			http.Error(w, "Key copy has no serial", http.StatusConflict)
+			return
+		}
+
+		var body []byte
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "png":
+			w.Header().Set("Content-Type", "image/png")
+			body, err = qrcode.Encode(serial, qrcode.Medium, size)
+		case "svg":
+			w.Header().Set("Content-Type", "image/svg+xml")
+			body, err = qrSVG(serial, size)
+		default:
+			http.Error(w, "format must be png or svg", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Error generating label: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(body)
+	}
+}
+
+// Get a printable PDF sheet of labels for the listed key copies and/or every copy of a key
+func CreateLabelSheet(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req labelSheetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if len(req.KeyCopyIDs) == 0 && req.KeyID == 0 {
+			http.Error(w, "key_copy_ids or key_id is required", http.StatusBadRequest)
+			return
+		}
+
+		labels, err := labelCopies(db, req)
+		if err != nil {
+			log.Printf("Error querying key copies: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if len(labels) == 0 {
+			http.Error(w, "No key copies with serials found", http.StatusNotFound)
+			return
+		}
+
+		sheet, err := labelSheetPDF(labels)
+		if err != nil {
+			log.Printf("Error generating label sheet: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", `inline; filename="key-copy-labels.pdf"`)
+		w.Write(sheet)
+	}
+}
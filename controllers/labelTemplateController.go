@@ -0,0 +1,171 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-app-be/models"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// validateLabelTemplate fills in the default label size and returns a message when the template is not usable
+func validateLabelTemplate(t *models.LabelTemplate) string {
+	if t.Organisation == "" {
+		return "organisation is required"
+	}
+	if t.ZPL == "" {
+		return "zpl is required"
+	}
+	if t.WidthDots == 0 {
+		t.WidthDots = zplDefaultWidth
+	}
+	if t.HeightDots == 0 {
+		t.HeightDots = zplDefaultHeight
+	}
+	if t.WidthDots < 0 || t.HeightDots < 0 {
+		return "width_dots and height_dots must be positive"
+	}
+	if t.WidthDots > zplMaxDots || t.HeightDots > zplMaxDots {
+		return fmt.Sprintf("width_dots and height_dots can be at most %d", zplMaxDots)
+	}
+	if _, err := parseZPLTemplate(t.ZPL); err != nil {
+		return "Invalid zpl template: " + err.Error()
+	}
+	return ""
+}
+
+// Get all label templates
+func GetLabelTemplates(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT id, organisation, zpl, width_dots, height_dots, updated_at FROM label_templates ORDER BY organisation")
+		if err != nil {
+			log.Printf("Error querying label templates: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		templates := []models.LabelTemplate{}
+		for rows.Next() {
+			var t models.LabelTemplate
+			if err := rows.Scan(&t.ID, &t.Organisation, &t.ZPL, &t.WidthDots, &t.HeightDots, &t.UpdatedAt); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			templates = append(templates, t)
+		}
+
+		json.NewEncoder(w).Encode(templates)
+	}
+}
+
+// Create the label template for an organisation
+func CreateLabelTemplate(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var t models.LabelTemplate
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if msg := validateLabelTemplate(&t); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		err := db.QueryRow(`
+			INSERT INTO label_templates (organisation, zpl, width_dots, height_dots)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (organisation) DO NOTHING
+			RETURNING id, updated_at`,
+			t.Organisation, t.ZPL, t.WidthDots, t.HeightDots,
+		).Scan(&t.ID, &t.UpdatedAt)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Organisation already has a label template", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error creating label template: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
+	}
+}
+
+// Update a label template
+func UpdateLabelTemplate(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		var t models.LabelTemplate
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if msg := validateLabelTemplate(&t); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		var taken bool
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM label_templates WHERE organisation = $1 AND id <> $2)", t.Organisation, id).Scan(&taken)
+		if err != nil {
+			log.Printf("Error checking label templates: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			http.Error(w, "Organisation already has a label template", http.StatusConflict)
+			return
+		}
+
+		err = db.QueryRow(`
+			UPDATE label_templates SET organisation = $1, zpl = $2, width_dots = $3, height_dots = $4, updated_at = NOW()
+			WHERE id = $5
+			RETURNING id, updated_at`,
+			t.Organisation, t.ZPL, t.WidthDots, t.HeightDots, id,
+		).Scan(&t.ID, &t.UpdatedAt)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Label template not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error updating label template: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		json.NewEncoder(w).Encode(t)
+	}
+}
+
+// Delete a label template, putting the organisation back on the default template
+func DeleteLabelTemplate(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		result, err := db.Exec("DELETE FROM label_templates WHERE id = $1", id)
+		if err != nil {
+			log.Printf("Error deleting label template: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			http.Error(w, "Label template not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Label template deleted successfully"})
+	}
+}
@@ -0,0 +1,570 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-app-be/models"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type campaignRequest struct {
+	Name      string     `json:"name"`
+	CreatedBy int        `json:"created_by"`
+	DueAt     *time.Time `json:"due_at"`
+}
+
+type campaignCompletion struct {
+	StaffID int `json:"staff_id"`
+}
+
+type itemDecision struct {
+	ReviewerID int    `json:"reviewer_id"`
+	Decision   string `json:"decision"`
+	Note       string `json:"note"`
+}
+
+type CampaignSummary struct {
+	models.RecertificationCampaign
+	TotalItems int `json:"total_items"`
+	Pending    int `json:"pending"`
+	Kept       int `json:"kept"`
+	Revoked    int `json:"revoked"`
+}
+
+type RecertificationReportItem struct {
+	KeyCopyID    int        `json:"key_copy_id"`
+	KeyName      string     `json:"key_name"`
+	StaffName    string     `json:"staff_name"`
+	ReviewerName string     `json:"reviewer_name"`
+	Decision     string     `json:"decision"`
+	DecisionNote string     `json:"decision_note"`
+	DecidedAt    *time.Time `json:"decided_at"`
+}
+
+type RecertificationReport struct {
+	CampaignID  int                         `json:"campaign_id"`
+	Name        string                      `json:"name"`
+	CreatedAt   time.Time                   `json:"created_at"`
+	CompletedAt *time.Time                  `json:"completed_at"`
+	SignedBy    int                         `json:"signed_by"`
+	Items       []RecertificationReportItem `json:"items"`
+}
+
+// SignedRecertificationReport carries the report exactly as it was signed, so the signature can be checked
+// over the bytes of Report
+type SignedRecertificationReport struct {
+	Report    json.RawMessage `json:"report"`
+	Algorithm string          `json:"algorithm"`
+	Signature string          `json:"signature"`
+}
+
+const campaignSummaryQuery = `
+	SELECT c.id, c.name, c.status, c.created_by, c.created_at, c.due_at, c.completed_at,
+		COALESCE(c.signed_by, 0), COALESCE(c.signature, ''),
+		COUNT(i.id),
+		COUNT(i.id) FILTER (WHERE i.decision = 'pending'),
+		COUNT(i.id) FILTER (WHERE i.decision = 'keep'),
+		COUNT(i.id) FILTER (WHERE i.decision = 'revoke')
+	FROM recertification_campaigns c
+	LEFT JOIN recertification_items i ON i.campaign_id = c.id`
+
+const recertificationItemColumns = `id, campaign_id, key_copy_id, key_id, staff_id, COALESCE(reviewer_id, 0),
+	decision, COALESCE(decision_note, ''), decided_at, COALESCE(return_task_id, 0)`
+
+func scanCampaignSummary(row rowScanner) (CampaignSummary, error) {
+	var c CampaignSummary
+	err := row.Scan(&c.ID, &c.Name, &c.Status, &c.CreatedBy, &c.CreatedAt, &c.DueAt, &c.CompletedAt,
+		&c.SignedBy, &c.Signature, &c.TotalItems, &c.Pending, &c.Kept, &c.Revoked)
+	return c, err
+}
+
+func scanRecertificationItem(row rowScanner) (models.RecertificationItem, error) {
+	var i models.RecertificationItem
+	err := row.Scan(&i.ID, &i.CampaignID, &i.KeyCopyID, &i.KeyID, &i.StaffID, &i.ReviewerID,
+		&i.Decision, &i.DecisionNote, &i.DecidedAt, &i.ReturnTaskID)
+	return i, err
+}
+
+// signReport signs a report payload with HMAC-SHA256 using the REPORT_SIGNING_KEY environment variable
+func signReport(payload interface{}) (string, error) {
+	key := os.Getenv("REPORT_SIGNING_KEY")
+	if key == "" {
+		return "", errors.New("REPORT_SIGNING_KEY is not set")
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// buildRecertificationReport collects a campaign's decisions with names resolved
+func buildRecertificationReport(q queryer, c models.RecertificationCampaign) (RecertificationReport, error) {
+	report := RecertificationReport{
+		CampaignID:  c.ID,
+		Name:        c.Name,
+		CreatedAt:   c.CreatedAt,
+		CompletedAt: c.CompletedAt,
+		SignedBy:    c.SignedBy,
+		Items:       []RecertificationReportItem{},
+	}
+
+	rows, err := q.Query(`
+		SELECT i.key_copy_id, COALESCE(k.name, ''), COALESCE(s.name, ''), COALESCE(rv.name, ''),
+			i.decision, COALESCE(i.decision_note, ''), i.decided_at
+		FROM recertification_items i
+		LEFT JOIN keys k ON k.id = i.key_id
+		LEFT JOIN staffs s ON s.id = i.staff_id
+		LEFT JOIN staffs rv ON rv.id = i.reviewer_id
+		WHERE i.campaign_id = $1
+		ORDER BY i.id`, c.ID)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item RecertificationReportItem
+		if err := rows.Scan(&item.KeyCopyID, &item.KeyName, &item.StaffName, &item.ReviewerName,
+			&item.Decision, &item.DecisionNote, &item.DecidedAt); err != nil {
+			return report, err
+		}
+		report.Items = append(report.Items, item)
+	}
+	return report, rows.Err()
+}
+
+// Get all recertification campaigns with their progress
+func GetCampaigns(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(campaignSummaryQuery + " GROUP BY c.id ORDER BY c.created_at DESC")
+		if err != nil {
+			log.Printf("Error querying campaigns: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		campaigns := []CampaignSummary{}
+		for rows.Next() {
+			c, err := scanCampaignSummary(rows)
+			if err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			campaigns = append(campaigns, c)
+		}
+
+		json.NewEncoder(w).Encode(campaigns)
+	}
+}
+
+// Get a specific recertification campaign with its progress
+func GetCampaign(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		c, err := scanCampaignSummary(db.QueryRow(campaignSummaryQuery+" WHERE c.id = $1 GROUP BY c.id", id))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Campaign not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving campaign: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// Start a recertification campaign, snapshotting every current key copy holder
+func CreateCampaign(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req campaignRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if req.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+
+		admin, err := isAdmin(db, req.CreatedBy)
+		if err != nil {
+			log.Printf("Error checking admin: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !admin {
+			http.Error(w, "Only an admin can start a recertification campaign", http.StatusForbidden)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var id int
+		err = tx.QueryRow(
+			"INSERT INTO recertification_campaigns (name, created_by, due_at) VALUES ($1, $2, $3) RETURNING id",
+			req.Name, req.CreatedBy, req.DueAt,
+		).Scan(&id)
+		if err != nil {
+			log.Printf("Error creating campaign: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// Items go to the key custodian, or to the holder's manager when the holder is the custodian
+		// or the key has none. Items with no reviewer are left to admins.
+		_, err = tx.Exec(`
+			INSERT INTO recertification_items (campaign_id, key_copy_id, key_id, staff_id, reviewer_id)
+			SELECT $1, kc.id, kc.key_id, kc.staff_id,
+				CASE WHEN COALESCE(k.staff_id, 0) NOT IN (0, kc.staff_id) THEN k.staff_id ELSE s.manager_id END
+			FROM key_copies kc
+			JOIN keys k ON k.id = kc.key_id
+			JOIN staffs s ON s.id = kc.staff_id
+			ORDER BY kc.id`, id)
+		if err != nil {
+			log.Printf("Error snapshotting key copy holders: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		c, err := scanCampaignSummary(tx.QueryRow(campaignSummaryQuery+" WHERE c.id = $1 GROUP BY c.id", id))
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error creating campaign: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// Get the review items of a campaign, optionally filtered by reviewer and decision
+func GetCampaignItems(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		query := "SELECT " + recertificationItemColumns + " FROM recertification_items WHERE campaign_id = $1"
+		queryParams := []interface{}{id}
+		if reviewerID := r.URL.Query().Get("reviewer_id"); reviewerID != "" {
+			queryParams = append(queryParams, reviewerID)
+			query += " AND reviewer_id = $" + strconv.Itoa(len(queryParams))
+		}
+		if decision := r.URL.Query().Get("decision"); decision != "" {
+			queryParams = append(queryParams, decision)
+			query += " AND decision = $" + strconv.Itoa(len(queryParams))
+		}
+		query += " ORDER BY id"
+
+		rows, err := db.Query(query, queryParams...)
+		if err != nil {
+			log.Printf("Error querying campaign items: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		items := []models.RecertificationItem{}
+		for rows.Next() {
+			item, err := scanRecertificationItem(rows)
+			if err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			items = append(items, item)
+		}
+
+		json.NewEncoder(w).Encode(items)
+	}
+}
+
+// Record a keep or revoke decision on a review item. Revoking opens a return task for the holder.
+func DecideCampaignItem(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		var d itemDecision
+		if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if d.Decision != "keep" && d.Decision != "revoke" {
+			http.Error(w, "decision must be keep or revoke", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		item, err := scanRecertificationItem(tx.QueryRow("SELECT "+recertificationItemColumns+" FROM recertification_items WHERE id = $1 FOR UPDATE", id))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Review item not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving review item: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		var status string
+		var dueAt *time.Time
+		err = tx.QueryRow("SELECT status, due_at FROM recertification_campaigns WHERE id = $1", item.CampaignID).Scan(&status, &dueAt)
+		if err != nil {
+			log.Printf("Error retrieving campaign: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if status != "open" {
+			http.Error(w, "Campaign is already completed", http.StatusConflict)
+			return
+		}
+		if item.Decision != "pending" {
+			http.Error(w, "Review item has already been decided", http.StatusConflict)
+			return
+		}
+
+		if d.ReviewerID != item.ReviewerID {
+			admin, err := isAdmin(tx, d.ReviewerID)
+			if err != nil {
+				log.Printf("Error checking admin: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if !admin {
+				http.Error(w, "Only the assigned reviewer or an admin can decide this item", http.StatusForbidden)
+				return
+			}
+		}
+
+		if d.Decision == "revoke" {
+			reason := fmt.Sprintf("Access revoked in recertification campaign #%d", item.CampaignID)
+			item.ReturnTaskID, err = openReturnTask(tx, item.KeyCopyID, item.StaffID, reason, dueAt)
+			if err != nil {
+				log.Printf("Error opening return task: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		item.Decision = d.Decision
+		item.DecisionNote = d.Note
+		item.ReviewerID = d.ReviewerID
+		err = tx.QueryRow(`
+			UPDATE recertification_items
+			SET decision = $1, decision_note = $2, reviewer_id = $3, return_task_id = $4, decided_at = NOW()
+			WHERE id = $5
+			RETURNING decided_at`,
+			item.Decision, item.DecisionNote, item.ReviewerID, nullableID(item.ReturnTaskID), item.ID,
+		).Scan(&item.DecidedAt)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error recording decision: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(item)
+	}
+}
+
+// Complete a campaign once every item is decided and sign its report
+func CompleteCampaign(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		var req campaignCompletion
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		// Completing signs the report, so there's no point checking anything else without a key
+		if os.Getenv("REPORT_SIGNING_KEY") == "" {
+			http.Error(w, "Campaign reports can't be signed: REPORT_SIGNING_KEY is not configured", http.StatusServiceUnavailable)
+			return
+		}
+
+		admin, err := isAdmin(db, req.StaffID)
+		if err != nil {
+			log.Printf("Error checking admin: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !admin {
+			http.Error(w, "Only an admin can complete a recertification campaign", http.StatusForbidden)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var status string
+		err = tx.QueryRow("SELECT status FROM recertification_campaigns WHERE id = $1 FOR UPDATE", id).Scan(&status)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Campaign not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving campaign: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+		if status != "open" {
+			http.Error(w, "Campaign is already completed", http.StatusConflict)
+			return
+		}
+
+		var pending int
+		err = tx.QueryRow("SELECT COUNT(*) FROM recertification_items WHERE campaign_id = $1 AND decision = 'pending'", id).Scan(&pending)
+		if err != nil {
+			log.Printf("Error counting pending items: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if pending > 0 {
+			http.Error(w, fmt.Sprintf("Campaign still has %d undecided items", pending), http.StatusConflict)
+			return
+		}
+
+		_, err = tx.Exec(
+			"UPDATE recertification_campaigns SET status = 'completed', completed_at = NOW(), signed_by = $1 WHERE id = $2",
+			req.StaffID, id,
+		)
+		if err != nil {
+			log.Printf("Error completing campaign: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		c, err := scanCampaignSummary(tx.QueryRow(campaignSummaryQuery+" WHERE c.id = $1 GROUP BY c.id", id))
+		if err != nil {
+			log.Printf("Error retrieving campaign: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		report, err := buildRecertificationReport(tx, c.RecertificationCampaign)
+		if err != nil {
+			log.Printf("Error building report: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// The report is stored as signed, since the keys and staff it names can change afterwards
+		data, err := json.Marshal(report)
+		if err == nil {
+			c.Signature, err = signReport(json.RawMessage(data))
+		}
+		if err != nil {
+			log.Printf("Error signing report: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		_, err = tx.Exec("UPDATE recertification_campaigns SET signature = $1, report = $2 WHERE id = $3", c.Signature, string(data), id)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error storing report signature: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// Export the signed completion report of a campaign
+func GetCampaignReport(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		c, err := scanCampaignSummary(db.QueryRow(campaignSummaryQuery+" WHERE c.id = $1 GROUP BY c.id", id))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Campaign not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving campaign: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if c.Status != "completed" {
+			http.Error(w, "Campaign is not completed yet", http.StatusConflict)
+			return
+		}
+
+		var report string
+		err = db.QueryRow("SELECT COALESCE(report, '') FROM recertification_campaigns WHERE id = $1", c.ID).Scan(&report)
+		if err != nil {
+			log.Printf("Error retrieving report: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if report == "" {
+			http.Error(w, "Campaign was completed without a stored report", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=recertification-%d.json", c.ID))
+		json.NewEncoder(w).Encode(SignedRecertificationReport{
+			Report:    json.RawMessage(report),
+			Algorithm: "HMAC-SHA256",
+			Signature: c.Signature,
+		})
+	}
+}
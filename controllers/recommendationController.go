@@ -0,0 +1,251 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// saturatedFor is how long at least n loans were running at once
+func saturatedFor(loans []loanInterval, n int) time.Duration {
+	if n <= 0 || len(loans) == 0 {
+		return 0
+	}
+	edges := loanEdges(loans)
+
+	var total time.Duration
+	current := 0
+	for i, e := range edges {
+		current += e.delta
+		if current >= n && i+1 < len(edges) {
+			total += edges[i+1].at.Sub(e.at)
+		}
+	}
+	return total
+}
+
+// copyShortageShare is how much of the time every copy of a key can be out before another copy is recommended
+const copyShortageShare = 0.05
+
+type IdleCopy struct {
+	KeyCopyID int    `json:"key_copy_id"`
+	Serial    string `json:"serial"`
+}
+
+// CopyRecommendation says how many copies of a key to keep and why
+type CopyRecommendation struct {
+	KeyID               int        `json:"key_id"`
+	Name                string     `json:"name"`
+	Copies              int        `json:"copies"`
+	Recommended         int        `json:"recommended"`
+	Action              string     `json:"action"`
+	PeakLoans           int        `json:"peak_loans"`
+	PeakReservations    int        `json:"peak_reservations"`
+	RefusedReservations int        `json:"refused_reservations"`
+	UnavailableHours    float64    `json:"unavailable_hours"`
+	Surplus             int        `json:"surplus"`
+	IdleCopies          []IdleCopy `json:"idle_copies"`
+	Reasons             []string   `json:"reasons"`
+}
+
+// Recommend how many copies of each key to keep, from loan and reservation demand between from and to
+// (the last 90 days by default). A key needs as many copies as were ever wanted at once, by loans or by
+// reservations including refused ones, plus one if every copy was out for more than copyShortageShare
+// of the time. Copies beyond that are surplus, and copies that never left the cabinet are listed as
+// idle since they are a liability without being of use. Keys that need copies come first, then keys
+// with surplus.
+func GetCopyRecommendations(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		to := time.Now()
+		if value := query.Get("to"); value != "" {
+			t, err := parseTime(value)
+			if err != nil {
+				http.Error(w, "Invalid to", http.StatusBadRequest)
+				return
+			}
+			to = t
+		}
+		from := to.AddDate(0, 0, -90)
+		if value := query.Get("from"); value != "" {
+			t, err := parseTime(value)
+			if err != nil {
+				http.Error(w, "Invalid from", http.StatusBadRequest)
+				return
+			}
+			from = t
+		}
+		if !from.Before(to) {
+			http.Error(w, "from must be before to", http.StatusBadRequest)
+			return
+		}
+
+		// Loans can't run past now
+		end := to
+		if now := time.Now(); now.Before(end) {
+			end = now
+		}
+		if end.Before(from) {
+			end = from
+		}
+
+		changes, err := holderChanges(db, from, end)
+		if err != nil {
+			log.Printf("Error querying key copy history: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		keyLoans := map[int][]loanInterval{}
+		loaned := map[int]bool{}
+		for _, c := range changes {
+			if start, stop, ok := c.loanWithin(from, end); ok {
+				keyLoans[c.KeyID] = append(keyLoans[c.KeyID], loanInterval{start, stop})
+				loaned[c.KeyCopyID] = true
+			}
+		}
+
+		rows, err := db.Query(`
+			SELECT key_id, start_time, end_time, status
+			FROM key_reservations
+			WHERE status IN ('active', 'refused') AND start_time < $2 AND end_time > $1`, from, to)
+		if err != nil {
+			log.Printf("Error querying reservations: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		keyReservations := map[int][]loanInterval{}
+		refused := map[int]int{}
+		for rows.Next() {
+			var keyID int
+			var status string
+			var res loanInterval
+			if err := rows.Scan(&keyID, &res.Start, &res.End, &status); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			keyReservations[keyID] = append(keyReservations[keyID], res)
+			if status == "refused" {
+				refused[keyID]++
+			}
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Error querying reservations: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		rows, err = db.Query(`
+			SELECT k.id, k.name, COALESCE(kc.id, 0), COALESCE(kc.serial, ''), COALESCE(kc.staff_id, 0)
+			FROM keys k
+			LEFT JOIN key_copies kc ON kc.key_id = k.id AND kc.status = 'active'
+			ORDER BY k.id, kc.id`)
+		if err != nil {
+			log.Printf("Error querying key copies: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		recommendations := []*CopyRecommendation{}
+		byKey := map[int]*CopyRecommendation{}
+		for rows.Next() {
+			var keyID, copyID, staffID int
+			var name, serial string
+			if err := rows.Scan(&keyID, &name, &copyID, &serial, &staffID); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			rec, ok := byKey[keyID]
+			if !ok {
+				rec = &CopyRecommendation{KeyID: keyID, Name: name, IdleCopies: []IdleCopy{}, Reasons: []string{}}
+				byKey[keyID] = rec
+				recommendations = append(recommendations, rec)
+			}
+			if copyID == 0 {
+				continue
+			}
+			rec.Copies++
+			if staffID == 0 && !loaned[copyID] {
+				rec.IdleCopies = append(rec.IdleCopies, IdleCopy{KeyCopyID: copyID, Serial: serial})
+			}
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Error querying key copies: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		for _, rec := range recommendations {
+			rec.PeakLoans = peakConcurrent(keyLoans[rec.KeyID])
+			rec.PeakReservations = peakConcurrent(keyReservations[rec.KeyID])
+			rec.RefusedReservations = refused[rec.KeyID]
+
+			// With no copies the key was never available
+			unavailable := end.Sub(from)
+			if rec.Copies > 0 {
+				unavailable = saturatedFor(keyLoans[rec.KeyID], rec.Copies)
+			}
+			rec.UnavailableHours = math.Round(unavailable.Hours()*100) / 100
+
+			rec.Recommended = 1
+			if rec.PeakLoans > rec.Recommended {
+				rec.Recommended = rec.PeakLoans
+				rec.Reasons = append(rec.Reasons, fmt.Sprintf("Up to %d copies were out at once", rec.PeakLoans))
+			}
+			if rec.PeakReservations > rec.Recommended {
+				rec.Recommended = rec.PeakReservations
+				rec.Reasons = append(rec.Reasons, fmt.Sprintf("Up to %d reservations were wanted at once", rec.PeakReservations))
+			}
+			if rec.RefusedReservations > 0 {
+				rec.Reasons = append(rec.Reasons, fmt.Sprintf("%d reservations were refused for lack of a copy", rec.RefusedReservations))
+			}
+			if rec.Copies == 0 {
+				rec.Reasons = append(rec.Reasons, "Key has no copies")
+			} else if unavailable > 0 {
+				rec.Reasons = append(rec.Reasons, fmt.Sprintf("No copy was available for %.1f hours", unavailable.Hours()))
+				// Demand we couldn't see while every copy was out
+				if unavailable.Hours() >= end.Sub(from).Hours()*copyShortageShare && rec.Recommended <= rec.Copies {
+					rec.Recommended = rec.Copies + 1
+				}
+			}
+
+			switch {
+			case rec.Recommended > rec.Copies:
+				rec.Action = "add"
+			case rec.Recommended < rec.Copies:
+				rec.Action = "reduce"
+				rec.Surplus = rec.Copies - rec.Recommended
+				rec.Reasons = append(rec.Reasons, fmt.Sprintf("%d copies are more than demand needs", rec.Surplus))
+			default:
+				rec.Action = "keep"
+			}
+			if len(rec.IdleCopies) > 0 && rec.Surplus > 0 {
+				rec.Reasons = append(rec.Reasons, fmt.Sprintf("%d copies were never taken out", len(rec.IdleCopies)))
+			}
+		}
+
+		order := map[string]int{"add": 0, "reduce": 1, "keep": 2}
+		sort.SliceStable(recommendations, func(i, j int) bool {
+			a, b := recommendations[i], recommendations[j]
+			if order[a.Action] != order[b.Action] {
+				return order[a.Action] < order[b.Action]
+			}
+			if a.Action == "reduce" {
+				return a.Surplus > b.Surplus
+			}
+			return a.Recommended-a.Copies > b.Recommended-b.Copies
+		})
+
+		json.NewEncoder(w).Encode(recommendations)
+	}
+}
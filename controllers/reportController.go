@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+type ExpiredAssignment struct {
+	KeyCopyID int       `json:"key_copy_id"`
+	KeyID     int       `json:"key_id"`
+	KeyName   string    `json:"key_name"`
+	StaffID   int       `json:"staff_id"`
+	StaffName string    `json:"staff_name"`
+	StaffType string    `json:"staff_type"`
+	ExpiredAt time.Time `json:"expired_at"`
+	DaysOver  int       `json:"days_over"`
+}
+
+// Get copies whose assignment has expired but which have not been returned
+func GetExpiredAssignments(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`
+			SELECT kc.id, kc.key_id, k.name, kc.staff_id, s.name, s.staff_type, COALESCE(kc.expires_at, s.valid_until) AS expired_at
+			FROM key_copies kc
+			JOIN keys k ON kc.key_id = k.id
+			JOIN staffs s ON kc.staff_id = s.id
+			WHERE kc.expired
+			ORDER BY expired_at`)
+		if err != nil {
+			log.Printf("Error querying expired assignments: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		assignments := []ExpiredAssignment{}
+		for rows.Next() {
+			var a ExpiredAssignment
+			if err := rows.Scan(&a.KeyCopyID, &a.KeyID, &a.KeyName, &a.StaffID, &a.StaffName, &a.StaffType, &a.ExpiredAt); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			a.DaysOver = int(time.Since(a.ExpiredAt).Hours() / 24)
+			assignments = append(assignments, a)
+		}
+
+		json.NewEncoder(w).Encode(assignments)
+	}
+}
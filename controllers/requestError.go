@@ -0,0 +1,26 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+)
+
+// requestError is a request the API refuses, with the status to refuse it with
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e requestError) Error() string {
+	return e.message
+}
+
+// writeRequestError sends err to the client if it is a requestError, reporting whether it did
+func writeRequestError(w http.ResponseWriter, err error) bool {
+	var reqErr requestError
+	if !errors.As(err, &reqErr) {
+		return false
+	}
+	http.Error(w, reqErr.message, reqErr.status)
+	return true
+}
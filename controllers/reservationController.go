@@ -0,0 +1,420 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"go-app-be/models"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type AvailabilitySlot struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	FreeCopies  int       `json:"free_copies"`
+	FreeCopyIDs []int     `json:"free_copy_ids"`
+}
+
+type KeyAvailability struct {
+	KeyID       int                `json:"key_id"`
+	TotalCopies int                `json:"total_copies"`
+	Slots       []AvailabilitySlot `json:"slots"`
+}
+
+const maxAvailabilitySlots = 500
+
+// parseTime accepts RFC3339 timestamps, minute precision timestamps and plain dates
+func parseTime(value string) (time.Time, error) {
+	layouts := []string{time.RFC3339, "2006-01-02T15:04Z07:00", "2006-01-02"}
+
+	var err error
+	for _, layout := range layouts {
+		var t time.Time
+		if t, err = time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// keyCopiesForKey loads every copy of a key that is not lost, with 0 as the staff ID of copies in stock
+func keyCopiesForKey(q queryer, keyID int) ([]models.KeyCopy, error) {
+	rows, err := q.Query("SELECT id, key_id, COALESCE(staff_id, 0) FROM key_copies WHERE key_id = $1 AND status = 'active' ORDER BY id", keyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var copies []models.KeyCopy
+	for rows.Next() {
+		var kc models.KeyCopy
+		if err := rows.Scan(&kc.ID, &kc.KeyID, &kc.StaffID); err != nil {
+			return nil, err
+		}
+		copies = append(copies, kc)
+	}
+	return copies, rows.Err()
+}
+
+// reservationConflict reports whether the key copy has an active reservation overlapping the window
+func reservationConflict(q queryer, keyCopyID int, start, end time.Time) (bool, error) {
+	var exists bool
+	err := q.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM key_reservations
+			WHERE key_copy_id = $1 AND status = 'active'
+			AND start_time < $3 AND end_time > $2
+		)`, keyCopyID, start, end).Scan(&exists)
+	return exists, err
+}
+
+// reservedByOther reports whether someone other than staffID holds an active reservation on the copy at the given time
+func reservedByOther(q queryer, keyCopyID, staffID int, at time.Time) (bool, error) {
+	var exists bool
+	err := q.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM key_reservations
+			WHERE key_copy_id = $1 AND status = 'active' AND staff_id <> $2
+			AND start_time <= $3 AND end_time > $3
+		)`, keyCopyID, staffID, at).Scan(&exists)
+	return exists, err
+}
+
+// copyFreeForReservation checks a copy against active loans and existing reservations
+func copyFreeForReservation(q queryer, kc models.KeyCopy, staffID int, start, end time.Time) (bool, error) {
+	// A copy on loan to someone else has no return date, so it cannot be promised to anyone
+	if kc.StaffID != 0 && kc.StaffID != staffID {
+		return false, nil
+	}
+
+	conflict, err := reservationConflict(q, kc.ID, start, end)
+	if err != nil {
+		return false, err
+	}
+	return !conflict, nil
+}
+
+// Get active reservations for a key
+func GetReservations(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		rows, err := db.Query(`
+			SELECT id, key_id, key_copy_id, staff_id, start_time, end_time, status
+			FROM key_reservations
+			WHERE key_id = $1 AND status = 'active' AND end_time > NOW()
+			ORDER BY start_time`, id)
+		if err != nil {
+			log.Printf("Error querying reservations: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		reservations := []models.Reservation{}
+		for rows.Next() {
+			var res models.Reservation
+			if err := rows.Scan(&res.ID, &res.KeyID, &res.KeyCopyID, &res.StaffID, &res.StartTime, &res.EndTime, &res.Status); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			reservations = append(reservations, res)
+		}
+
+		json.NewEncoder(w).Encode(reservations)
+	}
+}
+
+// Reserve a copy of a key for a time slot
+func CreateReservation(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		keyID, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Invalid key ID", http.StatusBadRequest)
+			return
+		}
+
+		var res models.Reservation
+		if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if res.StaffID == 0 {
+			http.Error(w, "staff_id is required", http.StatusBadRequest)
+			return
+		}
+		if !res.EndTime.After(res.StartTime) {
+			http.Error(w, "end_time must be after start_time", http.StatusBadRequest)
+			return
+		}
+		if !res.EndTime.After(time.Now()) {
+			http.Error(w, "Reservation must end in the future", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		// Lock the key so concurrent reservations for it are checked one at a time
+		err = tx.QueryRow("SELECT id FROM keys WHERE id = $1 FOR UPDATE", keyID).Scan(&res.KeyID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Key not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving key: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		var exists bool
+		err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM staffs WHERE id = $1)", res.StaffID).Scan(&exists)
+		if err != nil {
+			log.Printf("Error checking staff existence: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Staff ID does not exist", http.StatusBadRequest)
+			return
+		}
+
+		copies, err := keyCopiesForKey(tx, keyID)
+		if err != nil {
+			log.Printf("Error retrieving key copies (key_id=%d): %v", keyID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if res.KeyCopyID != 0 {
+			var requested *models.KeyCopy
+			for i := range copies {
+				if copies[i].ID == res.KeyCopyID {
+					requested = &copies[i]
+				}
+			}
+			if requested == nil {
+				http.Error(w, "Key copy does not belong to this key", http.StatusBadRequest)
+				return
+			}
+
+			free, err := copyFreeForReservation(tx, *requested, res.StaffID, res.StartTime, res.EndTime)
+			if err != nil {
+				log.Printf("Error checking reservation conflicts: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if !free {
+				http.Error(w, "Key copy is not available for the requested time slot", http.StatusConflict)
+				return
+			}
+		} else {
+			for _, kc := range copies {
+				free, err := copyFreeForReservation(tx, kc, res.StaffID, res.StartTime, res.EndTime)
+				if err != nil {
+					log.Printf("Error checking reservation conflicts: %v", err)
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+				if free {
+					res.KeyCopyID = kc.ID
+					break
+				}
+			}
+			if res.KeyCopyID == 0 {
+				// Keep the refused request so copy-count recommendations can see demand we couldn't meet
+				_, err = tx.Exec(
+					"INSERT INTO key_reservations (key_id, staff_id, start_time, end_time, status) VALUES ($1, $2, $3, $4, 'refused')",
+					res.KeyID, res.StaffID, res.StartTime, res.EndTime,
+				)
+				if err == nil {
+					err = tx.Commit()
+				}
+				if err != nil {
+					log.Printf("Error recording refused reservation: %v", err)
+				}
+				http.Error(w, "No key copy is available for the requested time slot", http.StatusConflict)
+				return
+			}
+		}
+
+		err = tx.QueryRow(
+			"INSERT INTO key_reservations (key_id, key_copy_id, staff_id, start_time, end_time) VALUES ($1, $2, $3, $4, $5) RETURNING id, status",
+			res.KeyID, res.KeyCopyID, res.StaffID, res.StartTime, res.EndTime,
+		).Scan(&res.ID, &res.Status)
+		if err != nil {
+			log.Printf("Error creating reservation: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing reservation: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// Cancel a reservation
+func CancelReservation(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+		reservationID := vars["reservationId"]
+
+		result, err := db.Exec(
+			"UPDATE key_reservations SET status = 'cancelled' WHERE id = $1 AND key_id = $2 AND status = 'active'",
+			reservationID, id,
+		)
+		if err != nil {
+			log.Printf("Error cancelling reservation: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			http.Error(w, "Reservation not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Reservation cancelled successfully"})
+	}
+}
+
+// Get free copies of a key per time slot
+func GetKeyAvailability(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		keyID, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Invalid key ID", http.StatusBadRequest)
+			return
+		}
+
+		from := time.Now().Truncate(time.Hour)
+		if v := r.URL.Query().Get("from"); v != "" {
+			if from, err = parseTime(v); err != nil {
+				http.Error(w, "Invalid from parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		to := from.Add(24 * time.Hour)
+		if v := r.URL.Query().Get("to"); v != "" {
+			if to, err = parseTime(v); err != nil {
+				http.Error(w, "Invalid to parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		if !to.After(from) {
+			http.Error(w, "to must be after from", http.StatusBadRequest)
+			return
+		}
+
+		slotMinutes, err := strconv.Atoi(r.URL.Query().Get("slotMinutes"))
+		if err != nil || slotMinutes <= 0 {
+			slotMinutes = 60
+		}
+		slot := time.Duration(slotMinutes) * time.Minute
+		if to.Sub(from)/slot > maxAvailabilitySlots {
+			http.Error(w, "Too many slots requested, widen slotMinutes or narrow the range", http.StatusBadRequest)
+			return
+		}
+
+		var exists bool
+		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM keys WHERE id = $1)", keyID).Scan(&exists)
+		if err != nil {
+			log.Printf("Error checking key existence: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+
+		copies, err := keyCopiesForKey(db, keyID)
+		if err != nil {
+			log.Printf("Error retrieving key copies (key_id=%d): %v", keyID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT key_copy_id, start_time, end_time
+			FROM key_reservations
+			WHERE key_id = $1 AND status = 'active' AND start_time < $3 AND end_time > $2`,
+			keyID, from, to)
+		if err != nil {
+			log.Printf("Error querying reservations: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		var reservations []models.Reservation
+		for rows.Next() {
+			var res models.Reservation
+			if err := rows.Scan(&res.KeyCopyID, &res.StartTime, &res.EndTime); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			reservations = append(reservations, res)
+		}
+
+		availability := KeyAvailability{KeyID: keyID, TotalCopies: len(copies)}
+		for start := from; start.Before(to); start = start.Add(slot) {
+			end := start.Add(slot)
+			if end.After(to) {
+				end = to
+			}
+
+			s := AvailabilitySlot{Start: start, End: end, FreeCopyIDs: []int{}}
+			for _, kc := range copies {
+				if kc.StaffID != 0 {
+					continue
+				}
+
+				reserved := false
+				for _, res := range reservations {
+					if res.KeyCopyID == kc.ID && res.StartTime.Before(end) && res.EndTime.After(start) {
+						reserved = true
+						break
+					}
+				}
+				if !reserved {
+					s.FreeCopyIDs = append(s.FreeCopyIDs, kc.ID)
+				}
+			}
+			s.FreeCopies = len(s.FreeCopyIDs)
+			availability.Slots = append(availability.Slots, s)
+		}
+
+		json.NewEncoder(w).Encode(availability)
+	}
+}
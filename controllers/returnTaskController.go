@@ -0,0 +1,170 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-app-be/models"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type returnTaskCompletion struct {
+	StaffID int `json:"staff_id"`
+}
+
+const returnTaskColumns = "id, key_copy_id, staff_id, reason, status, created_at, due_at, completed_at"
+
+func scanReturnTask(row rowScanner) (models.ReturnTask, error) {
+	var t models.ReturnTask
+	err := row.Scan(&t.ID, &t.KeyCopyID, &t.StaffID, &t.Reason, &t.Status, &t.CreatedAt, &t.DueAt, &t.CompletedAt)
+	return t, err
+}
+
+// openReturnTask asks a holder to bring a copy back and returns the new task's ID
+func openReturnTask(q queryer, keyCopyID, staffID int, reason string, dueAt *time.Time) (int, error) {
+	var id int
+	err := q.QueryRow(
+		"INSERT INTO return_tasks (key_copy_id, staff_id, reason, due_at) VALUES ($1, $2, $3, $4) RETURNING id",
+		keyCopyID, staffID, reason, dueAt,
+	).Scan(&id)
+	return id, err
+}
+
+// returnKeyCopy puts a copy back in stock and records it in the copy history
+func returnKeyCopy(q queryer, keyCopyID, keyID, previousStaffID, performedBy int, note string) error {
+	_, err := q.Exec(
+		"UPDATE key_copies SET staff_id = 0, witness_staff_id = NULL, expires_at = NULL, expired = FALSE WHERE id = $1",
+		keyCopyID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return recordKeyCopyHistory(q, models.KeyCopyHistory{
+		KeyCopyID:       keyCopyID,
+		KeyID:           keyID,
+		Action:          "returned",
+		PreviousStaffID: previousStaffID,
+		PerformedBy:     performedBy,
+		Note:            note,
+	})
+}
+
+// Get return tasks, optionally filtered by status and holder
+func GetReturnTasks(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := "SELECT " + returnTaskColumns + " FROM return_tasks WHERE 1=1"
+		var queryParams []interface{}
+
+		if status := r.URL.Query().Get("status"); status != "" {
+			queryParams = append(queryParams, status)
+			query += " AND status = $" + strconv.Itoa(len(queryParams))
+		}
+		if staffID := r.URL.Query().Get("staff_id"); staffID != "" {
+			queryParams = append(queryParams, staffID)
+			query += " AND staff_id = $" + strconv.Itoa(len(queryParams))
+		}
+		query += " ORDER BY created_at"
+
+		rows, err := db.Query(query, queryParams...)
+		if err != nil {
+			log.Printf("Error querying return tasks: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		tasks := []models.ReturnTask{}
+		for rows.Next() {
+			t, err := scanReturnTask(rows)
+			if err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			tasks = append(tasks, t)
+		}
+
+		json.NewEncoder(w).Encode(tasks)
+	}
+}
+
+// Complete a return task, putting the copy back in stock if the holder still has it
+func CompleteReturnTask(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		var req returnTaskCompletion
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		t, err := scanReturnTask(tx.QueryRow("SELECT "+returnTaskColumns+" FROM return_tasks WHERE id = $1 FOR UPDATE", id))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Return task not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving return task: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if t.Status != "open" {
+			http.Error(w, "Return task is not open", http.StatusConflict)
+			return
+		}
+
+		var kc models.KeyCopy
+		err = tx.QueryRow(
+			"SELECT id, key_id, COALESCE(staff_id, 0) FROM key_copies WHERE id = $1 FOR UPDATE",
+			t.KeyCopyID,
+		).Scan(&kc.ID, &kc.KeyID, &kc.StaffID)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error retrieving key copy: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// A copy that was deleted or has already changed hands needs nothing more from this holder
+		if err == nil && kc.StaffID == t.StaffID {
+			err = returnKeyCopy(tx, kc.ID, kc.KeyID, kc.StaffID, req.StaffID, fmt.Sprintf("Returned for return task #%d", t.ID))
+			if err != nil {
+				log.Printf("Error returning key copy: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		t.Status = "completed"
+		err = tx.QueryRow(
+			"UPDATE return_tasks SET status = $1, completed_at = NOW() WHERE id = $2 RETURNING completed_at",
+			t.Status, t.ID,
+		).Scan(&t.CompletedAt)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error completing return task: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(t)
+	}
+}
@@ -11,7 +11,29 @@ import (
 	"github.com/gorilla/mux"
 )
 
-// Get all staffs with pagination and name filter
+var staffTypes = map[string]bool{"employee": true, "contractor": true, "visitor": true}
+
+// validateStaff defaults the staff type and checks the validity window, returning a message when invalid
+func validateStaff(s *models.Staff) string {
+	if s.StaffType == "" {
+		s.StaffType = "employee"
+	}
+	if !staffTypes[s.StaffType] {
+		return "staff_type must be employee, contractor or visitor"
+	}
+	if s.StaffType != "employee" && s.ValidUntil == nil {
+		return "valid_until is required for contractors and visitors"
+	}
+	if s.ValidFrom != nil && s.ValidUntil != nil && !s.ValidUntil.After(*s.ValidFrom) {
+		return "valid_until must be after valid_from"
+	}
+	if s.ClearanceLevel < 0 {
+		return "clearance_level cannot be negative"
+	}
+	return ""
+}
+
+// Get all staffs with pagination and name filter, or all matching staffs as CSV or XLSX
 func GetStaffs(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -38,6 +60,22 @@ func GetStaffs(db *sql.DB) http.HandlerFunc {
 			queryParams = append(queryParams, nameParam)
 		}
 
+		// Exports skip pagination and stream every matching staff member
+		format, ok := exportFormat(r)
+		if !ok {
+			http.Error(w, "format must be json, csv or xlsx", http.StatusBadRequest)
+			return
+		}
+		if format != "" {
+			exportQuery(db, w, format, "staffs",
+				[]string{"ID", "Name", "Role", "Staff Type", "Valid From", "Valid Until", "Clearance Level", "Manager ID", "External ID"}, `
+				SELECT staffs.id, staffs.name, staffs.role, staffs.staff_type, staffs.valid_from, staffs.valid_until, staffs.clearance_level, staffs.manager_id, staffs.external_id
+				FROM staffs
+			`+whereClause+`
+				ORDER BY staffs.id`, queryParams...)
+			return
+		}
+
 		countQuery := "SELECT COUNT(*) FROM staffs " + whereClause
 		var total int
 		err = db.QueryRow(countQuery, queryParams...).Scan(&total)
@@ -51,7 +89,7 @@ func GetStaffs(db *sql.DB) http.HandlerFunc {
 
 		// Join with the staffs table to get the staff_name
 		selectQuery := `
-			SELECT staffs.id, staffs.name, staffs.role
+			SELECT staffs.id, staffs.name, staffs.role, staffs.staff_type, staffs.valid_from, staffs.valid_until, staffs.clearance_level, COALESCE(staffs.manager_id, 0), COALESCE(staffs.external_id, '')
 			FROM staffs
 		` + whereClause + `
 			ORDER BY staffs.id 
@@ -66,19 +104,11 @@ func GetStaffs(db *sql.DB) http.HandlerFunc {
 		}
 		defer rows.Close()
 
-		var staffs []struct {
-			ID   int    `json:"id"`
-			Name string `json:"name"`
-			Role string `json:"role"`
-		}
+		var staffs []models.Staff
 
 		for rows.Next() {
-			var s struct {
-				ID   int    `json:"id"`
-				Name string `json:"name"`
-				Role string `json:"role"`
-			}
-			if err := rows.Scan(&s.ID, &s.Name, &s.Role); err != nil {
+			var s models.Staff
+			if err := rows.Scan(&s.ID, &s.Name, &s.Role, &s.StaffType, &s.ValidFrom, &s.ValidUntil, &s.ClearanceLevel, &s.ManagerID, &s.ExternalID); err != nil {
 				log.Printf("Error scanning row: %v", err)
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
 				return
@@ -112,11 +142,43 @@ func GetStaffs(db *sql.DB) http.HandlerFunc {
 func CreateStaff(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var s models.Staff
-		json.NewDecoder(r.Body).Decode(&s)
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if msg := validateStaff(&s); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		// Verify manager exists if manager_id is provided
+		if s.ManagerID != 0 {
+			var exists bool
+			err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM staffs WHERE id = $1)", s.ManagerID).Scan(&exists)
+			if err != nil {
+				log.Printf("Error checking manager existence: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				http.Error(w, "Manager ID does not exist", http.StatusBadRequest)
+				return
+			}
+		}
 
-		err := db.QueryRow("INSERT INTO staffs (name, role) VALUES ($1, $2) RETURNING id", s.Name, s.Role).Scan(&s.ID)
+		err := db.QueryRow(
+			"INSERT INTO staffs (name, role, staff_type, valid_from, valid_until, clearance_level, manager_id, external_id) VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, '')) RETURNING id",
+			s.Name, s.Role, s.StaffType, s.ValidFrom, s.ValidUntil, s.ClearanceLevel, nullableID(s.ManagerID), s.ExternalID,
+		).Scan(&s.ID)
+		if isUniqueViolation(err) {
+			http.Error(w, "external_id is already in use", http.StatusConflict)
+			return
+		}
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("Error creating staff: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
 		}
 
 		json.NewEncoder(w).Encode(s)
@@ -135,6 +197,26 @@ func UpdateStaff(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		if msg := validateStaff(&s); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		// Verify manager exists if manager_id is provided
+		if s.ManagerID != 0 {
+			var exists bool
+			err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM staffs WHERE id = $1)", s.ManagerID).Scan(&exists)
+			if err != nil {
+				log.Printf("Error checking manager existence: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				http.Error(w, "Manager ID does not exist", http.StatusBadRequest)
+				return
+			}
+		}
+
 		// Verify staff exists
 		var existingStaff models.Staff
 		err := db.QueryRow(
@@ -153,10 +235,14 @@ func UpdateStaff(db *sql.DB) http.HandlerFunc {
 		}
 
 		_, err = db.Exec(
-			"UPDATE staffs SET name = $1, role = $2 WHERE id = $3",
-			s.Name, s.Role, id,
+			"UPDATE staffs SET name = $1, role = $2, staff_type = $3, valid_from = $4, valid_until = $5, clearance_level = $6, manager_id = $7, external_id = NULLIF($8, '') WHERE id = $9",
+			s.Name, s.Role, s.StaffType, s.ValidFrom, s.ValidUntil, s.ClearanceLevel, nullableID(s.ManagerID), s.ExternalID, id,
 		)
 
+		if isUniqueViolation(err) {
+			http.Error(w, "external_id is already in use", http.StatusConflict)
+			return
+		}
 		if err != nil {
 			log.Printf("Error updating key: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
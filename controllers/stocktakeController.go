@@ -0,0 +1,512 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-app-be/models"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type stocktakeRequest struct {
+	OperatorID int `json:"operator_id"`
+	KeyID      int `json:"key_id"`
+}
+
+type stocktakeScanRequest struct {
+	KeyCopyID int `json:"key_copy_id"`
+	// StaffID is who the copy was found with, 0 when it was found in the cabinet
+	StaffID int `json:"staff_id"`
+}
+
+type stocktakeCorrection struct {
+	KeyCopyID int `json:"key_copy_id"`
+	// Action is "mark_lost", "mark_found" or "fix_holder"
+	Action  string `json:"action"`
+	StaffID int    `json:"staff_id"`
+}
+
+type stocktakeClose struct {
+	OperatorID  int                   `json:"operator_id"`
+	Corrections []stocktakeCorrection `json:"corrections"`
+	clearanceOverride
+}
+
+type StocktakeDiscrepancy struct {
+	KeyCopyID       int    `json:"key_copy_id"`
+	KeyID           int    `json:"key_id"`
+	KeyName         string `json:"key_name"`
+	Status          string `json:"status"`
+	ExpectedStaffID int    `json:"expected_staff_id"`
+	ObservedStaffID int    `json:"observed_staff_id"`
+}
+
+type StocktakeResult struct {
+	Session     models.StocktakeSession `json:"session"`
+	Scanned     int                     `json:"scanned"`
+	Missing     []StocktakeDiscrepancy  `json:"missing"`
+	Unexpected  []StocktakeDiscrepancy  `json:"unexpected"`
+	Misassigned []StocktakeDiscrepancy  `json:"misassigned"`
+}
+
+const stocktakeColumns = "id, operator_id, COALESCE(key_id, 0), status, created_at, closed_at"
+
+func scanStocktake(row rowScanner) (models.StocktakeSession, error) {
+	var s models.StocktakeSession
+	err := row.Scan(&s.ID, &s.OperatorID, &s.KeyID, &s.Status, &s.CreatedAt, &s.ClosedAt)
+	return s, err
+}
+
+// compareStocktake reconciles a session's scans against key_copies. Copies expected in the cabinet
+// but not scanned are missing, scanned copies the database has elsewhere (or lost) are unexpected,
+// and copies found with a different staff member than recorded are misassigned.
+func compareStocktake(q queryer, session models.StocktakeSession) (StocktakeResult, error) {
+	result := StocktakeResult{
+		Session:     session,
+		Missing:     []StocktakeDiscrepancy{},
+		Unexpected:  []StocktakeDiscrepancy{},
+		Misassigned: []StocktakeDiscrepancy{},
+	}
+
+	rows, err := q.Query(`
+		SELECT kc.id, kc.key_id, k.name, kc.status, COALESCE(kc.staff_id, 0), sc.key_copy_id IS NOT NULL, COALESCE(sc.observed_staff_id, 0)
+		FROM key_copies kc
+		JOIN keys k ON k.id = kc.key_id
+		LEFT JOIN stocktake_scans sc ON sc.key_copy_id = kc.id AND sc.session_id = $1
+		WHERE $2 = 0 OR kc.key_id = $2
+		ORDER BY kc.id`, session.ID, session.KeyID)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d StocktakeDiscrepancy
+		var scanned bool
+		if err := rows.Scan(&d.KeyCopyID, &d.KeyID, &d.KeyName, &d.Status, &d.ExpectedStaffID, &scanned, &d.ObservedStaffID); err != nil {
+			return result, err
+		}
+
+		switch {
+		case !scanned:
+			if d.ExpectedStaffID == 0 && d.Status == "active" {
+				result.Missing = append(result.Missing, d)
+			}
+		case d.Status != "active":
+			result.Scanned++
+			result.Unexpected = append(result.Unexpected, d)
+		case d.ObservedStaffID == d.ExpectedStaffID:
+			result.Scanned++
+		case d.ObservedStaffID == 0:
+			result.Scanned++
+			result.Unexpected = append(result.Unexpected, d)
+		default:
+			result.Scanned++
+			result.Misassigned = append(result.Misassigned, d)
+		}
+	}
+	return result, rows.Err()
+}
+
+// Open a stocktake session, optionally limited to the copies of one key
+func CreateStocktake(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req stocktakeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if req.OperatorID == 0 {
+			http.Error(w, "operator_id is required", http.StatusBadRequest)
+			return
+		}
+
+		var exists bool
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM staffs WHERE id = $1)", req.OperatorID).Scan(&exists)
+		if err != nil {
+			log.Printf("Error checking staff existence: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Staff ID does not exist", http.StatusBadRequest)
+			return
+		}
+
+		// Verify key exists if key_id is provided
+		if req.KeyID != 0 {
+			err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM keys WHERE id = $1)", req.KeyID).Scan(&exists)
+			if err != nil {
+				log.Printf("Error checking key existence: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				http.Error(w, "Key ID does not exist", http.StatusBadRequest)
+				return
+			}
+		}
+
+		session, err := scanStocktake(db.QueryRow(
+			"INSERT INTO stocktake_sessions (operator_id, key_id) VALUES ($1, $2) RETURNING "+stocktakeColumns,
+			req.OperatorID, nullableID(req.KeyID),
+		))
+		if err != nil {
+			log.Printf("Error creating stocktake: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(session)
+	}
+}
+
+// Get a stocktake session with its discrepancies against the database
+func GetStocktake(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		session, err := scanStocktake(db.QueryRow("SELECT "+stocktakeColumns+" FROM stocktake_sessions WHERE id = $1", id))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Stocktake not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving stocktake: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		result, err := compareStocktake(db, session)
+		if err != nil {
+			log.Printf("Error comparing stocktake: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// Record a copy as found during a stocktake. Scanning the same copy again replaces the earlier scan.
+func CreateStocktakeScan(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		var req stocktakeScanRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		session, err := scanStocktake(db.QueryRow("SELECT "+stocktakeColumns+" FROM stocktake_sessions WHERE id = $1", id))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Stocktake not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving stocktake: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+		if session.Status != "open" {
+			http.Error(w, "Stocktake is closed", http.StatusConflict)
+			return
+		}
+
+		var keyID int
+		err = db.QueryRow("SELECT key_id FROM key_copies WHERE id = $1", req.KeyCopyID).Scan(&keyID)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error retrieving key copy: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err == sql.ErrNoRows {
+			http.Error(w, "Key copy does not exist", http.StatusBadRequest)
+			return
+		}
+		if session.KeyID != 0 && keyID != session.KeyID {
+			http.Error(w, "Key copy is outside the scope of this stocktake", http.StatusBadRequest)
+			return
+		}
+
+		if req.StaffID != 0 {
+			var exists bool
+			if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM staffs WHERE id = $1)", req.StaffID).Scan(&exists); err != nil {
+				log.Printf("Error checking staff existence: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				http.Error(w, "Staff ID does not exist", http.StatusBadRequest)
+				return
+			}
+		}
+
+		scan := models.StocktakeScan{SessionID: session.ID, KeyCopyID: req.KeyCopyID, ObservedStaffID: req.StaffID}
+		err = db.QueryRow(`
+			INSERT INTO stocktake_scans (session_id, key_copy_id, observed_staff_id)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (session_id, key_copy_id) DO UPDATE SET observed_staff_id = EXCLUDED.observed_staff_id, scanned_at = NOW()
+			RETURNING id, scanned_at`,
+			scan.SessionID, scan.KeyCopyID, scan.ObservedStaffID,
+		).Scan(&scan.ID, &scan.ScannedAt)
+		if err != nil {
+			log.Printf("Error recording scan: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(scan)
+	}
+}
+
+// Untick a copy scanned by mistake
+func DeleteStocktakeScan(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+		keyCopyID := vars["keyCopyId"]
+
+		result, err := db.Exec(`
+			DELETE FROM stocktake_scans
+			WHERE session_id = $1 AND key_copy_id = $2
+			AND EXISTS(SELECT 1 FROM stocktake_sessions WHERE id = $1 AND status = 'open')`,
+			id, keyCopyID)
+		if err != nil {
+			log.Printf("Error deleting scan: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			http.Error(w, "Scan not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"message": "Scan deleted successfully"})
+	}
+}
+
+// Close a stocktake, applying any corrections in the same transaction
+func CloseStocktake(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		var req stocktakeClose
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		session, err := scanStocktake(tx.QueryRow("SELECT "+stocktakeColumns+" FROM stocktake_sessions WHERE id = $1 FOR UPDATE", id))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Stocktake not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving stocktake: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+		if session.Status != "open" {
+			http.Error(w, "Stocktake is already closed", http.StatusConflict)
+			return
+		}
+
+		if len(req.Corrections) > 0 {
+			if req.OperatorID == 0 {
+				http.Error(w, "operator_id is required to apply corrections", http.StatusBadRequest)
+				return
+			}
+
+			var exists bool
+			if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM staffs WHERE id = $1)", req.OperatorID).Scan(&exists); err != nil {
+				log.Printf("Error checking staff existence: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				http.Error(w, "Staff ID does not exist", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Corrections may only touch the copies this stocktake flagged
+		before, err := compareStocktake(tx, session)
+		if err != nil {
+			log.Printf("Error comparing stocktake: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		flagged := map[int]bool{}
+		for _, list := range [][]StocktakeDiscrepancy{before.Missing, before.Unexpected, before.Misassigned} {
+			for _, d := range list {
+				flagged[d.KeyCopyID] = true
+			}
+		}
+
+		note := fmt.Sprintf("Corrected by stocktake #%d", session.ID)
+		for _, c := range req.Corrections {
+			var kc models.KeyCopy
+			err := tx.QueryRow(
+				"SELECT id, key_id, COALESCE(staff_id, 0), status, expires_at, expired FROM key_copies WHERE id = $1 FOR UPDATE",
+				c.KeyCopyID,
+			).Scan(&kc.ID, &kc.KeyID, &kc.StaffID, &kc.Status, &kc.ExpiresAt, &kc.Expired)
+			if err == sql.ErrNoRows {
+				http.Error(w, fmt.Sprintf("Key copy %d does not exist", c.KeyCopyID), http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				log.Printf("Error retrieving key copy: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if session.KeyID != 0 && kc.KeyID != session.KeyID {
+				http.Error(w, fmt.Sprintf("Key copy %d is not part of this stocktake", kc.ID), http.StatusBadRequest)
+				return
+			}
+			if !flagged[kc.ID] {
+				http.Error(w, fmt.Sprintf("Key copy %d has no discrepancy in this stocktake", kc.ID), http.StatusBadRequest)
+				return
+			}
+
+			h := models.KeyCopyHistory{
+				KeyCopyID:       kc.ID,
+				KeyID:           kc.KeyID,
+				PreviousStaffID: kc.StaffID,
+				StaffID:         kc.StaffID,
+				PerformedBy:     req.OperatorID,
+				Note:            note,
+			}
+
+			switch c.Action {
+			case "mark_lost":
+				_, err = tx.Exec("UPDATE key_copies SET status = 'lost' WHERE id = $1", kc.ID)
+				h.Action = "marked_lost"
+			case "mark_found":
+				_, err = tx.Exec("UPDATE key_copies SET status = 'active' WHERE id = $1", kc.ID)
+				h.Action = "marked_found"
+			case "fix_holder":
+				if c.StaffID != 0 {
+					var exists bool
+					if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM staffs WHERE id = $1)", c.StaffID).Scan(&exists); err != nil {
+						log.Printf("Error checking staff existence: %v", err)
+						http.Error(w, "Internal server error", http.StatusInternalServerError)
+						return
+					}
+					if !exists {
+						http.Error(w, fmt.Sprintf("Staff ID %d does not exist", c.StaffID), http.StatusBadRequest)
+						return
+					}
+				}
+				// A new holder goes through the same checks as a reassignment
+				expiresAt, expired := kc.ExpiresAt, kc.Expired
+				if c.StaffID != kc.StaffID {
+					expiresAt, expired = nil, false
+				}
+				if c.StaffID != 0 && c.StaffID != kc.StaffID {
+					dual, err := isDualControl(tx, kc.KeyID)
+					if err != nil {
+						log.Printf("Error checking dual control: %v", err)
+						http.Error(w, "Internal server error", http.StatusInternalServerError)
+						return
+					}
+					if dual {
+						http.Error(w, dualControlMessage, http.StatusConflict)
+						return
+					}
+
+					_, msg, err := checkClearance(tx, c.StaffID, kc.KeyID, req.clearanceOverride)
+					if err != nil {
+						log.Printf("Error checking clearance: %v", err)
+						http.Error(w, "Internal server error", http.StatusInternalServerError)
+						return
+					}
+					if msg != "" {
+						http.Error(w, msg, http.StatusForbidden)
+						return
+					}
+
+					expiresAt, msg, err = assignmentExpiry(tx, c.StaffID, nil)
+					if err != nil {
+						log.Printf("Error checking staff validity: %v", err)
+						http.Error(w, "Internal server error", http.StatusInternalServerError)
+						return
+					}
+					if msg != "" {
+						http.Error(w, msg, http.StatusBadRequest)
+						return
+					}
+				}
+				_, err = tx.Exec(
+					`UPDATE key_copies
+					SET staff_id = $1, status = 'active', witness_staff_id = NULL, expires_at = $2, expired = $3
+					WHERE id = $4`,
+					c.StaffID, expiresAt, expired, kc.ID,
+				)
+				h.Action = "holder_corrected"
+				h.StaffID = c.StaffID
+			default:
+				http.Error(w, fmt.Sprintf("Unknown correction action %q", c.Action), http.StatusBadRequest)
+				return
+			}
+			if err == nil {
+				err = recordKeyCopyHistory(tx, h)
+			}
+			if err == nil {
+				err = recordAudit(tx, models.AuditLog{
+					Action:      "stocktake_correction",
+					PerformedBy: req.OperatorID,
+					Entity:      "key_copy",
+					EntityID:    kc.ID,
+					Details:     fmt.Sprintf("Stocktake #%d: %s", session.ID, h.Action),
+				})
+			}
+			if err != nil {
+				log.Printf("Error applying correction: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		err = tx.QueryRow(
+			"UPDATE stocktake_sessions SET status = 'closed', closed_at = NOW() WHERE id = $1 RETURNING status, closed_at",
+			session.ID,
+		).Scan(&session.Status, &session.ClosedAt)
+		if err != nil {
+			log.Printf("Error closing stocktake: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		result, err := compareStocktake(tx, session)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error closing stocktake: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(result)
+	}
+}
@@ -0,0 +1,475 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-app-be/models"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultTransferWindow is how long a receiver has to accept a transfer when none is given
+const defaultTransferWindow = 24 * time.Hour
+
+type transferRequest struct {
+	FromStaffID      int    `json:"from_staff_id"`
+	ToStaffID        int    `json:"to_staff_id"`
+	Note             string `json:"note"`
+	ExpiresInMinutes int    `json:"expires_in_minutes"`
+	clearanceOverride
+}
+
+type transferResponse struct {
+	StaffID int    `json:"staff_id"`
+	Note    string `json:"note"`
+}
+
+const transferLapsedMessage = "Key copy's assignment has expired, renewing it requires a new approved access request"
+
+// assignmentLapsed reports whether a held copy's assignment has run out, whether or not ExpireAssignments
+// has flagged it yet
+func assignmentLapsed(kc models.KeyCopy) bool {
+	return kc.Expired || (kc.ExpiresAt != nil && !kc.ExpiresAt.After(time.Now()))
+}
+
+const transferColumns = "id, key_copy_id, from_staff_id, to_staff_id, status, COALESCE(note, ''), clearance_overridden, created_at, expires_at, responded_at"
+
+func scanTransfers(rows *sql.Rows) ([]models.KeyCopyTransfer, error) {
+	transfers := []models.KeyCopyTransfer{}
+	for rows.Next() {
+		var t models.KeyCopyTransfer
+		if err := rows.Scan(&t.ID, &t.KeyCopyID, &t.FromStaffID, &t.ToStaffID, &t.Status, &t.Note, &t.ClearanceOverridden, &t.CreatedAt, &t.ExpiresAt, &t.RespondedAt); err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, t)
+	}
+	return transfers, rows.Err()
+}
+
+// ExpireTransfers marks pending transfers past their deadline as expired and records it in the copy history
+func ExpireTransfers(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		UPDATE key_copy_transfers t
+		SET status = 'expired', responded_at = NOW()
+		FROM key_copies kc
+		WHERE kc.id = t.key_copy_id AND t.status = 'pending' AND t.expires_at <= NOW()
+		RETURNING t.id, t.key_copy_id, kc.key_id, t.from_staff_id`)
+	if err != nil {
+		return err
+	}
+
+	var expired []models.KeyCopyHistory
+	for rows.Next() {
+		var transferID int
+		var h models.KeyCopyHistory
+		if err := rows.Scan(&transferID, &h.KeyCopyID, &h.KeyID, &h.StaffID); err != nil {
+			rows.Close()
+			return err
+		}
+		h.Action = "transfer_expired"
+		h.PreviousStaffID = h.StaffID
+		h.Note = fmt.Sprintf("Transfer #%d expired without a response", transferID)
+		expired = append(expired, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, h := range expired {
+		if err := recordKeyCopyHistory(tx, h); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Get transfers for a key copy
+func GetKeyCopyTransfers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		rows, err := db.Query("SELECT "+transferColumns+" FROM key_copy_transfers WHERE key_copy_id = $1 ORDER BY created_at DESC", id)
+		if err != nil {
+			log.Printf("Error querying transfers: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		transfers, err := scanTransfers(rows)
+		if err != nil {
+			log.Printf("Error scanning row: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(transfers)
+	}
+}
+
+// Get incoming and outgoing transfers for a staff member, optionally filtered by status
+func GetStaffTransfers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		query := "SELECT " + transferColumns + " FROM key_copy_transfers WHERE (from_staff_id = $1 OR to_staff_id = $1)"
+		queryParams := []interface{}{id}
+		if status := r.URL.Query().Get("status"); status != "" {
+			query += " AND status = $2"
+			queryParams = append(queryParams, status)
+		}
+		query += " ORDER BY created_at DESC"
+
+		rows, err := db.Query(query, queryParams...)
+		if err != nil {
+			log.Printf("Error querying transfers: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		transfers, err := scanTransfers(rows)
+		if err != nil {
+			log.Printf("Error scanning row: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(transfers)
+	}
+}
+
+// Initiate a transfer of a key copy from its current holder to another staff member
+func CreateTransfer(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		var req transferRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if req.FromStaffID == 0 || req.ToStaffID == 0 {
+			http.Error(w, "from_staff_id and to_staff_id are required", http.StatusBadRequest)
+			return
+		}
+		if req.FromStaffID == req.ToStaffID {
+			http.Error(w, "Cannot transfer a key copy to its current holder", http.StatusBadRequest)
+			return
+		}
+
+		window := defaultTransferWindow
+		if req.ExpiresInMinutes > 0 {
+			window = time.Duration(req.ExpiresInMinutes) * time.Minute
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var kc models.KeyCopy
+		err = tx.QueryRow(
+			"SELECT id, key_id, COALESCE(staff_id, 0), status, expires_at, expired FROM key_copies WHERE id = $1 FOR UPDATE",
+			id,
+		).Scan(&kc.ID, &kc.KeyID, &kc.StaffID, &kc.Status, &kc.ExpiresAt, &kc.Expired)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Key copy not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving key copy: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if kc.StaffID != req.FromStaffID {
+			http.Error(w, "Only the current holder can initiate a transfer", http.StatusForbidden)
+			return
+		}
+		if kc.Status != "active" {
+			http.Error(w, "Key copy is marked "+kc.Status, http.StatusConflict)
+			return
+		}
+		if assignmentLapsed(kc) {
+			http.Error(w, transferLapsedMessage, http.StatusConflict)
+			return
+		}
+
+		dual, err := isDualControl(tx, kc.KeyID)
+		if err != nil {
+			log.Printf("Error checking dual control: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if dual {
+			http.Error(w, dualControlMessage, http.StatusConflict)
+			return
+		}
+
+		var exists bool
+		err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM staffs WHERE id = $1)", req.ToStaffID).Scan(&exists)
+		if err != nil {
+			log.Printf("Error checking staff existence: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Staff ID does not exist", http.StatusBadRequest)
+			return
+		}
+
+		err = tx.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM key_copy_transfers WHERE key_copy_id = $1 AND status = 'pending' AND expires_at > NOW())",
+			kc.ID,
+		).Scan(&exists)
+		if err != nil {
+			log.Printf("Error checking pending transfers: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if exists {
+			http.Error(w, "Key copy already has a pending transfer", http.StatusConflict)
+			return
+		}
+
+		overridden, msg, err := checkClearance(tx, req.ToStaffID, kc.KeyID, req.clearanceOverride)
+		if err != nil {
+			log.Printf("Error checking clearance: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if msg != "" {
+			http.Error(w, msg, http.StatusForbidden)
+			return
+		}
+
+		t := models.KeyCopyTransfer{
+			KeyCopyID:           kc.ID,
+			FromStaffID:         req.FromStaffID,
+			ToStaffID:           req.ToStaffID,
+			Note:                req.Note,
+			ClearanceOverridden: overridden,
+		}
+		err = tx.QueryRow(`
+			INSERT INTO key_copy_transfers (key_copy_id, from_staff_id, to_staff_id, note, clearance_overridden, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id, status, created_at, expires_at`,
+			t.KeyCopyID, t.FromStaffID, t.ToStaffID, t.Note, t.ClearanceOverridden, time.Now().Add(window),
+		).Scan(&t.ID, &t.Status, &t.CreatedAt, &t.ExpiresAt)
+		if err != nil {
+			log.Printf("Error creating transfer: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		err = recordKeyCopyHistory(tx, models.KeyCopyHistory{
+			KeyCopyID:       kc.ID,
+			KeyID:           kc.KeyID,
+			Action:          "transfer_initiated",
+			PreviousStaffID: kc.StaffID,
+			StaffID:         kc.StaffID,
+			PerformedBy:     req.FromStaffID,
+			Note:            fmt.Sprintf("Transfer #%d to staff %d initiated", t.ID, t.ToStaffID),
+		})
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error recording key copy history: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
+	}
+}
+
+// Accept a pending transfer, handing the key copy over to the receiver
+func AcceptTransfer(db *sql.DB) http.HandlerFunc {
+	return respondToTransfer(db, true)
+}
+
+// Decline a pending transfer, leaving the key copy with its current holder
+func DeclineTransfer(db *sql.DB) http.HandlerFunc {
+	return respondToTransfer(db, false)
+}
+
+func respondToTransfer(db *sql.DB, accept bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		var req transferResponse
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var t models.KeyCopyTransfer
+		err = tx.QueryRow("SELECT "+transferColumns+" FROM key_copy_transfers WHERE id = $1 FOR UPDATE", id).Scan(
+			&t.ID, &t.KeyCopyID, &t.FromStaffID, &t.ToStaffID, &t.Status, &t.Note, &t.ClearanceOverridden, &t.CreatedAt, &t.ExpiresAt, &t.RespondedAt,
+		)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Transfer not found", http.StatusNotFound)
+			} else {
+				log.Printf("Error retrieving transfer: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if req.StaffID != t.ToStaffID {
+			http.Error(w, "Only the receiving staff member can respond to this transfer", http.StatusForbidden)
+			return
+		}
+		if t.Status != "pending" || !t.ExpiresAt.After(time.Now()) {
+			http.Error(w, "Transfer is no longer pending", http.StatusConflict)
+			return
+		}
+
+		var kc models.KeyCopy
+		err = tx.QueryRow(
+			"SELECT id, key_id, COALESCE(staff_id, 0), status, expires_at, expired FROM key_copies WHERE id = $1 FOR UPDATE",
+			t.KeyCopyID,
+		).Scan(&kc.ID, &kc.KeyID, &kc.StaffID, &kc.Status, &kc.ExpiresAt, &kc.Expired)
+		if err != nil {
+			log.Printf("Error retrieving key copy: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		h := models.KeyCopyHistory{
+			KeyCopyID:       kc.ID,
+			KeyID:           kc.KeyID,
+			PreviousStaffID: kc.StaffID,
+			StaffID:         kc.StaffID,
+			PerformedBy:     req.StaffID,
+			Note:            req.Note,
+		}
+
+		if accept {
+			if kc.StaffID != t.FromStaffID {
+				http.Error(w, "Key copy is no longer held by the initiating staff member", http.StatusConflict)
+				return
+			}
+			// The copy may have been marked lost since the transfer was offered
+			if kc.Status != "active" {
+				http.Error(w, "Key copy is marked "+kc.Status, http.StatusConflict)
+				return
+			}
+			if assignmentLapsed(kc) {
+				http.Error(w, transferLapsedMessage, http.StatusConflict)
+				return
+			}
+
+			reserved, err := reservedByOther(tx, kc.ID, t.ToStaffID, time.Now())
+			if err != nil {
+				log.Printf("Error checking reservations: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if reserved {
+				http.Error(w, "Key copy is reserved by another staff member", http.StatusConflict)
+				return
+			}
+
+			// Clearance may have changed since the transfer was initiated
+			if !t.ClearanceOverridden {
+				_, msg, err := checkClearance(tx, t.ToStaffID, kc.KeyID, clearanceOverride{})
+				if err != nil {
+					log.Printf("Error checking clearance: %v", err)
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+				if msg != "" {
+					http.Error(w, msg, http.StatusForbidden)
+					return
+				}
+			}
+
+			// The assignment moves as it is, so its expiry carries over, capped at the receiver's validity
+			expiresAt, msg, err := assignmentExpiry(tx, t.ToStaffID, kc.ExpiresAt)
+			if err != nil {
+				log.Printf("Error checking staff validity: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if msg != "" {
+				http.Error(w, msg, http.StatusConflict)
+				return
+			}
+
+			_, err = tx.Exec(
+				"UPDATE key_copies SET staff_id = $1, witness_staff_id = NULL, expires_at = $2 WHERE id = $3",
+				t.ToStaffID, expiresAt, kc.ID,
+			)
+			if err != nil {
+				log.Printf("Error updating key copy: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			t.Status = "accepted"
+			h.Action = "transfer_accepted"
+			h.StaffID = t.ToStaffID
+		} else {
+			t.Status = "declined"
+			h.Action = "transfer_declined"
+		}
+
+		err = tx.QueryRow(
+			"UPDATE key_copy_transfers SET status = $1, responded_at = NOW() WHERE id = $2 RETURNING responded_at",
+			t.Status, t.ID,
+		).Scan(&t.RespondedAt)
+		if err != nil {
+			log.Printf("Error updating transfer: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if h.Note == "" {
+			h.Note = fmt.Sprintf("Transfer #%d %s", t.ID, t.Status)
+		}
+		err = recordKeyCopyHistory(tx, h)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error recording key copy history: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(t)
+	}
+}
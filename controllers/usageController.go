@@ -0,0 +1,449 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// usageMaxBuckets keeps a long range with a fine bucket from producing a huge response
+const usageMaxBuckets = 1000
+
+// holderChange is a point in a copy's history where its holder changed. A change to a staff member starts
+// a loan that lasts until the copy's next change, and a change away from one is a return.
+type holderChange struct {
+	KeyCopyID         int
+	KeyID             int
+	KeyName           string
+	StaffID           int
+	StaffName         string
+	StaffRole         string
+	PreviousStaffID   int
+	PreviousStaffName string
+	PreviousStaffRole string
+	At                time.Time
+	Until             *time.Time
+}
+
+// holderChanges gets the holder changes that fall in [from, to), along with earlier ones whose loan
+// was still running at from
+func holderChanges(q queryer, from, to time.Time) ([]holderChange, error) {
+	rows, err := q.Query(`
+		WITH history AS (
+			SELECT h.id, h.key_copy_id, COALESCE(h.key_id, kc.key_id) AS key_id, h.staff_id, h.created_at,
+				LAG(h.staff_id) OVER (PARTITION BY h.key_copy_id ORDER BY h.created_at, h.id) AS previous_staff_id
+			FROM key_copy_history h
+			LEFT JOIN key_copies kc ON kc.id = h.key_copy_id
+		), changes AS (
+			SELECT *, LEAD(created_at) OVER (PARTITION BY key_copy_id ORDER BY created_at, id) AS ended_at
+			FROM history
+			WHERE staff_id IS DISTINCT FROM previous_staff_id
+		)
+		SELECT c.key_copy_id, COALESCE(c.key_id, 0), COALESCE(k.name, ''),
+			COALESCE(c.staff_id, 0), COALESCE(s.name, ''), COALESCE(s.role, ''),
+			COALESCE(c.previous_staff_id, 0), COALESCE(p.name, ''), COALESCE(p.role, ''),
+			c.created_at, c.ended_at
+		FROM changes c
+		LEFT JOIN keys k ON k.id = c.key_id
+		LEFT JOIN staffs s ON s.id = c.staff_id
+		LEFT JOIN staffs p ON p.id = c.previous_staff_id
+		WHERE c.created_at < $2
+			AND (c.created_at >= $1 OR (c.staff_id IS NOT NULL AND (c.ended_at IS NULL OR c.ended_at > $1)))
+		ORDER BY c.created_at, c.id`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []holderChange{}
+	for rows.Next() {
+		var c holderChange
+		err := rows.Scan(&c.KeyCopyID, &c.KeyID, &c.KeyName, &c.StaffID, &c.StaffName, &c.StaffRole,
+			&c.PreviousStaffID, &c.PreviousStaffName, &c.PreviousStaffRole, &c.At, &c.Until)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// loanWithin clips the loan a holder change starts to [from, to). ok is false when the change is a return
+// or the loan falls outside the window.
+func (c holderChange) loanWithin(from, to time.Time) (start, end time.Time, ok bool) {
+	if c.StaffID == 0 {
+		return time.Time{}, time.Time{}, false
+	}
+	start, end = c.At, to
+	if c.Until != nil && c.Until.Before(end) {
+		end = *c.Until
+	}
+	if start.Before(from) {
+		start = from
+	}
+	return start, end, start.Before(end)
+}
+
+type loanInterval struct {
+	Start, End time.Time
+}
+
+type loanEdge struct {
+	at    time.Time
+	delta int
+}
+
+// loanEdges turns loans into their start (+1) and end (-1) points in time order, with ends first
+// so a loan ending at the instant another starts does not overlap it
+func loanEdges(loans []loanInterval) []loanEdge {
+	edges := make([]loanEdge, 0, len(loans)*2)
+	for _, l := range loans {
+		edges = append(edges, loanEdge{l.Start, 1}, loanEdge{l.End, -1})
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].at.Equal(edges[j].at) {
+			return edges[i].delta < edges[j].delta
+		}
+		return edges[i].at.Before(edges[j].at)
+	})
+	return edges
+}
+
+// peakConcurrent is the most loans running at the same moment
+func peakConcurrent(loans []loanInterval) int {
+	peak, current := 0, 0
+	for _, e := range loanEdges(loans) {
+		current += e.delta
+		if current > peak {
+			peak = current
+		}
+	}
+	return peak
+}
+
+// usageBucketStart truncates t to the start of its day, ISO week or month in loc
+func usageBucketStart(t time.Time, bucket string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch bucket {
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+	case "week":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	}
+}
+
+func usageBucketNext(t time.Time, bucket string) time.Time {
+	switch bucket {
+	case "month":
+		return t.AddDate(0, 1, 0)
+	case "week":
+		return t.AddDate(0, 0, 7)
+	default:
+		return t.AddDate(0, 0, 1)
+	}
+}
+
+func roundHours(h float64) float64 {
+	return math.Round(h*100) / 100
+}
+
+type UsageBucket struct {
+	Start     time.Time `json:"start"`
+	Checkouts int       `json:"checkouts"`
+	Returns   int       `json:"returns"`
+}
+
+// UsageGroup is the activity of one key, staff member or role. Series only has the buckets with activity.
+type UsageGroup struct {
+	ID               int           `json:"id,omitempty"`
+	Name             string        `json:"name"`
+	Checkouts        int           `json:"checkouts"`
+	Returns          int           `json:"returns"`
+	Loans            int           `json:"loans"`
+	AverageLoanHours float64       `json:"average_loan_hours"`
+	Series           []UsageBucket `json:"series"`
+
+	loanHours float64
+	buckets   map[time.Time]*UsageBucket
+}
+
+func (g *UsageGroup) count(bucket time.Time, checkouts, returns int) {
+	if g.buckets == nil {
+		g.buckets = map[time.Time]*UsageBucket{}
+	}
+	b, ok := g.buckets[bucket]
+	if !ok {
+		b = &UsageBucket{Start: bucket}
+		g.buckets[bucket] = b
+	}
+	b.Checkouts += checkouts
+	b.Returns += returns
+	g.Checkouts += checkouts
+	g.Returns += returns
+}
+
+func (g *UsageGroup) finish() {
+	g.Series = []UsageBucket{}
+	for _, b := range g.buckets {
+		g.Series = append(g.Series, *b)
+	}
+	sort.Slice(g.Series, func(i, j int) bool { return g.Series[i].Start.Before(g.Series[j].Start) })
+	if g.Loans > 0 {
+		g.AverageLoanHours = roundHours(g.loanHours / float64(g.Loans))
+	}
+}
+
+type usageGroups struct {
+	groups map[string]*UsageGroup
+}
+
+func (u *usageGroups) get(key string, id int, name string) *UsageGroup {
+	if u.groups == nil {
+		u.groups = map[string]*UsageGroup{}
+	}
+	g, ok := u.groups[key]
+	if !ok {
+		g = &UsageGroup{ID: id, Name: name}
+		u.groups[key] = g
+	}
+	return g
+}
+
+// list finishes the groups, busiest first
+func (u *usageGroups) list() []*UsageGroup {
+	list := []*UsageGroup{}
+	for _, g := range u.groups {
+		g.finish()
+		list = append(list, g)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Checkouts != list[j].Checkouts {
+			return list[i].Checkouts > list[j].Checkouts
+		}
+		if list[i].ID != list[j].ID {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+type UsageHour struct {
+	Hour      int `json:"hour"`
+	Checkouts int `json:"checkouts"`
+}
+
+// KeyUtilisation is how much of the time a key's copies spent out. Utilisation is loan hours over the hours
+// the copies could have been out, counting at least as many copies as were ever out at once.
+type KeyUtilisation struct {
+	KeyID          int     `json:"key_id"`
+	Name           string  `json:"name"`
+	Copies         int     `json:"copies"`
+	PeakConcurrent int     `json:"peak_concurrent"`
+	LoanHours      float64 `json:"loan_hours"`
+	Utilisation    float64 `json:"utilisation"`
+}
+
+type UsageReport struct {
+	From             time.Time        `json:"from"`
+	To               time.Time        `json:"to"`
+	Bucket           string           `json:"bucket"`
+	TimeZone         string           `json:"time_zone"`
+	Checkouts        int              `json:"checkouts"`
+	Returns          int              `json:"returns"`
+	Loans            int              `json:"loans"`
+	AverageLoanHours float64          `json:"average_loan_hours"`
+	Series           []UsageBucket    `json:"series"`
+	ByKey            []*UsageGroup    `json:"by_key"`
+	ByStaff          []*UsageGroup    `json:"by_staff"`
+	ByRole           []*UsageGroup    `json:"by_role"`
+	PeakHours        []UsageHour      `json:"peak_hours"`
+	Utilisation      []KeyUtilisation `json:"utilisation"`
+}
+
+// Get checkouts and returns per key, staff member and role bucketed by day, week or month between from and to
+// (the last 30 days by default), with loan durations, checkouts per hour of day and utilisation per key.
+// Loan durations are for loans returned inside the range. Buckets and hours are in the tz time zone (UTC by default).
+func GetUsageReport(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		to := time.Now()
+		if value := query.Get("to"); value != "" {
+			t, err := parseTime(value)
+			if err != nil {
+				http.Error(w, "Invalid to", http.StatusBadRequest)
+				return
+			}
+			to = t
+		}
+		from := to.AddDate(0, 0, -30)
+		if value := query.Get("from"); value != "" {
+			t, err := parseTime(value)
+			if err != nil {
+				http.Error(w, "Invalid from", http.StatusBadRequest)
+				return
+			}
+			from = t
+		}
+		if !from.Before(to) {
+			http.Error(w, "from must be before to", http.StatusBadRequest)
+			return
+		}
+
+		bucket := query.Get("bucket")
+		if bucket == "" {
+			bucket = "day"
+		}
+		if bucket != "day" && bucket != "week" && bucket != "month" {
+			http.Error(w, "bucket must be day, week or month", http.StatusBadRequest)
+			return
+		}
+
+		tz := query.Get("tz")
+		if tz == "" {
+			tz = "UTC"
+		}
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			http.Error(w, "Invalid tz", http.StatusBadRequest)
+			return
+		}
+
+		report := UsageReport{From: from, To: to, Bucket: bucket, TimeZone: tz, Series: []UsageBucket{}}
+		series := map[time.Time]*UsageBucket{}
+		for b := usageBucketStart(from, bucket, loc); b.Before(to); b = usageBucketNext(b, bucket) {
+			if len(report.Series) == usageMaxBuckets {
+				http.Error(w, "Range has too many buckets, use a shorter range or a larger bucket", http.StatusBadRequest)
+				return
+			}
+			report.Series = append(report.Series, UsageBucket{Start: b})
+		}
+		for i := range report.Series {
+			series[report.Series[i].Start] = &report.Series[i]
+		}
+
+		changes, err := holderChanges(db, from, to)
+		if err != nil {
+			log.Printf("Error querying key copy history: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// Time after now can't have been used, so utilisation only counts up to now
+		end := to
+		if now := time.Now(); now.Before(end) {
+			end = now
+		}
+
+		var byKey, byStaff, byRole usageGroups
+		hours := make([]UsageHour, 24)
+		for i := range hours {
+			hours[i].Hour = i
+		}
+		keyLoans := map[int][]loanInterval{}
+		keyLoanHours := map[int]float64{}
+		var loanHours float64
+
+		for _, c := range changes {
+			if !c.At.Before(from) {
+				b := usageBucketStart(c.At, bucket, loc)
+				key := byKey.get("key:"+strconv.Itoa(c.KeyID), c.KeyID, c.KeyName)
+				if c.StaffID != 0 {
+					series[b].Checkouts++
+					report.Checkouts++
+					key.count(b, 1, 0)
+					byStaff.get("staff:"+strconv.Itoa(c.StaffID), c.StaffID, c.StaffName).count(b, 1, 0)
+					byRole.get("role:"+c.StaffRole, 0, c.StaffRole).count(b, 1, 0)
+					hours[c.At.In(loc).Hour()].Checkouts++
+				}
+				if c.PreviousStaffID != 0 {
+					series[b].Returns++
+					report.Returns++
+					key.count(b, 0, 1)
+					byStaff.get("staff:"+strconv.Itoa(c.PreviousStaffID), c.PreviousStaffID, c.PreviousStaffName).count(b, 0, 1)
+					byRole.get("role:"+c.PreviousStaffRole, 0, c.PreviousStaffRole).count(b, 0, 1)
+				}
+			}
+
+			if start, stop, ok := c.loanWithin(from, end); ok {
+				keyLoans[c.KeyID] = append(keyLoans[c.KeyID], loanInterval{start, stop})
+				keyLoanHours[c.KeyID] += stop.Sub(start).Hours()
+			}
+
+			// Only whole loans returned inside the range count towards the average duration
+			if c.StaffID != 0 && !c.At.Before(from) && c.Until != nil && c.Until.Before(to) {
+				h := c.Until.Sub(c.At).Hours()
+				report.Loans++
+				loanHours += h
+				for _, g := range []*UsageGroup{
+					byKey.get("key:"+strconv.Itoa(c.KeyID), c.KeyID, c.KeyName),
+					byStaff.get("staff:"+strconv.Itoa(c.StaffID), c.StaffID, c.StaffName),
+					byRole.get("role:"+c.StaffRole, 0, c.StaffRole),
+				} {
+					g.Loans++
+					g.loanHours += h
+				}
+			}
+		}
+		if report.Loans > 0 {
+			report.AverageLoanHours = roundHours(loanHours / float64(report.Loans))
+		}
+		report.ByKey = byKey.list()
+		report.ByStaff = byStaff.list()
+		report.ByRole = byRole.list()
+		report.PeakHours = hours
+
+		rows, err := db.Query(`
+			SELECT k.id, k.name, COUNT(kc.id)
+			FROM keys k
+			LEFT JOIN key_copies kc ON kc.key_id = k.id AND kc.status = 'active'
+			GROUP BY k.id, k.name
+			ORDER BY k.id`)
+		if err != nil {
+			log.Printf("Error querying keys: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		windowHours := end.Sub(from).Hours()
+		report.Utilisation = []KeyUtilisation{}
+		for rows.Next() {
+			var u KeyUtilisation
+			if err := rows.Scan(&u.KeyID, &u.Name, &u.Copies); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			u.PeakConcurrent = peakConcurrent(keyLoans[u.KeyID])
+			u.LoanHours = roundHours(keyLoanHours[u.KeyID])
+			copies := u.Copies
+			if u.PeakConcurrent > copies {
+				copies = u.PeakConcurrent
+			}
+			if copies > 0 && windowHours > 0 {
+				u.Utilisation = math.Round(keyLoanHours[u.KeyID]/(float64(copies)*windowHours)*1000) / 1000
+			}
+			report.Utilisation = append(report.Utilisation, u)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Error querying keys: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		sort.SliceStable(report.Utilisation, func(i, j int) bool {
+			return report.Utilisation[i].Utilisation > report.Utilisation[j].Utilisation
+		})
+
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,365 @@
+package controllers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/boombuler/barcode/code128"
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// zplDefaultTemplate prints the key name, the serial and a Code 128 barcode of the serial on a 2x1" tag at 203 dpi
+const zplDefaultTemplate = `^XA
+^CI28
+^FO20,20^A0N,30,30^FD{{.KeyName}}^FS
+^FO20,58^A0N,24,24^FD{{.Serial}}^FS
+^FO20,95^BY2^BCN,80,N,N,N^FD{{.Serial}}^FS
+^XZ`
+
+const (
+	zplDefaultWidth  = 406
+	zplDefaultHeight = 203
+	// zplMaxDots bounds label sizes, from templates and ^PW/^LL alike, at what a wide 300 dpi printer takes
+	zplMaxDots = 2000
+	// zplMaxPreviewLabels is how many labels one preview draws
+	zplMaxPreviewLabels = 10
+)
+
+type zplRequest struct {
+	labelSheetRequest
+	Organisation string `json:"organisation"`
+	// Preview renders the ZPL to a PNG locally instead of returning it, for checking templates without a printer
+	Preview bool `json:"preview"`
+}
+
+// zplEscape keeps field values from being read as ZPL commands
+var zplEscape = strings.NewReplacer("^", " ", "~", " ")
+
+// parseZPLTemplate parses a label template and renders it once with sample data, so a broken
+// template is caught when it is saved rather than at the front desk
+func parseZPLTemplate(zpl string) (*template.Template, error) {
+	tmpl, err := template.New("label").Parse(zpl)
+	if err != nil {
+		return nil, err
+	}
+	_, err = renderZPL(tmpl, []keyCopyLabel{{KeyCopyID: 1, KeyID: 42, Serial: "KEY-0042-01", KeyName: "Sample key"}})
+	return tmpl, err
+}
+
+// renderZPL renders one label per copy and joins them into a single print job
+func renderZPL(tmpl *template.Template, labels []keyCopyLabel) (string, error) {
+	var job strings.Builder
+	for _, l := range labels {
+		l.Serial = zplEscape.Replace(l.Serial)
+		l.KeyName = zplEscape.Replace(l.KeyName)
+		l.KeyDescription = zplEscape.Replace(l.KeyDescription)
+		if err := tmpl.Execute(&job, l); err != nil {
+			return "", err
+		}
+		job.WriteString("\n")
+	}
+	return job.String(), nil
+}
+
+// zplPreview draws the subset of ZPL our templates use: field origins, scalable font 0,
+// Code 128 and QR barcodes and graphic boxes. Other commands are ignored, and everything
+// is drawn in the normal orientation. Labels are black on white, so they're drawn in grey
+// to keep large ones small in memory.
+type zplPreview struct {
+	width, height int
+	labels        []*image.Gray
+	img           *image.Gray
+
+	x, y                       int
+	fontH, fontW               int
+	defaultFontH, defaultFontW int
+	moduleW, barH              int
+	field                      string
+	fieldArgs                  []string
+}
+
+func zplArg(args []string, i, def int) int {
+	if i >= len(args) {
+		return def
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(args[i]))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+// zplDots caps a label dimension at zplMaxDots
+func zplDots(n int) int {
+	if n > zplMaxDots {
+		return zplMaxDots
+	}
+	return n
+}
+
+// canvas starts the current label on first use, so ^PW and ^LL after ^XA still apply
+func (p *zplPreview) canvas() *image.Gray {
+	if p.img == nil {
+		p.img = image.NewGray(image.Rect(0, 0, p.width, p.height))
+		draw.Draw(p.img, p.img.Bounds(), image.White, image.Point{}, draw.Src)
+	}
+	return p.img
+}
+
+func (p *zplPreview) fill(r image.Rectangle) {
+	draw.Draw(p.canvas(), r, image.Black, image.Point{}, draw.Src)
+}
+
+func (p *zplPreview) text(x, y, h, w int, s string) {
+	face := basicfont.Face7x13
+	src := image.NewRGBA(image.Rect(0, 0, face.Advance*len([]rune(s)), face.Height))
+	d := font.Drawer{Dst: src, Src: image.Black, Face: face, Dot: fixed.P(0, face.Ascent)}
+	d.DrawString(s)
+
+	// Scale the 7x13 bitmap font to the requested cell; a width equal to the height is normal proportions
+	width := src.Bounds().Dx() * w / face.Height
+	if width == 0 || h == 0 {
+		return
+	}
+	draw.NearestNeighbor.Scale(p.canvas(), image.Rect(x, y, x+width, y+h), src, src.Bounds(), draw.Over, nil)
+}
+
+func (p *zplPreview) drawField(data string) error {
+	switch p.field {
+	case "code128":
+		code, err := code128.Encode(data)
+		if err != nil {
+			return err
+		}
+		h := zplArg(p.fieldArgs, 1, p.barH)
+		for i := 0; i < code.Bounds().Dx(); i++ {
+			if r, _, _, _ := code.At(i, 0).RGBA(); r == 0 {
+				p.fill(image.Rect(p.x+i*p.moduleW, p.y, p.x+(i+1)*p.moduleW, p.y+h))
+			}
+		}
+		// Interpretation line under the bars unless turned off
+		if len(p.fieldArgs) < 3 || strings.TrimSpace(p.fieldArgs[2]) != "N" {
+			p.text(p.x, p.y+h+4, 20, 20, data)
+		}
+	case "qr":
+		// QR field data starts with the error correction and input mode, e.g. QA,KEY-0042-01
+		if len(data) > 3 && data[2] == ',' {
+			data = data[3:]
+		}
+		code, err := qrcode.New(data, qrcode.Medium)
+		if err != nil {
+			return err
+		}
+		code.DisableBorder = true
+		mag := zplArg(p.fieldArgs, 2, 3)
+		for row, modules := range code.Bitmap() {
+			for col, dark := range modules {
+				if dark {
+					p.fill(image.Rect(p.x+col*mag, p.y+row*mag, p.x+(col+1)*mag, p.y+(row+1)*mag))
+				}
+			}
+		}
+	default:
+		p.text(p.x, p.y, p.fontH, p.fontW, data)
+	}
+	return nil
+}
+
+func (p *zplPreview) command(code, args string) error {
+	list := strings.Split(args, ",")
+	switch {
+	case code == "XA":
+		p.img = nil
+		p.fontH, p.fontW = p.defaultFontH, p.defaultFontW
+	case code == "XZ":
+		p.labels = append(p.labels, p.canvas())
+		p.img = nil
+	case code == "PW":
+		p.width = zplDots(zplArg(list, 0, p.width))
+	case code == "LL":
+		p.height = zplDots(zplArg(list, 0, p.height))
+	case code == "FO", code == "FT":
+		p.x, p.y = zplArg(list, 0, 0), zplArg(list, 1, 0)
+	case code == "CF":
+		p.defaultFontH = zplArg(list, 1, p.defaultFontH)
+		p.defaultFontW = zplArg(list, 2, p.defaultFontH)
+		p.fontH, p.fontW = p.defaultFontH, p.defaultFontW
+	case code[0] == 'A':
+		// ^A0N,30,30: font name and orientation come straight after the A
+		p.fontH = zplArg(list, 1, p.defaultFontH)
+		p.fontW = zplArg(list, 2, p.fontH)
+	case code == "BY":
+		p.moduleW = zplArg(list, 0, 2)
+		p.barH = zplArg(list, 2, p.barH)
+	case code == "BC":
+		p.field, p.fieldArgs = "code128", list
+	case code == "BQ":
+		p.field, p.fieldArgs = "qr", list
+	case code == "GB":
+		w, h := zplArg(list, 0, 1), zplArg(list, 1, 1)
+		t := zplArg(list, 2, 1)
+		outer := image.Rect(p.x, p.y, p.x+w, p.y+h)
+		p.fill(outer)
+		if inner := outer.Inset(t); !inner.Empty() {
+			draw.Draw(p.canvas(), inner, image.White, image.Point{}, draw.Src)
+		}
+	case code == "FD":
+		return p.drawField(args)
+	case code == "FS":
+		p.field, p.fieldArgs = "", nil
+		p.fontH, p.fontW = p.defaultFontH, p.defaultFontW
+	}
+	return nil
+}
+
+// previewZPL renders a ZPL job to one PNG with the labels stacked on top of each other. Labels past
+// zplMaxPreviewLabels are left out.
+func previewZPL(zpl string, width, height int) ([]byte, error) {
+	p := &zplPreview{width: zplDots(width), height: zplDots(height), defaultFontH: 30, defaultFontW: 30, moduleW: 2, barH: 10}
+	p.fontH, p.fontW = p.defaultFontH, p.defaultFontW
+
+	zpl = strings.NewReplacer("\r", "", "\n", "").Replace(zpl)
+	for i := 0; i < len(zpl); {
+		if zpl[i] != '^' && zpl[i] != '~' || i+3 > len(zpl) {
+			i++
+			continue
+		}
+		code := strings.ToUpper(zpl[i+1 : i+3])
+		end := strings.IndexAny(zpl[i+3:], "^~")
+		if end < 0 {
+			end = len(zpl) - i - 3
+		}
+		args := zpl[i+3 : i+3+end]
+		if code[0] == 'A' && code != "A@" {
+			args = zpl[i+2 : i+3+end]
+		}
+		if err := p.command(code, args); err != nil {
+			return nil, err
+		}
+		if len(p.labels) >= zplMaxPreviewLabels {
+			break
+		}
+		i += 3 + end
+	}
+
+	// A template missing its closing ^XZ still gets previewed
+	if p.img != nil || len(p.labels) == 0 {
+		p.labels = append(p.labels, p.canvas())
+	}
+
+	const gap = 10
+	totalW, totalH := 0, 0
+	for _, l := range p.labels {
+		if l.Bounds().Dx() > totalW {
+			totalW = l.Bounds().Dx()
+		}
+		totalH += l.Bounds().Dy() + gap
+	}
+	sheet := image.NewGray(image.Rect(0, 0, totalW, totalH))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(color.Gray{Y: 200}), image.Point{}, draw.Src)
+	y := 0
+	for _, l := range p.labels {
+		draw.Draw(sheet, l.Bounds().Add(image.Pt(0, y)), l, image.Point{}, draw.Src)
+		y += l.Bounds().Dy() + gap
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, sheet); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Render a ZPL print job for key copies using the organisation's label template, or a PNG preview of it
+func CreateZPLLabels(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req zplRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if len(req.KeyCopyIDs) == 0 && req.KeyID == 0 {
+			http.Error(w, "key_copy_ids or key_id is required", http.StatusBadRequest)
+			return
+		}
+
+		zpl, width, height := zplDefaultTemplate, zplDefaultWidth, zplDefaultHeight
+		if req.Organisation != "" {
+			err := db.QueryRow(
+				"SELECT zpl, width_dots, height_dots FROM label_templates WHERE organisation = $1",
+				req.Organisation,
+			).Scan(&zpl, &width, &height)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					http.Error(w, "Label template not found", http.StatusNotFound)
+				} else {
+					log.Printf("Error retrieving label template: %v", err)
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+				}
+				return
+			}
+		}
+
+		tmpl, err := template.New("label").Parse(zpl)
+		if err != nil {
+			log.Printf("Error parsing label template: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		labels, err := labelCopies(db, req.labelSheetRequest)
+		if err != nil {
+			log.Printf("Error querying key copies: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if len(labels) == 0 {
+			http.Error(w, "No key copies with serials found", http.StatusNotFound)
+			return
+		}
+
+		job, err := renderZPL(tmpl, labels)
+		if err != nil {
+			log.Printf("Error rendering label template: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if !req.Preview {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Content-Disposition", `attachment; filename="key-copy-labels.zpl"`)
+			w.Write([]byte(job))
+			return
+		}
+
+		if len(labels) > zplMaxPreviewLabels {
+			http.Error(w, fmt.Sprintf("A preview can show at most %d labels", zplMaxPreviewLabels), http.StatusBadRequest)
+			return
+		}
+
+		preview, err := previewZPL(job, width, height)
+		if err != nil {
+			log.Printf("Error rendering label preview: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(preview)
+	}
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"database/sql"
+	"go-app-be/controllers"
 	"go-app-be/routes"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq" // PostgreSQL driver
@@ -24,7 +26,8 @@ func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000") // Adjust this for production
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key")
+		w.Header().Set("Access-Control-Expose-Headers", "Idempotent-Replayed")
 
 		// Handle preflight (OPTIONS) request
 		if r.Method == http.MethodOptions {
@@ -49,6 +52,12 @@ func createTablesIfNotExist(db *sql.DB) {
 		log.Fatal("Error creating keys table: ", err)
 	}
 
+	// Add the custodian column to keys tables created before it existed
+	_, err = db.Exec(`ALTER TABLE keys ADD COLUMN IF NOT EXISTS staff_id INTEGER`)
+	if err != nil {
+		log.Fatal("Error adding staff_id to keys table: ", err)
+	}
+
 	// Create key_copies table if not exists
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS key_copies (
@@ -72,6 +81,509 @@ func createTablesIfNotExist(db *sql.DB) {
 	if err != nil {
 		log.Fatal("Error creating staffs table: ", err)
 	}
+
+	// Add staff types, validity windows and assignment expiry
+	_, err = db.Exec(`
+		ALTER TABLE staffs ADD COLUMN IF NOT EXISTS staff_type TEXT NOT NULL DEFAULT 'employee';
+		ALTER TABLE staffs ADD COLUMN IF NOT EXISTS valid_from TIMESTAMPTZ;
+		ALTER TABLE staffs ADD COLUMN IF NOT EXISTS valid_until TIMESTAMPTZ;
+		ALTER TABLE key_copies ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+		ALTER TABLE key_copies ADD COLUMN IF NOT EXISTS expired BOOLEAN NOT NULL DEFAULT FALSE;
+	`)
+	if err != nil {
+		log.Fatal("Error adding assignment expiry columns: ", err)
+	}
+
+	// Create key_reservations table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS key_reservations (
+			id SERIAL PRIMARY KEY,
+			key_id INTEGER REFERENCES keys(id) ON DELETE CASCADE,
+			key_copy_id INTEGER REFERENCES key_copies(id) ON DELETE CASCADE,
+			staff_id INTEGER REFERENCES staffs(id) ON DELETE CASCADE,
+			start_time TIMESTAMPTZ NOT NULL,
+			end_time TIMESTAMPTZ NOT NULL,
+			status TEXT NOT NULL DEFAULT 'active',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating key_reservations table: ", err)
+	}
+
+	// Create key_copy_history table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS key_copy_history (
+			id SERIAL PRIMARY KEY,
+			key_copy_id INTEGER NOT NULL,
+			key_id INTEGER,
+			action TEXT NOT NULL,
+			previous_staff_id INTEGER,
+			staff_id INTEGER,
+			performed_by INTEGER,
+			note TEXT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating key_copy_history table: ", err)
+	}
+
+	// Create key_copy_transfers table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS key_copy_transfers (
+			id SERIAL PRIMARY KEY,
+			key_copy_id INTEGER REFERENCES key_copies(id) ON DELETE CASCADE,
+			from_staff_id INTEGER NOT NULL,
+			to_staff_id INTEGER NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			note TEXT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMPTZ NOT NULL,
+			responded_at TIMESTAMPTZ
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating key_copy_transfers table: ", err)
+	}
+
+	// Create access_requests table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS access_requests (
+			id SERIAL PRIMARY KEY,
+			key_id INTEGER REFERENCES keys(id) ON DELETE CASCADE,
+			staff_id INTEGER REFERENCES staffs(id) ON DELETE CASCADE,
+			justification TEXT NOT NULL,
+			start_date TIMESTAMPTZ NOT NULL,
+			end_date TIMESTAMPTZ NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			approver_id INTEGER,
+			decision_note TEXT,
+			key_copy_id INTEGER,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			decided_at TIMESTAMPTZ
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating access_requests table: ", err)
+	}
+
+	// Add clearance levels to keys and staffs
+	_, err = db.Exec(`
+		ALTER TABLE keys ADD COLUMN IF NOT EXISTS clearance_level INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE staffs ADD COLUMN IF NOT EXISTS clearance_level INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE key_copy_transfers ADD COLUMN IF NOT EXISTS clearance_overridden BOOLEAN NOT NULL DEFAULT FALSE;
+	`)
+	if err != nil {
+		log.Fatal("Error adding clearance columns: ", err)
+	}
+
+	// Create audit_logs table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_logs (
+			id SERIAL PRIMARY KEY,
+			action TEXT NOT NULL,
+			performed_by INTEGER,
+			entity TEXT NOT NULL,
+			entity_id INTEGER,
+			reason TEXT,
+			details TEXT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating audit_logs table: ", err)
+	}
+
+	// Add dual control to keys and the confirming witness to key copies
+	_, err = db.Exec(`
+		ALTER TABLE keys ADD COLUMN IF NOT EXISTS dual_control BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE key_copies ADD COLUMN IF NOT EXISTS witness_staff_id INTEGER;
+	`)
+	if err != nil {
+		log.Fatal("Error adding dual control columns: ", err)
+	}
+
+	// Create key_copy_checkouts table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS key_copy_checkouts (
+			id SERIAL PRIMARY KEY,
+			key_copy_id INTEGER REFERENCES key_copies(id) ON DELETE CASCADE,
+			staff_id INTEGER NOT NULL,
+			witness_staff_id INTEGER,
+			status TEXT NOT NULL DEFAULT 'pending',
+			loan_expires_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMPTZ NOT NULL,
+			confirmed_at TIMESTAMPTZ
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating key_copy_checkouts table: ", err)
+	}
+
+	// Link checkouts to the access request they pick up
+	_, err = db.Exec(`ALTER TABLE key_copy_checkouts ADD COLUMN IF NOT EXISTS access_request_id INTEGER`)
+	if err != nil {
+		log.Fatal("Error adding access_request_id to key_copy_checkouts table: ", err)
+	}
+
+	// Add the manager column to staffs
+	_, err = db.Exec(`ALTER TABLE staffs ADD COLUMN IF NOT EXISTS manager_id INTEGER`)
+	if err != nil {
+		log.Fatal("Error adding manager_id to staffs table: ", err)
+	}
+
+	// Create return_tasks table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS return_tasks (
+			id SERIAL PRIMARY KEY,
+			key_copy_id INTEGER NOT NULL,
+			staff_id INTEGER NOT NULL,
+			reason TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'open',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			due_at TIMESTAMPTZ,
+			completed_at TIMESTAMPTZ
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating return_tasks table: ", err)
+	}
+
+	// Create recertification_campaigns table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS recertification_campaigns (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'open',
+			created_by INTEGER NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			due_at TIMESTAMPTZ,
+			completed_at TIMESTAMPTZ,
+			signed_by INTEGER,
+			signature TEXT
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating recertification_campaigns table: ", err)
+	}
+
+	// Keep the exact report each campaign signature was made over
+	_, err = db.Exec(`ALTER TABLE recertification_campaigns ADD COLUMN IF NOT EXISTS report TEXT`)
+	if err != nil {
+		log.Fatal("Error adding report to recertification_campaigns table: ", err)
+	}
+
+	// Create recertification_items table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS recertification_items (
+			id SERIAL PRIMARY KEY,
+			campaign_id INTEGER REFERENCES recertification_campaigns(id) ON DELETE CASCADE,
+			key_copy_id INTEGER NOT NULL,
+			key_id INTEGER NOT NULL,
+			staff_id INTEGER NOT NULL,
+			reviewer_id INTEGER,
+			decision TEXT NOT NULL DEFAULT 'pending',
+			decision_note TEXT,
+			decided_at TIMESTAMPTZ,
+			return_task_id INTEGER
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating recertification_items table: ", err)
+	}
+
+	// Add lost/found status to key_copies if not exists
+	_, err = db.Exec(`
+		ALTER TABLE key_copies ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active'
+	`)
+	if err != nil {
+		log.Fatal("Error adding key copy status: ", err)
+	}
+
+	// Create stocktake_sessions table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS stocktake_sessions (
+			id SERIAL PRIMARY KEY,
+			operator_id INTEGER NOT NULL,
+			key_id INTEGER,
+			status TEXT NOT NULL DEFAULT 'open',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			closed_at TIMESTAMPTZ
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating stocktake_sessions table: ", err)
+	}
+
+	// Create stocktake_scans table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS stocktake_scans (
+			id SERIAL PRIMARY KEY,
+			session_id INTEGER REFERENCES stocktake_sessions(id) ON DELETE CASCADE,
+			key_copy_id INTEGER NOT NULL,
+			observed_staff_id INTEGER NOT NULL DEFAULT 0,
+			scanned_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			UNIQUE (session_id, key_copy_id)
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating stocktake_scans table: ", err)
+	}
+
+	// Add serial numbers to key_copies if not exists
+	_, err = db.Exec(`
+		ALTER TABLE keys ADD COLUMN IF NOT EXISTS copy_seq INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE key_copies ADD COLUMN IF NOT EXISTS serial TEXT UNIQUE;
+	`)
+	if err != nil {
+		log.Fatal("Error adding key copy serials: ", err)
+	}
+
+	// Give copies created before serials existed one, numbered per key in creation order
+	_, err = db.Exec(`
+		WITH numbered AS (
+			SELECT c.id, c.key_id, k.copy_seq + ROW_NUMBER() OVER (PARTITION BY c.key_id ORDER BY c.id) AS seq
+			FROM key_copies c
+			JOIN keys k ON k.id = c.key_id
+			WHERE c.serial IS NULL
+		), updated AS (
+			UPDATE key_copies kc
+			SET serial = 'KEY-' || LPAD(n.key_id::text, GREATEST(4, LENGTH(n.key_id::text)), '0')
+				|| '-' || LPAD(n.seq::text, GREATEST(2, LENGTH(n.seq::text)), '0')
+			FROM numbered n
+			WHERE kc.id = n.id
+			RETURNING n.key_id, n.seq
+		)
+		UPDATE keys k SET copy_seq = u.seq
+		FROM (SELECT key_id, MAX(seq) AS seq FROM updated GROUP BY key_id) u
+		WHERE k.id = u.key_id
+	`)
+	if err != nil {
+		log.Fatal("Error backfilling key copy serials: ", err)
+	}
+
+	// Create label_templates table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS label_templates (
+			id SERIAL PRIMARY KEY,
+			organisation TEXT NOT NULL UNIQUE,
+			zpl TEXT NOT NULL,
+			width_dots INTEGER NOT NULL DEFAULT 406,
+			height_dots INTEGER NOT NULL DEFAULT 203,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating label_templates table: ", err)
+	}
+
+	// Create cabinets table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cabinets (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			adapter TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating cabinets table: ", err)
+	}
+
+	// Create cabinet_slots table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cabinet_slots (
+			cabinet_id INTEGER REFERENCES cabinets(id) ON DELETE CASCADE,
+			slot INTEGER NOT NULL,
+			key_copy_id INTEGER NOT NULL UNIQUE,
+			PRIMARY KEY (cabinet_id, slot)
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating cabinet_slots table: ", err)
+	}
+
+	// Create cabinet_events table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cabinet_events (
+			id SERIAL PRIMARY KEY,
+			cabinet_id INTEGER REFERENCES cabinets(id) ON DELETE CASCADE,
+			slot INTEGER NOT NULL,
+			event TEXT NOT NULL,
+			staff_id INTEGER,
+			key_copy_id INTEGER,
+			outcome TEXT NOT NULL,
+			detail TEXT,
+			occurred_at TIMESTAMPTZ NOT NULL,
+			received_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating cabinet_events table: ", err)
+	}
+
+	// Create alerts table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS alerts (
+			id SERIAL PRIMARY KEY,
+			type TEXT NOT NULL,
+			severity TEXT NOT NULL,
+			message TEXT NOT NULL,
+			key_copy_id INTEGER,
+			staff_id INTEGER,
+			status TEXT NOT NULL DEFAULT 'open',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating alerts table: ", err)
+	}
+
+	// Track who acknowledged and resolved alerts, and keep rules from raising the same alert twice while it is unresolved
+	_, err = db.Exec(`
+		ALTER TABLE alerts ADD COLUMN IF NOT EXISTS acknowledged_by INTEGER;
+		ALTER TABLE alerts ADD COLUMN IF NOT EXISTS acknowledged_at TIMESTAMPTZ;
+		ALTER TABLE alerts ADD COLUMN IF NOT EXISTS resolved_by INTEGER;
+		ALTER TABLE alerts ADD COLUMN IF NOT EXISTS resolved_at TIMESTAMPTZ;
+		ALTER TABLE alerts ADD COLUMN IF NOT EXISTS resolution_note TEXT;
+		ALTER TABLE alerts ADD COLUMN IF NOT EXISTS dedup_key TEXT;
+		CREATE UNIQUE INDEX IF NOT EXISTS alerts_unresolved_dedup_key ON alerts (dedup_key) WHERE status <> 'resolved';
+	`)
+	if err != nil {
+		log.Fatal("Error adding alert workflow columns: ", err)
+	}
+
+	// Create alert_events table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS alert_events (
+			id SERIAL PRIMARY KEY,
+			alert_id INTEGER NOT NULL REFERENCES alerts(id) ON DELETE CASCADE,
+			event TEXT NOT NULL,
+			staff_id INTEGER,
+			note TEXT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating alert_events table: ", err)
+	}
+
+	// Create anomaly_rules table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS anomaly_rules (
+			name TEXT PRIMARY KEY,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			params JSONB NOT NULL DEFAULT '{}',
+			last_run_at TIMESTAMPTZ
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating anomaly_rules table: ", err)
+	}
+
+	// Create doors table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS doors (
+			id SERIAL PRIMARY KEY,
+			code TEXT NOT NULL UNIQUE,
+			name TEXT NOT NULL,
+			key_id INTEGER
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating doors table: ", err)
+	}
+
+	// Create door_events table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS door_events (
+			id SERIAL PRIMARY KEY,
+			door_code TEXT NOT NULL,
+			door_id INTEGER,
+			key_id INTEGER,
+			event TEXT NOT NULL,
+			staff_id INTEGER,
+			occurred_at TIMESTAMPTZ NOT NULL,
+			holder_staff_ids INTEGER[] NOT NULL DEFAULT '{}',
+			flagged BOOLEAN NOT NULL DEFAULT FALSE,
+			imported_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			UNIQUE (door_code, occurred_at, event)
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating door_events table: ", err)
+	}
+
+	// Index key_copy_history for point-in-time holder queries and start the history of copies that have none
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS key_copy_history_copy_time ON key_copy_history (key_copy_id, created_at);
+		INSERT INTO key_copy_history (key_copy_id, key_id, action, staff_id, note)
+		SELECT kc.id, kc.key_id, 'created', NULLIF(kc.staff_id, 0), 'Recorded when assignment history began'
+		FROM key_copies kc
+		WHERE NOT EXISTS (SELECT 1 FROM key_copy_history h WHERE h.key_copy_id = kc.id);
+	`)
+	if err != nil {
+		log.Fatal("Error backfilling key copy history: ", err)
+	}
+
+	// Add external IDs so keys and staff can be matched to records in other systems
+	_, err = db.Exec(`
+		ALTER TABLE keys ADD COLUMN IF NOT EXISTS external_id TEXT UNIQUE;
+		ALTER TABLE staffs ADD COLUMN IF NOT EXISTS external_id TEXT UNIQUE;
+	`)
+	if err != nil {
+		log.Fatal("Error adding external_id columns: ", err)
+	}
+
+	// Create export_jobs table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS export_jobs (
+			id SERIAL PRIMARY KEY,
+			dataset TEXT NOT NULL,
+			format TEXT NOT NULL,
+			from_time TIMESTAMPTZ,
+			to_time TIMESTAMPTZ,
+			requested_by INTEGER,
+			status TEXT NOT NULL DEFAULT 'pending',
+			file_name TEXT,
+			row_count INTEGER NOT NULL DEFAULT 0,
+			error TEXT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			started_at TIMESTAMPTZ,
+			completed_at TIMESTAMPTZ,
+			expires_at TIMESTAMPTZ
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating export_jobs table: ", err)
+	}
+
+	// Create idempotency_keys table if not exists
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+			key TEXT PRIMARY KEY,
+			fingerprint TEXT NOT NULL,
+			status INTEGER,
+			headers JSONB,
+			body BYTEA,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMPTZ NOT NULL
+		)
+	`)
+	if err != nil {
+		log.Fatal("Error creating idempotency_keys table: ", err)
+	}
+}
+
+// runPeriodically calls job every interval for as long as the server runs
+func runPeriodically(interval time.Duration, name string, job func() error) {
+	for range time.Tick(interval) {
+		if err := job(); err != nil {
+			log.Printf("Error running %s: %v", name, err)
+		}
+	}
 }
 
 func main() {
@@ -82,9 +594,25 @@ func main() {
 	}
 	defer db.Close()
 
+	if os.Getenv("REPORT_SIGNING_KEY") == "" {
+		log.Println("REPORT_SIGNING_KEY is not set, so recertification campaigns can't be completed")
+	}
+	if os.Getenv("EXPORT_SIGNING_KEY") == "" && os.Getenv("REPORT_SIGNING_KEY") == "" {
+		log.Println("EXPORT_SIGNING_KEY is not set, so export jobs can't be requested")
+	}
+
 	// Create tables if they don't exist
 	createTablesIfNotExist(db)
 
+	// Start background jobs
+	go runPeriodically(time.Minute, "transfer expiry", func() error { return controllers.ExpireTransfers(db) })
+	go runPeriodically(time.Minute, "assignment expiry", func() error { return controllers.ExpireAssignments(db) })
+	go runPeriodically(time.Minute, "checkout expiry", func() error { return controllers.ExpireCheckouts(db) })
+	go runPeriodically(5*time.Minute, "anomaly detection", func() error { return controllers.DetectAnomalies(db) })
+	go runPeriodically(time.Minute, "export jobs", func() error { return controllers.ProcessExportJobs(db) })
+	go runPeriodically(time.Hour, "export cleanup", func() error { return controllers.CleanupExports(db) })
+	go runPeriodically(time.Hour, "idempotency key expiry", func() error { return controllers.ExpireIdempotencyKeys(db) })
+
 	// Initialize the router
 	router := mux.NewRouter()
 
@@ -94,6 +622,7 @@ func main() {
 	// Apply JSON middleware
 	router.Use(jsonContentTypeMiddleware)
 	router.Use(corsMiddleware)
+	router.Use(controllers.IdempotencyMiddleware(db))
 
 	// Start the server
 	log.Fatal(http.ListenAndServe(":8000", router))
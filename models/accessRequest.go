@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+type AccessRequest struct {
+	ID            int        `json:"id"`
+	KeyID         int        `json:"key_id"`
+	StaffID       int        `json:"staff_id"`
+	Justification string     `json:"justification"`
+	StartDate     time.Time  `json:"start_date"`
+	EndDate       time.Time  `json:"end_date"`
+	Status        string     `json:"status"`
+	ApproverID    int        `json:"approver_id"`
+	DecisionNote  string     `json:"decision_note"`
+	KeyCopyID     int        `json:"key_copy_id"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DecidedAt     *time.Time `json:"decided_at"`
+}
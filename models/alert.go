@@ -0,0 +1,40 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type Alert struct {
+	ID             int        `json:"id"`
+	Type           string     `json:"type"`
+	Severity       string     `json:"severity"`
+	Message        string     `json:"message"`
+	KeyCopyID      int        `json:"key_copy_id"`
+	StaffID        int        `json:"staff_id"`
+	Status         string     `json:"status"`
+	CreatedAt      time.Time  `json:"created_at"`
+	AcknowledgedBy int        `json:"acknowledged_by"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at"`
+	ResolvedBy     int        `json:"resolved_by"`
+	ResolvedAt     *time.Time `json:"resolved_at"`
+	ResolutionNote string     `json:"resolution_note"`
+}
+
+type AlertEvent struct {
+	ID        int       `json:"id"`
+	AlertID   int       `json:"alert_id"`
+	Event     string    `json:"event"`
+	StaffID   int       `json:"staff_id"`
+	Note      string    `json:"note"`
+	CreatedAt time.Time `json:"created_at"`
+	Alert     Alert     `json:"alert"`
+}
+
+type AnomalyRule struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Enabled     bool            `json:"enabled"`
+	Params      json.RawMessage `json:"params"`
+	LastRunAt   *time.Time      `json:"last_run_at"`
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+type AuditLog struct {
+	ID          int       `json:"id"`
+	Action      string    `json:"action"`
+	PerformedBy int       `json:"performed_by"`
+	Entity      string    `json:"entity"`
+	EntityID    int       `json:"entity_id"`
+	Reason      string    `json:"reason"`
+	Details     string    `json:"details"`
+	CreatedAt   time.Time `json:"created_at"`
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+type Cabinet struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Adapter   string    `json:"adapter"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CabinetSlot struct {
+	CabinetID int `json:"cabinet_id"`
+	Slot      int `json:"slot"`
+	KeyCopyID int `json:"key_copy_id"`
+}
+
+type CabinetEvent struct {
+	ID         int       `json:"id"`
+	CabinetID  int       `json:"cabinet_id"`
+	Slot       int       `json:"slot"`
+	Event      string    `json:"event"`
+	StaffID    int       `json:"staff_id"`
+	KeyCopyID  int       `json:"key_copy_id"`
+	Outcome    string    `json:"outcome"`
+	Detail     string    `json:"detail"`
+	OccurredAt time.Time `json:"occurred_at"`
+	ReceivedAt time.Time `json:"received_at"`
+}
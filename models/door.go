@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+type Door struct {
+	ID    int    `json:"id"`
+	Code  string `json:"code"`
+	Name  string `json:"name"`
+	KeyID int    `json:"key_id"`
+}
+
+type DoorEvent struct {
+	ID             int       `json:"id"`
+	DoorCode       string    `json:"door_code"`
+	DoorID         int       `json:"door_id"`
+	KeyID          int       `json:"key_id"`
+	Event          string    `json:"event"`
+	StaffID        int       `json:"staff_id"`
+	OccurredAt     time.Time `json:"occurred_at"`
+	HolderStaffIDs []int     `json:"holder_staff_ids"`
+	Flagged        bool      `json:"flagged"`
+	ImportedAt     time.Time `json:"imported_at"`
+}
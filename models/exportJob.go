@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+type ExportJob struct {
+	ID          int        `json:"id"`
+	Dataset     string     `json:"dataset"`
+	Format      string     `json:"format"`
+	From        *time.Time `json:"from"`
+	To          *time.Time `json:"to"`
+	RequestedBy int        `json:"requested_by"`
+	Status      string     `json:"status"`
+	Rows        int        `json:"rows"`
+	Error       string     `json:"error"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	DownloadURL string     `json:"download_url,omitempty"`
+}
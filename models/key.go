@@ -1,8 +1,11 @@
 package models
 
 type Key struct {
-	ID          int    `json:"id"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	StaffID     int    `json:"staff_id"`
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	Description    string `json:"description"`
+	StaffID        int    `json:"staff_id"`
+	ClearanceLevel int    `json:"clearance_level"`
+	DualControl    bool   `json:"dual_control"`
+	ExternalID     string `json:"external_id"`
 }
@@ -1,7 +1,14 @@
 package models
 
+import "time"
+
 type KeyCopy struct {
-	ID      int `json:"id"`
-	KeyID   int `json:"key_id"`
-	StaffID int `json:"staff_id"`
+	ID             int        `json:"id"`
+	KeyID          int        `json:"key_id"`
+	Serial         string     `json:"serial"`
+	StaffID        int        `json:"staff_id"`
+	WitnessStaffID int        `json:"witness_staff_id"`
+	Status         string     `json:"status"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	Expired        bool       `json:"expired"`
 }
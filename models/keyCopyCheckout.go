@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+type KeyCopyCheckout struct {
+	ID              int        `json:"id"`
+	KeyCopyID       int        `json:"key_copy_id"`
+	StaffID         int        `json:"staff_id"`
+	WitnessStaffID  int        `json:"witness_staff_id"`
+	AccessRequestID int        `json:"access_request_id"`
+	Status          string     `json:"status"`
+	LoanExpiresAt   *time.Time `json:"loan_expires_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	ConfirmedAt     *time.Time `json:"confirmed_at"`
+}
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+type KeyCopyHistory struct {
+	ID              int       `json:"id"`
+	KeyCopyID       int       `json:"key_copy_id"`
+	KeyID           int       `json:"key_id"`
+	Action          string    `json:"action"`
+	PreviousStaffID int       `json:"previous_staff_id"`
+	StaffID         int       `json:"staff_id"`
+	PerformedBy     int       `json:"performed_by"`
+	Note            string    `json:"note"`
+	CreatedAt       time.Time `json:"created_at"`
+}
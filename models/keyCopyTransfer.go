@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+type KeyCopyTransfer struct {
+	ID                  int        `json:"id"`
+	KeyCopyID           int        `json:"key_copy_id"`
+	FromStaffID         int        `json:"from_staff_id"`
+	ToStaffID           int        `json:"to_staff_id"`
+	Status              string     `json:"status"`
+	Note                string     `json:"note"`
+	ClearanceOverridden bool       `json:"clearance_overridden"`
+	CreatedAt           time.Time  `json:"created_at"`
+	ExpiresAt           time.Time  `json:"expires_at"`
+	RespondedAt         *time.Time `json:"responded_at"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+type LabelTemplate struct {
+	ID           int       `json:"id"`
+	Organisation string    `json:"organisation"`
+	ZPL          string    `json:"zpl"`
+	WidthDots    int       `json:"width_dots"`
+	HeightDots   int       `json:"height_dots"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+type RecertificationCampaign struct {
+	ID          int        `json:"id"`
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	CreatedBy   int        `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DueAt       *time.Time `json:"due_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	SignedBy    int        `json:"signed_by"`
+	Signature   string     `json:"signature"`
+}
+
+type RecertificationItem struct {
+	ID           int        `json:"id"`
+	CampaignID   int        `json:"campaign_id"`
+	KeyCopyID    int        `json:"key_copy_id"`
+	KeyID        int        `json:"key_id"`
+	StaffID      int        `json:"staff_id"`
+	ReviewerID   int        `json:"reviewer_id"`
+	Decision     string     `json:"decision"`
+	DecisionNote string     `json:"decision_note"`
+	DecidedAt    *time.Time `json:"decided_at"`
+	ReturnTaskID int        `json:"return_task_id"`
+}
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+type Reservation struct {
+	ID        int       `json:"id"`
+	KeyID     int       `json:"key_id"`
+	KeyCopyID int       `json:"key_copy_id"`
+	StaffID   int       `json:"staff_id"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	Status    string    `json:"status"`
+}
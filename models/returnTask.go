@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+type ReturnTask struct {
+	ID          int        `json:"id"`
+	KeyCopyID   int        `json:"key_copy_id"`
+	StaffID     int        `json:"staff_id"`
+	Reason      string     `json:"reason"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DueAt       *time.Time `json:"due_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+}
@@ -1,7 +1,15 @@
 package models
 
+import "time"
+
 type Staff struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
-	Role string `json:"role"`
+	ID             int        `json:"id"`
+	Name           string     `json:"name"`
+	Role           string     `json:"role"`
+	StaffType      string     `json:"staff_type"`
+	ValidFrom      *time.Time `json:"valid_from"`
+	ValidUntil     *time.Time `json:"valid_until"`
+	ClearanceLevel int        `json:"clearance_level"`
+	ManagerID      int        `json:"manager_id"`
+	ExternalID     string     `json:"external_id"`
 }
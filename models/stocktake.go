@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+type StocktakeSession struct {
+	ID         int        `json:"id"`
+	OperatorID int        `json:"operator_id"`
+	KeyID      int        `json:"key_id"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ClosedAt   *time.Time `json:"closed_at"`
+}
+
+type StocktakeScan struct {
+	ID              int       `json:"id"`
+	SessionID       int       `json:"session_id"`
+	KeyCopyID       int       `json:"key_copy_id"`
+	ObservedStaffID int       `json:"observed_staff_id"`
+	ScannedAt       time.Time `json:"scanned_at"`
+}
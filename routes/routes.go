@@ -13,15 +13,134 @@ func SetupRoutes(router *mux.Router, db *sql.DB) {
 	router.HandleFunc("/keys", controllers.GetKeys(db)).Methods("GET", "OPTIONS")
 	router.HandleFunc("/keys/{id}", controllers.GetKey(db)).Methods("GET", "OPTIONS")
 	router.HandleFunc("/keys", controllers.CreateKey(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/keys/bulk", controllers.BulkKeys(db)).Methods("POST", "OPTIONS")
 	router.HandleFunc("/keys/{id}", controllers.UpdateKey(db)).Methods("PUT", "OPTIONS")
 	router.HandleFunc("/keys/{id}", controllers.DeleteKey(db)).Methods("DELETE", "OPTIONS")
 
+	// Reservation Routes
+	router.HandleFunc("/keys/{id}/reservations", controllers.GetReservations(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/keys/{id}/reservations", controllers.CreateReservation(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/keys/{id}/reservations/{reservationId}", controllers.CancelReservation(db)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/keys/{id}/availability", controllers.GetKeyAvailability(db)).Methods("GET", "OPTIONS")
+
 	// Key Copy Routes
 	router.HandleFunc("/key-copies", controllers.GetKeyCopies(db)).Methods("GET", "OPTIONS")
 	router.HandleFunc("/key-copies", controllers.CreateKeyCopy(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/key-copies/bulk", controllers.BulkKeyCopies(db)).Methods("POST", "OPTIONS")
 	router.HandleFunc("/key-copies/{id}", controllers.UpdateKeyCopy(db)).Methods("PUT", "OPTIONS")
 	router.HandleFunc("/key-copies/{id}", controllers.DeleteKeyCopy(db)).Methods("DELETE", "OPTIONS")
 
+	// Label Routes
+	router.HandleFunc("/key-copies/serial/{serial}", controllers.GetKeyCopyBySerial(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/key-copies/{id}/label", controllers.GetKeyCopyLabel(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/key-copies/labels", controllers.CreateLabelSheet(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/key-copies/labels/zpl", controllers.CreateZPLLabels(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/label-templates", controllers.GetLabelTemplates(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/label-templates", controllers.CreateLabelTemplate(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/label-templates/{id}", controllers.UpdateLabelTemplate(db)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/label-templates/{id}", controllers.DeleteLabelTemplate(db)).Methods("DELETE", "OPTIONS")
+
+	// Transfer Routes
+	router.HandleFunc("/key-copies/{id}/transfers", controllers.GetKeyCopyTransfers(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/key-copies/{id}/transfers", controllers.CreateTransfer(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/staffs/{id}/transfers", controllers.GetStaffTransfers(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/transfers/{id}/accept", controllers.AcceptTransfer(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/transfers/{id}/decline", controllers.DeclineTransfer(db)).Methods("POST", "OPTIONS")
+
+	// Checkout Routes
+	router.HandleFunc("/key-copies/{id}/checkouts", controllers.CreateCheckout(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/checkouts/{id}", controllers.GetCheckout(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/checkouts/{id}/confirm", controllers.ConfirmCheckout(db)).Methods("POST", "OPTIONS")
+
+	// Access Request Routes
+	router.HandleFunc("/access-requests", controllers.CreateAccessRequest(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/access-requests/{id}", controllers.GetAccessRequest(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/access-requests/{id}/approve", controllers.ApproveAccessRequest(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/access-requests/{id}/reject", controllers.RejectAccessRequest(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/access-requests/{id}/pickup", controllers.PickupAccessRequest(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/staffs/{id}/access-requests", controllers.GetStaffAccessRequests(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/staffs/{id}/pending-approvals", controllers.GetPendingApprovals(db)).Methods("GET", "OPTIONS")
+
+	// Recertification Routes
+	router.HandleFunc("/recertifications", controllers.GetCampaigns(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/recertifications", controllers.CreateCampaign(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/recertifications/{id}", controllers.GetCampaign(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/recertifications/{id}/items", controllers.GetCampaignItems(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/recertifications/{id}/complete", controllers.CompleteCampaign(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/recertifications/{id}/report", controllers.GetCampaignReport(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/recertification-items/{id}/decision", controllers.DecideCampaignItem(db)).Methods("POST", "OPTIONS")
+
+	// Return Task Routes
+	router.HandleFunc("/return-tasks", controllers.GetReturnTasks(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/return-tasks/{id}/complete", controllers.CompleteReturnTask(db)).Methods("POST", "OPTIONS")
+
+	// Stocktake Routes
+	router.HandleFunc("/stocktakes", controllers.CreateStocktake(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/stocktakes/{id}", controllers.GetStocktake(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/stocktakes/{id}/scans", controllers.CreateStocktakeScan(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/stocktakes/{id}/scans/{keyCopyId}", controllers.DeleteStocktakeScan(db)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/stocktakes/{id}/close", controllers.CloseStocktake(db)).Methods("POST", "OPTIONS")
+
+	// History Routes
+	router.HandleFunc("/keys/{id}/holders", controllers.GetKeyHolders(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/staffs/{id}/keys", controllers.GetStaffKeys(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/key-copies/{id}/history", controllers.GetKeyCopyHistory(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/staffs/{id}/timeline", controllers.GetStaffTimeline(db)).Methods("GET", "OPTIONS")
+
+	// Cabinet Routes
+	router.HandleFunc("/cabinets", controllers.GetCabinets(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/cabinets", controllers.CreateCabinet(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/cabinets/{id}/slots", controllers.GetCabinetSlots(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/cabinets/{id}/slots/{slot}", controllers.UpdateCabinetSlot(db)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/cabinets/{id}/slots/{slot}", controllers.DeleteCabinetSlot(db)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/cabinets/{id}/events", controllers.GetCabinetEvents(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/cabinets/{id}/events", controllers.IngestCabinetEvents(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/cabinets/{id}/simulate", controllers.SimulateCabinetEvent(db)).Methods("POST", "OPTIONS")
+
+	// Door Routes
+	router.HandleFunc("/doors", controllers.GetDoors(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/doors", controllers.CreateDoor(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/doors/{id}", controllers.UpdateDoor(db)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/doors/{id}", controllers.DeleteDoor(db)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/door-events", controllers.GetDoorEvents(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/door-events/import", controllers.ImportDoorEvents(db)).Methods("POST", "OPTIONS")
+
+	// Alert Routes
+	router.HandleFunc("/alerts", controllers.GetAlerts(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/alerts/events", controllers.StreamAlertEvents(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/alerts/{id}/acknowledge", controllers.AcknowledgeAlert(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/alerts/{id}/resolve", controllers.ResolveAlert(db)).Methods("POST", "OPTIONS")
+
+	// Anomaly Rule Routes
+	router.HandleFunc("/anomaly-rules", controllers.GetAnomalyRules(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/anomaly-rules/run", controllers.RunAnomalyRules(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/anomaly-rules/{name}", controllers.UpdateAnomalyRule(db)).Methods("PUT", "OPTIONS")
+
+	// Dashboard Routes
+	router.HandleFunc("/dashboard", controllers.GetDashboard(db)).Methods("GET", "OPTIONS")
+
+	// Report Routes
+	router.HandleFunc("/reports/expired-assignments", controllers.GetExpiredAssignments(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/reports/usage", controllers.GetUsageReport(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/reports/copy-recommendations", controllers.GetCopyRecommendations(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/reports/key-register", controllers.GetKeyRegister(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/reports/access-statements/{id}", controllers.GetAccessStatement(db)).Methods("GET", "OPTIONS")
+
+	// Import Routes
+	router.HandleFunc("/import/{entity}", controllers.ImportRecords(db)).Methods("POST", "OPTIONS")
+
+	// Export Routes
+	router.HandleFunc("/exports", controllers.CreateExportJob(db)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/exports/{id}", controllers.GetExportJob(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/exports/{id}/download", controllers.DownloadExport(db)).Methods("GET", "OPTIONS")
+
+	// Admin Routes
+	router.HandleFunc("/admin/backup", controllers.GetBackup(db)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/admin/restore", controllers.RestoreBackup(db)).Methods("POST", "OPTIONS")
+
+	// Audit Routes
+	router.HandleFunc("/audit-logs", controllers.GetAuditLogs(db)).Methods("GET", "OPTIONS")
+
 	// Staff Routes
 	router.HandleFunc("/staffs", controllers.GetStaffs(db)).Methods("GET", "OPTIONS")
 	router.HandleFunc("/staffs", controllers.CreateStaff(db)).Methods("POST", "OPTIONS")